@@ -1,7 +1,26 @@
 package util
 
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
 //go:generate msgp -v -io=false -tests=false -unexported=true
 
+// ErrInvalidDeadNodes - the recorded dead nodes can't be decoded
+var ErrInvalidDeadNodes = errors.New("invalid dead nodes encoding")
+
+// The dead nodes of a round are encoded as a header of the format marker and version, followed by
+// the sorted node keys, each prefixed by its length. The marker is a msgp positive fixint, which
+// never starts a msgp encoded deadNodes map, so both formats can be read from the same column family.
+const (
+	deadNodesFormatMarker  = 0x00
+	deadNodesFormatVersion = 1
+	deadNodesHeaderLen     = 2
+)
+
+// deadNodes - the legacy msgp encoding of the dead nodes, keyed by the hex node keys
 type deadNodes struct {
 	Nodes map[string]bool `json:"n"` // value as bool type to pass msgp build error
 }
@@ -14,3 +33,73 @@ func (d *deadNodes) decode(data []byte) error {
 func (d *deadNodes) encode() ([]byte, error) {
 	return d.MarshalMsg(nil)
 }
+
+// encodeDeadNodeKeys - encode the node keys sorted and deduplicated
+func encodeDeadNodeKeys(keys []Key) ([]byte, error) {
+	sorted := make([]Key, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+
+	size := deadNodesHeaderLen
+	for _, k := range sorted {
+		size += 1 + len(k)
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, deadNodesFormatMarker, deadNodesFormatVersion)
+	var prev Key
+	for i, k := range sorted {
+		if len(k) == 0 || len(k) > 0xff {
+			return nil, ErrInvalidDeadNodes
+		}
+		if i > 0 && bytes.Equal(prev, k) {
+			continue
+		}
+		buf = append(buf, byte(len(k)))
+		buf = append(buf, k...)
+		prev = k
+	}
+	return buf, nil
+}
+
+// iterateDeadNodeKeys - call the handler with each node key of the encoded dead nodes, in either format.
+// The key is only valid during the call.
+func iterateDeadNodeKeys(data []byte, handler func(key []byte) error) error {
+	if len(data) == 0 || data[0] != deadNodesFormatMarker {
+		return iterateLegacyDeadNodeKeys(data, handler)
+	}
+	if len(data) < deadNodesHeaderLen || data[1] != deadNodesFormatVersion {
+		return ErrInvalidDeadNodes
+	}
+
+	data = data[deadNodesHeaderLen:]
+	for len(data) > 0 {
+		n := int(data[0])
+		if n == 0 || len(data) < 1+n {
+			return ErrInvalidDeadNodes
+		}
+		if err := handler(data[1 : 1+n]); err != nil {
+			return err
+		}
+		data = data[1+n:]
+	}
+	return nil
+}
+
+func iterateLegacyDeadNodeKeys(data []byte, handler func(key []byte) error) error {
+	dn := deadNodes{}
+	if err := dn.decode(data); err != nil {
+		return err
+	}
+	for k := range dn.Nodes {
+		key, err := fromHex(k)
+		if err != nil {
+			return err
+		}
+		if err := handler(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/encryption"
+)
+
+func deadNodesTestKeys(n int) []Key {
+	keys := make([]Key, 0, n)
+	for i := 0; i < n; i++ {
+		keys = append(keys, encryption.RawHash(fmt.Sprintf("node_%d", i)))
+	}
+	return keys
+}
+
+func collectDeadNodeKeys(t *testing.T, data []byte) []Key {
+	var keys []Key
+	require.NoError(t, iterateDeadNodeKeys(data, func(key []byte) error {
+		keys = append(keys, concat(key))
+		return nil
+	}))
+	return keys
+}
+
+func TestDeadNodes_Encoding(t *testing.T) {
+	keys := deadNodesTestKeys(100)
+	// duplicates are dropped
+	data, err := encodeDeadNodeKeys(append(keys, keys[:10]...))
+	require.NoError(t, err)
+	require.Equal(t, deadNodesHeaderLen+100*33, len(data))
+
+	decoded := collectDeadNodeKeys(t, data)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	require.Equal(t, keys, decoded)
+
+	empty, err := encodeDeadNodeKeys(nil)
+	require.NoError(t, err)
+	require.Empty(t, collectDeadNodeKeys(t, empty))
+
+	require.Equal(t, ErrInvalidDeadNodes, iterateDeadNodeKeys(data[:len(data)-1], func([]byte) error { return nil }))
+}
+
+func TestDeadNodes_LegacyEncoding(t *testing.T) {
+	keys := deadNodesTestKeys(20)
+	dn := deadNodes{Nodes: make(map[string]bool)}
+	for _, k := range keys {
+		dn.Nodes[ToHex(k)] = true
+	}
+	data, err := dn.encode()
+	require.NoError(t, err)
+
+	decoded := collectDeadNodeKeys(t, data)
+	require.ElementsMatch(t, keys, decoded)
+}
+
+func TestPNodeDB_PruneMixedDeadNodesFormats(t *testing.T) {
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+
+	var (
+		nodes  []Node
+		legacy = deadNodes{Nodes: make(map[string]bool)}
+	)
+	for i := 0; i < 20; i++ {
+		n := NewLeafNode(Path("0a"), Path(fmt.Sprintf("%02x", i)), Sequence(1), &Txn{fmt.Sprintf("%d", i)})
+		require.NoError(t, pndb.PutNode(n.GetHashBytes(), n))
+		if i < 10 {
+			legacy.Nodes[n.GetHash()] = true
+		} else {
+			nodes = append(nodes, n)
+		}
+	}
+
+	// a round recorded by a previous version
+	data, err := legacy.encode()
+	require.NoError(t, err)
+	require.NoError(t, pndb.db.PutCF(pndb.wo, pndb.deadNodesCFH, uint64ToBytes(1), data))
+	require.NoError(t, pndb.RecordDeadNodes(nodes, 2))
+
+	require.Equal(t, int64(20), pndb.Size(context.TODO()))
+	require.NoError(t, pndb.PruneBelowVersion(context.TODO(), 3))
+	require.Equal(t, int64(0), pndb.Size(context.TODO()))
+}
@@ -29,6 +29,28 @@ type MerklePatriciaTrie struct {
 	missingNodeKeys []Key
 	cache           *statecache.TransactionCache
 	deleteNodes     []Node // delete nodes that added when sync from remote
+
+	flat       FlatDB              // optional flat index of the values
+	pathFilter *PathFilter         // optional filter of the absent paths
+	countMode  bool                // keep the leaf counts in the full and extension nodes
+	dirtyPaths map[string]struct{} // paths changed since the change collector start root
+	dirtyAll   bool                // the changed paths are unknown
+	subPrefix  Path                // the leaf prefix of the nodes of a sub trie, nil for a top level trie
+
+	history         HistoryDB // optional index of the value changes
+	historyPrefixes []Path    // the prefixes of the paths recorded in the history, all if empty
+
+	observers []MPTObserver // called with the value changes before they are applied
+
+	indexes []*SecondaryIndex // the secondary indexes kept in sync with the values
+
+	usageDB       UsageDB                 // optional store of the storage usage by root
+	usagePrefixes []Path                  // the prefixes with accounted storage usage
+	usage         map[string]StorageUsage // the storage usage of the prefixes at the usage root
+	usageRoot     Key                     // the root the usage is up to date with
+	nodeLog       *nodeLog                // the nodes changed by the accounted write
+
+	meter *AccessMeter // optional counter of the node reads and writes
 }
 
 /*NewMerklePatriciaTrie - create a new patricia merkle trie */
@@ -60,6 +82,7 @@ func (mpt *MerklePatriciaTrie) getNode(key Key) (n Node, err error) {
 	v, ok := mpt.cache.Get(string(key))
 	if ok {
 		mpt.cache.AddHit()
+		mpt.meter.read(true)
 		n = v.(Node)
 		return
 	}
@@ -70,6 +93,7 @@ func (mpt *MerklePatriciaTrie) getNode(key Key) (n Node, err error) {
 	}
 	if err == nil {
 		mpt.cache.AddMiss()
+		mpt.meter.read(false)
 		mpt.cache.Set(string(key), n)
 	}
 	return
@@ -156,6 +180,14 @@ func (mpt *MerklePatriciaTrie) GetNodeValueRaw(path Path) ([]byte, error) {
 		return nil, ErrValueNotPresent
 	}
 
+	if mpt.pathAbsent(path) {
+		return nil, ErrValueNotPresent
+	}
+
+	if v, ok, err := mpt.getFlatValue(path); ok {
+		return v, err
+	}
+
 	rootNode, err := mpt.getNode(rootKey)
 	if err != nil {
 		return nil, err
@@ -192,19 +224,69 @@ func (mpt *MerklePatriciaTrie) Insert(path Path, value MPTSerializable) (Key, er
 		return nil, err
 	}
 
-	valueCopy := &SecureSerializableValue{eval}
 	mpt.mutex.Lock()
 	defer mpt.mutex.Unlock()
-	var newRootHash Key
+	var old []byte
+	indexed := mpt.indexed(path)
+	if len(mpt.observers) > 0 || indexed {
+		if old, err = mpt.valueAt(path); err != nil {
+			return nil, err
+		}
+	}
+	if len(mpt.observers) > 0 {
+		if err := mpt.notify(MutationInsert, path, old, eval); err != nil {
+			return nil, err
+		}
+	}
+	var dels, puts []Path
+	if indexed {
+		if dels, puts, err = mpt.indexUpdates(path, old, eval); err != nil {
+			return nil, err
+		}
+	}
+
+	put := mpt.insertValue
+	if _, ok := value.(*subTrieCommit); ok {
+		put = mpt.putValue
+	}
+	newRootHash, err := put(path, eval)
+	if err != nil {
+		return nil, err
+	}
+	if indexed {
+		return mpt.updateIndexes(path, dels, puts)
+	}
+	return newRootHash, nil
+}
+
+// insertValue - unsafe, insert the encoded value at the path
+func (mpt *MerklePatriciaTrie) insertValue(path Path, eval []byte) (Key, error) {
+	if err := mpt.releaseSubTrie(path, eval); err != nil {
+		return nil, err
+	}
+	return mpt.putValue(path, eval)
+}
+
+// putValue - unsafe, insert the value at the path, a sub trie referenced by the value replaced is kept
+func (mpt *MerklePatriciaTrie) putValue(path Path, eval []byte) (Key, error) {
+	var (
+		valueCopy   = &SecureSerializableValue{eval}
+		newRootHash Key
+		err         error
+	)
+	positions := mpt.startAccounting(path)
 	if mpt.root == nil {
-		_, newRootHash, err = mpt.insertLeaf(nil, valueCopy, Path(""), path)
+		_, newRootHash, err = mpt.insertLeaf(nil, valueCopy, mpt.rootPrefix(), path)
 	} else {
-		_, newRootHash, err = mpt.insert(valueCopy, mpt.root, Path(""), path)
+		_, newRootHash, err = mpt.insert(valueCopy, mpt.root, mpt.rootPrefix(), path)
 	}
 	if err != nil {
+		mpt.finishAccounting(positions, true, path)
 		return nil, err
 	}
 	mpt.setRoot(newRootHash)
+	mpt.markDirty(path)
+	mpt.finishAccounting(positions, false, path)
 	return newRootHash, nil
 }
 
@@ -212,12 +294,52 @@ func (mpt *MerklePatriciaTrie) Insert(path Path, value MPTSerializable) (Key, er
 func (mpt *MerklePatriciaTrie) Delete(path Path) (Key, error) {
 	mpt.mutex.Lock()
 	defer mpt.mutex.Unlock()
+	var (
+		old     []byte
+		err     error
+		indexed = mpt.indexed(path)
+	)
+	if len(mpt.observers) > 0 || indexed {
+		if old, err = mpt.valueAt(path); err != nil {
+			return nil, err
+		}
+	}
+	if len(mpt.observers) > 0 && old != nil {
+		if err := mpt.notify(MutationDelete, path, old, nil); err != nil {
+			return nil, err
+		}
+	}
+	var dels []Path
+	if indexed {
+		if dels, _, err = mpt.indexUpdates(path, old, nil); err != nil {
+			return nil, err
+		}
+	}
 
-	_, newRootHash, err := mpt.delete(mpt.root, Path(""), path)
+	newRootHash, err := mpt.deleteValue(path)
 	if err != nil {
 		return nil, err
 	}
+	if indexed {
+		return mpt.updateIndexes(path, dels, nil)
+	}
+	return newRootHash, nil
+}
+
+// deleteValue - unsafe, delete the value at the path
+func (mpt *MerklePatriciaTrie) deleteValue(path Path) (Key, error) {
+	if err := mpt.releaseSubTrie(path, nil); err != nil {
+		return nil, err
+	}
+	positions := mpt.startAccounting(path)
+	_, newRootHash, err := mpt.delete(mpt.root, mpt.rootPrefix(), path)
+	if err != nil {
+		mpt.finishAccounting(positions, true, path)
+		return nil, err
+	}
 	mpt.setRoot(newRootHash)
+	mpt.markDirty(path)
+	mpt.finishAccounting(positions, false, path)
 	return newRootHash, nil
 }
 
@@ -257,11 +379,51 @@ func (mpt *MerklePatriciaTrie) GetChangeCount() int {
 	return len(mpt.ChangeCollector.GetChanges())
 }
 
-/*SaveChanges - implement interface */
+// SaveChanges - implement interface. The trie is locked for reading while saving, the flat db, the
+// path filter, the history and the storage usage of the trie are updated along with the nodes. The
+// nodes are written from a copy of the changes, the root and the version taken under the lock, so the
+// write left running when the context is done doesn't use the trie.
 func (mpt *MerklePatriciaTrie) SaveChanges(ctx context.Context, ndb NodeDB, includeDeletes bool) error {
 	mpt.mutex.RLock()
-	defer mpt.mutex.RUnlock()
 	cc := mpt.ChangeCollector.Clone()
+	root, version, rc := mpt.root, mpt.Version, mpt.rootCommit()
+	fdb, pf := mpt.flat, mpt.pathFilter
+	if err := mpt.saveChanges(ctx, cc, ndb, includeDeletes, version, rc); err != nil {
+		mpt.mutex.RUnlock()
+		return err
+	}
+
+	flatErr := mpt.updateFlat(cc)
+	filterErr := mpt.updatePathFilter(cc, ndb)
+	mpt.updateHistory(cc)
+	usage := mpt.saveUsage()
+	mpt.mutex.RUnlock()
+	if flatErr == nil && filterErr == nil && usage == nil {
+		return nil
+	}
+
+	// the trie may be changed once unlocked, only the indexes that failed are dropped
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	if flatErr != nil && mpt.flat == fdb {
+		mpt.dropFlat(flatErr)
+	}
+	if filterErr != nil && mpt.pathFilter == pf {
+		mpt.dropPathFilter(filterErr)
+	}
+	if usage != nil && bytes.Equal(mpt.root, root) {
+		mpt.usage, mpt.usageRoot = usage, root
+	}
+	return nil
+}
+
+// saveChanges - unsafe, save the copy of the collected changes of the version to the node db
+func (mpt *MerklePatriciaTrie) saveChanges(ctx context.Context, cc ChangeCollectorI, ndb NodeDB,
+	includeDeletes bool, version Sequence, rc *rootCommit) error {
+	// the reverse diff goes first, so that the round can be undone whatever part of it is written
+	if err := mpt.saveReverseDiff(cc, ndb); err != nil {
+		return err
+	}
 
 	doneC := make(chan struct{})
 	errC := make(chan error, 1)
@@ -271,10 +433,10 @@ func (mpt *MerklePatriciaTrie) SaveChanges(ctx context.Context, ndb NodeDB, incl
 			close(doneC)
 			logging.Logger.Debug("MPT save changes success", zap.Any("duration", time.Since(ts)))
 		}()
-		err := cc.UpdateChanges(ndb, mpt.Version, includeDeletes)
+		err := updateChanges(cc, ndb, version, includeDeletes, rc)
 		if err != nil {
 			logging.Logger.Error("MPT save changes failed",
-				zap.Any("version", mpt.Version),
+				zap.Any("version", version),
 				zap.Int("changes", len(cc.GetChanges())),
 				zap.Error(err))
 			errC <- err
@@ -294,6 +456,11 @@ func (mpt *MerklePatriciaTrie) SaveChanges(ctx context.Context, ndb NodeDB, incl
 			zap.Error(err))
 		return err
 	case <-doneC:
+		select {
+		case err := <-errC:
+			return err
+		default:
+		}
 	}
 	return nil
 }
@@ -614,72 +781,7 @@ func (mpt *MerklePatriciaTrie) deleteAtNode(key Key, node Node, prefix, path Pat
 		if err != nil {
 			return nil, nil, err
 		}
-		if ckey == nil {
-			numChildren := nodeImpl.GetNumChildren()
-			if numChildren == 1 {
-				if nodeImpl.HasValue() { // a full node with no children anymore but with a value becomes a leaf node
-					return mpt.insertLeaf(node, nodeImpl.GetValue(), concat(prefix), nil)
-				}
-				// a full node with no children anymore and no value should be removed
-				return nil, nil, nil
-			}
-			if numChildren == 2 {
-				if !nodeImpl.HasValue() {
-					// a full node with a single child and no value should lift up the child
-					tempNode := nodeImpl.Clone().(*FullNode)
-					// clear the child being deleted
-					tempNode.PutChild(path[0], nil)
-					var otherChildKey []byte
-					var oidx byte
-					for idx, pe := range PathElements {
-						child := tempNode.GetChild(pe)
-						if child != nil {
-							oidx = byte(idx)
-							otherChildKey = child
-							break
-						}
-					}
-					ochild, err := mpt.getNode(otherChildKey)
-					if err != nil {
-						return nil, nil, err
-					}
-					npath := []byte{nodeImpl.indexToByte(oidx)}
-					var nnode Node
-					switch onodeImpl := ochild.(type) {
-					case *FullNode:
-						nnode = NewExtensionNode(npath, otherChildKey)
-					case *LeafNode:
-						if onodeImpl.Path != nil {
-							npath = append(npath, onodeImpl.Path...)
-						}
-						lnode := ochild.Clone().(*LeafNode)
-						lnode.SetOrigin(mpt.Version)
-						lnode.Path = npath
-						lnode.Prefix = concat(prefix)
-						nnode = lnode
-						if err := mpt.deleteNode(ochild); err != nil {
-							return nil, nil, err
-						}
-					case *ExtensionNode:
-						if onodeImpl.Path != nil {
-							npath = append(npath, onodeImpl.Path...)
-						}
-						enode := ochild.Clone().(*ExtensionNode)
-						enode.Path = npath
-						nnode = enode
-						if err := mpt.deleteNode(ochild); err != nil {
-							return nil, nil, err
-						}
-					default:
-						panic(fmt.Sprintf("unknown node type: %T %v %T", ochild, ochild, mpt.db))
-					}
-					return mpt.insertNode(node, nnode)
-				}
-			}
-		}
-		nnode := nodeImpl.Clone().(*FullNode)
-		nnode.PutChild(path[0], ckey)
-		return mpt.insertNode(node, nnode)
+		return mpt.deleteFullNodeChild(node, nodeImpl, prefix, path[0], ckey)
 	case *LeafNode:
 		if bytes.Equal(path, nodeImpl.Path) {
 			return mpt.deleteAfterPathTraversal(node)
@@ -697,36 +799,112 @@ func (mpt *MerklePatriciaTrie) deleteAtNode(key Key, node Node, prefix, path Pat
 		if err != nil {
 			return nil, nil, err
 		}
-		switch cnodeImpl := cnode.(type) {
-		case *LeafNode:
-			// if extension child changes from full node to leaf, convert the extension into a leaf node
-			nnode := cnode.Clone().(*LeafNode)
-			nnode.SetOrigin(mpt.Version)
-			nnode.Prefix = concat(prefix)
-			nnode.Path = append(nodeImpl.Path, cnodeImpl.Path...)
-			nnode.SetValue(cnodeImpl.GetValue())
-			if err := mpt.deleteNode(cnode); err != nil {
-				return nil, nil, err
+		return mpt.deleteExtensionChild(node, nodeImpl, prefix, cnode, ckey)
+	default:
+		panic(fmt.Sprintf("unknown node type: %T %v", node, node))
+	}
+}
+
+// deleteFullNodeChild - update the full node after the child at the path element is deleted
+// or replaced with ckey, a full node left with a single child or only a value is collapsed
+func (mpt *MerklePatriciaTrie) deleteFullNodeChild(node Node, nodeImpl *FullNode, prefix Path, pe byte, ckey Key) (Node, Key, error) {
+	if ckey == nil {
+		numChildren := nodeImpl.GetNumChildren()
+		if numChildren == 1 {
+			if nodeImpl.HasValue() { // a full node with no children anymore but with a value becomes a leaf node
+				return mpt.insertLeaf(node, nodeImpl.GetValue(), concat(prefix), nil)
 			}
-			return mpt.insertNode(node, nnode)
-		case *FullNode:
-			nnode := nodeImpl.Clone().(*ExtensionNode)
-			nnode.NodeKey = ckey
-			return mpt.insertNode(node, nnode)
-		case *ExtensionNode:
-			// if extension child changes from full node to extension node, merge the extensions
-			nnode := nodeImpl.Clone().(*ExtensionNode)
-			nnode.Path = append(nnode.Path, cnodeImpl.Path...)
-			nnode.NodeKey = cnodeImpl.NodeKey
-			if err := mpt.deleteNode(cnode); err != nil {
-				return nil, nil, err
+			// a full node with no children anymore and no value should be removed
+			return nil, nil, nil
+		}
+		if numChildren == 2 {
+			if !nodeImpl.HasValue() {
+				// a full node with a single child and no value should lift up the child
+				tempNode := nodeImpl.Clone().(*FullNode)
+				// clear the child being deleted
+				tempNode.PutChild(pe, nil)
+				var otherChildKey []byte
+				var oidx byte
+				for idx, pe := range PathElements {
+					child := tempNode.GetChild(pe)
+					if child != nil {
+						oidx = byte(idx)
+						otherChildKey = child
+						break
+					}
+				}
+				ochild, err := mpt.getNode(otherChildKey)
+				if err != nil {
+					return nil, nil, err
+				}
+				npath := []byte{nodeImpl.indexToByte(oidx)}
+				var nnode Node
+				switch onodeImpl := ochild.(type) {
+				case *FullNode:
+					nnode = NewExtensionNode(npath, otherChildKey)
+				case *LeafNode:
+					if onodeImpl.Path != nil {
+						npath = append(npath, onodeImpl.Path...)
+					}
+					lnode := ochild.Clone().(*LeafNode)
+					lnode.SetOrigin(mpt.Version)
+					lnode.Path = npath
+					lnode.Prefix = concat(prefix)
+					nnode = lnode
+					if err := mpt.deleteNode(ochild); err != nil {
+						return nil, nil, err
+					}
+				case *ExtensionNode:
+					if onodeImpl.Path != nil {
+						npath = append(npath, onodeImpl.Path...)
+					}
+					enode := ochild.Clone().(*ExtensionNode)
+					enode.Path = npath
+					nnode = enode
+					if err := mpt.deleteNode(ochild); err != nil {
+						return nil, nil, err
+					}
+				default:
+					panic(fmt.Sprintf("unknown node type: %T %v %T", ochild, ochild, mpt.db))
+				}
+				return mpt.insertNode(node, nnode)
 			}
-			return mpt.insertNode(node, nnode)
-		default:
-			panic(fmt.Sprintf("unknown node type: %T %v", cnode, cnode))
 		}
+	}
+	nnode := nodeImpl.Clone().(*FullNode)
+	nnode.PutChild(pe, ckey)
+	return mpt.insertNode(node, nnode)
+}
+
+// deleteExtensionChild - update the extension node after its child changed to cnode
+func (mpt *MerklePatriciaTrie) deleteExtensionChild(node Node, nodeImpl *ExtensionNode, prefix Path, cnode Node, ckey Key) (Node, Key, error) {
+	switch cnodeImpl := cnode.(type) {
+	case *LeafNode:
+		// if extension child changes from full node to leaf, convert the extension into a leaf node
+		nnode := cnode.Clone().(*LeafNode)
+		nnode.SetOrigin(mpt.Version)
+		nnode.Prefix = concat(prefix)
+		nnode.Path = concat(nodeImpl.Path, cnodeImpl.Path...)
+		nnode.SetValue(cnodeImpl.GetValue())
+		if err := mpt.deleteNode(cnode); err != nil {
+			return nil, nil, err
+		}
+		return mpt.insertNode(node, nnode)
+	case *FullNode:
+		nnode := nodeImpl.Clone().(*ExtensionNode)
+		nnode.NodeKey = ckey
+		return mpt.insertNode(node, nnode)
+	case *ExtensionNode:
+		// if extension child changes from full node to extension node, merge the extensions
+		nnode := nodeImpl.Clone().(*ExtensionNode)
+		nnode.Path = concat(nnode.Path, cnodeImpl.Path...)
+		nnode.NodeKey = cnodeImpl.NodeKey
+		if err := mpt.deleteNode(cnode); err != nil {
+			return nil, nil, err
+		}
+		return mpt.insertNode(node, nnode)
 	default:
-		panic(fmt.Sprintf("unknown node type: %T %v", node, node))
+		panic(fmt.Sprintf("unknown node type: %T %v", cnode, cnode))
 	}
 }
 
@@ -871,20 +1049,31 @@ func (mpt *MerklePatriciaTrie) insertNode(oldNode Node, newNode Node) (Node, Key
 	}
 
 	newNode.SetOrigin(mpt.Version)
-	ckey := newNode.GetHashBytes()
+	if mpt.countMode {
+		if err := mpt.setNodeCounts(oldNode, newNode); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		// the counts cloned from the old node are stale
+		clearNodeCounts(newNode)
+	}
+	ckey, hashed := nodeHashLen(newNode)
 	if err := mpt.db.PutNode(ckey, newNode); err != nil {
 		return nil, nil, err
 	}
+	mpt.meter.write(hashed)
 
 	mpt.cache.Set(string(ckey), newNode)
 
 	//If same node is inserted by client, don't add them into change collector
 	if oldNode == nil {
 		mpt.ChangeCollector.AddChange(oldNode, newNode)
+		mpt.logNodeChange(nil, newNode)
 	} else {
 		okey := oldNode.GetHashBytes()
 		if !bytes.Equal(okey, ckey) { //delete previous node only if it isn`t the same as new one
 			mpt.ChangeCollector.AddChange(oldNode, newNode)
+			mpt.logNodeChange(oldNode, newNode)
 			//NOTE: since leveldb is initiaized with propagate deletes as false, only newly created nodes will get deleted
 			if err := mpt.db.DeleteNode(okey); err != nil {
 				return nil, nil, err
@@ -902,6 +1091,7 @@ func (mpt *MerklePatriciaTrie) deleteNode(node Node) error {
 	}
 	//Logger.Debug("delete node", zap.Any("version", mpt.Version), zap.String("key", node.GetHash()))
 	mpt.ChangeCollector.DeleteChange(node)
+	mpt.logNodeChange(node, nil)
 	ckey := node.GetHashBytes()
 	err := mpt.db.DeleteNode(ckey)
 	if err != nil {
@@ -965,17 +1155,8 @@ func (mpt *MerklePatriciaTrie) pp2(key Key, depth byte, missingNodes *[]Key) err
 		}
 		return err
 	}
-	switch nodeImpl := node.(type) {
-	case *LeafNode:
-	case *ExtensionNode:
-		_ = mpt.pp2(nodeImpl.NodeKey, depth+2, missingNodes)
-	case *FullNode:
-		for _, cnode := range nodeImpl.Children {
-			if cnode == nil {
-				continue
-			}
-			_ = mpt.pp2(cnode, depth+2, missingNodes)
-		}
+	for _, ckey := range nodeRefs(node) {
+		_ = mpt.pp2(ckey, depth+2, missingNodes)
 	}
 	return nil
 }
@@ -1105,6 +1286,22 @@ func (mpt *MerklePatriciaTrie) mergeChanges(newRoot Key, changes []*NodeChange,
 		return errors.New("optimistic lock failure")
 	}
 
+	if len(mpt.observers) > 0 {
+		news := make(map[string]Node, len(changes))
+		for _, c := range changes {
+			news[string(c.New.GetHashBytes())] = c.New
+		}
+		getNew := func(key Key) (Node, error) {
+			if n, ok := news[string(key)]; ok {
+				return n, nil
+			}
+			return mpt.getNode(key)
+		}
+		if err := mpt.notifyDiff(MutationMerge, mergeCursorFor(mpt.getNode, mpt.root), mergeCursorFor(getNew, newRoot)); err != nil {
+			return err
+		}
+	}
+
 	for _, c := range changes {
 		if _, _, err := mpt.insertNode(c.Old, c.New); err != nil {
 			return err
@@ -1117,19 +1314,86 @@ func (mpt *MerklePatriciaTrie) mergeChanges(newRoot Key, changes []*NodeChange,
 		}
 	}
 
+	mpt.markDirtyChanges(changes, deletes)
 	mpt.setRoot(newRoot)
 	return nil
 }
 
-// MergeDB - merges the state changes from the node db directly
+// MergeDB - merges the state changes from the node db directly, the entries of the indexed values changed are updated after
 func (mpt *MerklePatriciaTrie) MergeDB(ndb NodeDB, root Key, deadNodes []Node) error {
 	mpt.mutex.Lock()
 	defer mpt.mutex.Unlock()
+	var changes []indexChange
+	if len(mpt.observers) > 0 || len(mpt.indexes) > 0 {
+		getNew := func(key Key) (Node, error) {
+			if n, err := ndb.GetNode(key); err == nil {
+				return n, nil
+			}
+			return mpt.getNode(key)
+		}
+		err := walkValueDiff(mergeCursorFor(mpt.getNode, mpt.root), mergeCursorFor(getNew, root), nil,
+			func(path Path, old, value []byte) error {
+				if err := mpt.notify(MutationMerge, path, old, value); err != nil {
+					return err
+				}
+				var err error
+				changes, err = mpt.addIndexChange(changes, path, old, value)
+				return err
+			})
+		if err != nil {
+			return err
+		}
+	}
 	handler := func(ctx context.Context, key Key, node Node) error {
 		_, _, err := mpt.insertNode(nil, node)
 		return err
 	}
 	mpt.root = root
+	mpt.dirtyAll = true
 	mpt.deleteNodes = append(mpt.deleteNodes, deadNodes...)
-	return ndb.Iterate(context.TODO(), handler)
+	if err := ndb.Iterate(context.TODO(), handler); err != nil {
+		return err
+	}
+	_, err := mpt.updateIndexChanges(changes)
+	return err
+}
+
+// markDirty - unsafe, marks a path changed since the start root, the path
+// indexes can't serve the reads of the changed paths
+func (mpt *MerklePatriciaTrie) markDirty(path Path) {
+	if mpt.dirtyPaths == nil {
+		mpt.dirtyPaths = make(map[string]struct{})
+	}
+	mpt.dirtyPaths[string(path)] = struct{}{}
+}
+
+// markDirtyChanges - unsafe, marks the paths of merged node changes
+func (mpt *MerklePatriciaTrie) markDirtyChanges(changes []*NodeChange, deletes []Node) {
+	puts, dels, ok := flatChanges(changes, deletes)
+	if !ok {
+		mpt.dirtyAll = true
+		return
+	}
+	for p := range puts {
+		mpt.markDirty(Path(p))
+	}
+	for _, p := range dels {
+		mpt.markDirty(p)
+	}
+}
+
+// indexValidFor - unsafe, checks if an index built at the given root can serve the path,
+// that is the index is at the current root, or at the start root and the path is not changed since
+func (mpt *MerklePatriciaTrie) indexValidFor(indexRoot Key, path Path) bool {
+	if len(indexRoot) == 0 {
+		return false
+	}
+	if bytes.Equal(indexRoot, mpt.root) {
+		return true
+	}
+	if mpt.dirtyAll || mpt.ChangeCollector == nil || !bytes.Equal(indexRoot, mpt.ChangeCollector.GetStartRoot()) {
+		return false
+	}
+	_, ok := mpt.dirtyPaths[string(path)]
+	return !ok
 }
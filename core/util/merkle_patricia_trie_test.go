@@ -2183,3 +2183,66 @@ func TestMPTFindMissingNodes(t *testing.T) {
 
 	require.True(t, find)
 }
+
+// blockingNodeDB - signals the node writes and blocks them until released
+type blockingNodeDB struct {
+	*MemoryNodeDB
+	once    sync.Once
+	writing chan struct{}
+	release chan struct{}
+	written chan struct{}
+}
+
+func newBlockingNodeDB() *blockingNodeDB {
+	return &blockingNodeDB{
+		MemoryNodeDB: NewMemoryNodeDB(),
+		writing:      make(chan struct{}),
+		release:      make(chan struct{}),
+		written:      make(chan struct{}, 16),
+	}
+}
+
+func (b *blockingNodeDB) MultiPutNode(keys []Key, nodes []Node) error {
+	b.once.Do(func() { close(b.writing) })
+	<-b.release
+	err := b.MemoryNodeDB.MultiPutNode(keys, nodes)
+	b.written <- struct{}{}
+	return err
+}
+
+func TestMerklePatriciaTrie_SaveChangesReadLocked(t *testing.T) {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	for i := 0; i < 10; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+
+	// the trie is read while the nodes are written
+	ndb := newBlockingNodeDB()
+	errC := make(chan error, 1)
+	go func() { errC <- mpt.SaveChanges(context.Background(), ndb, false) }()
+	<-ndb.writing
+	var v Txn
+	require.NoError(t, mpt.GetNodeValue(flatTestPath(0), &v))
+	require.Equal(t, "value_0", v.Data)
+	close(ndb.release)
+	require.NoError(t, <-errC)
+	<-ndb.written
+
+	// the write left running when the context is done saves the root taken on save
+	root := mpt.GetRoot()
+	ndb = newBlockingNodeDB()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { errC <- mpt.SaveChanges(ctx, ndb, false) }()
+	<-ndb.writing
+	cancel()
+	require.ErrorIs(t, <-errC, context.Canceled)
+	_, err := mpt.Insert(flatTestPath(100), &Txn{"after"})
+	require.NoError(t, err)
+	close(ndb.release)
+	<-ndb.written
+	smpt := NewMerklePatriciaTrie(ndb, Sequence(1), root, statecache.NewEmpty())
+	require.NoError(t, smpt.Validate())
+	_, err = smpt.GetNodeValueRaw(flatTestPath(100))
+	require.Equal(t, ErrValueNotPresent, err)
+}
@@ -0,0 +1,309 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/0chain/common/core/common"
+	"github.com/0chain/common/core/logging"
+	"go.uber.org/zap"
+)
+
+// BatchWrite - a write of a batch update, a nil value is a delete
+type BatchWrite struct {
+	Path  Path
+	Value MPTSerializable
+}
+
+// encode - the encoded value of the write, nil for a delete
+func (w *BatchWrite) encode() ([]byte, error) {
+	if w.Value == nil {
+		return nil, nil
+	}
+	eval, err := w.Value.MarshalMsg(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(eval) > MPTMaxAllowableNodeSize {
+		msg := fmt.Sprintf("node exceeds maximum permissible size of %d bytes for path: %s", MPTMaxAllowableNodeSize, string(w.Path))
+		return nil, common.NewError("failed to insert node", msg)
+	}
+	if len(eval) == 0 {
+		return nil, nil
+	}
+	return eval, nil
+}
+
+// UpdateBatch - apply the writes in order as by Insert and Delete, all of them or none. The writes are
+// applied to a scratch trie over the db of the trie and its changes are merged at once, the storage
+// usage is accounted over the paths written. When the root is a full node and none of the writes is at
+// the root path, the writes are grouped by the first path element and each group is applied to its
+// subtree in parallel, then the subtrees are combined into a single new root with the same changes as
+// applying the writes one by one. The writes are applied one by one otherwise or when the trie has
+// observers or indexes. The observers are called with the changes of the writes in order once all of
+// them are applied and their new nodes are written, when the merge can't fail anymore. A veto leaves the
+// trie unchanged, the new nodes written are not referenced.
+func (mpt *MerklePatriciaTrie) UpdateBatch(writes []BatchWrite) (Key, error) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+
+	var (
+		scratch   = mpt.scratchTrie(mpt.root)
+		mutations []Mutation
+	)
+	if len(mpt.observers) > 0 {
+		scratch.observers = []MPTObserver{func(m Mutation) error {
+			mutations = append(mutations, m)
+			return nil
+		}}
+	}
+	rootNode, err := mpt.batchRootNode(writes)
+	if err != nil {
+		return nil, err
+	}
+	if rootNode == nil {
+		err = scratch.applyWrites(writes)
+	} else {
+		err = scratch.applyShardWrites(rootNode, writes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mpt.mergeBatch(scratch, mutations)
+}
+
+// batchRootNode - unsafe, the root full node whose subtrees the writes can be applied to in parallel,
+// nil if the writes are to be applied one by one
+func (mpt *MerklePatriciaTrie) batchRootNode(writes []BatchWrite) (*FullNode, error) {
+	if mpt.root == nil || len(mpt.observers) > 0 || len(mpt.indexes) > 0 {
+		return nil, nil
+	}
+	for _, w := range writes {
+		if len(w.Path) == 0 {
+			// the shape of the trie depends on the order of the writes at the root
+			return nil, nil
+		}
+	}
+	node, err := mpt.getNode(mpt.root)
+	if err != nil {
+		return nil, err
+	}
+	rootNode, _ := node.(*FullNode)
+	return rootNode, nil
+}
+
+// applyWrites - apply the writes one by one as by Insert
+func (mpt *MerklePatriciaTrie) applyWrites(writes []BatchWrite) error {
+	for _, w := range writes {
+		if _, err := mpt.Insert(w.Path, w.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyShardWrites - unsafe, apply the writes grouped by the first path element to the subtrees of the
+// root node in parallel and combine the subtrees into a new root
+func (mpt *MerklePatriciaTrie) applyShardWrites(rootNode *FullNode, writes []BatchWrite) error {
+	groups := make(map[byte][]BatchWrite)
+	for _, w := range writes {
+		groups[w.Path[0]] = append(groups[w.Path[0]], w)
+	}
+
+	type shard struct {
+		pe      byte
+		scratch *MerklePatriciaTrie
+		err     error
+	}
+	var (
+		shards []*shard
+		wg     sync.WaitGroup
+	)
+	for _, pe := range PathElements {
+		group := groups[pe]
+		if len(group) == 0 {
+			continue
+		}
+		s := &shard{pe: pe, scratch: mpt.scratchTrie(rootNode.GetChild(pe))}
+		shards = append(shards, s)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.err = s.scratch.applySubtreeWrites(concat(mpt.rootPrefix(), s.pe), group)
+		}()
+	}
+	wg.Wait()
+	for _, s := range shards {
+		if s.err != nil {
+			return s.err
+		}
+	}
+
+	// the changes of the subtrees are merged in path element order
+	var (
+		nnode     = rootNode.Clone().(*FullNode)
+		lastEmpty *shard
+	)
+	for _, s := range shards {
+		if err := mpt.mergeScratchChanges(s.scratch); err != nil {
+			return err
+		}
+		if s.scratch.root == nil {
+			lastEmpty = s
+			continue
+		}
+		nnode.PutChild(s.pe, s.scratch.root)
+	}
+	for _, s := range shards {
+		if s.scratch.root == nil && s != lastEmpty {
+			nnode.PutChild(s.pe, nil)
+		}
+	}
+
+	switch {
+	case lastEmpty != nil && nnode.GetNumChildren() == 1 && !nnode.HasValue():
+		// all the values are deleted
+		if err := mpt.deleteNode(rootNode); err != nil {
+			return err
+		}
+		mpt.setRoot(nil)
+	default:
+		node, newRootHash, err := mpt.insertNode(rootNode, nnode)
+		if err != nil {
+			return err
+		}
+		if lastEmpty != nil {
+			// the last subtree removed may collapse the root
+			_, newRootHash, err = mpt.deleteFullNodeChild(node, node.(*FullNode), mpt.rootPrefix(), lastEmpty.pe, nil)
+			if err != nil {
+				return err
+			}
+		}
+		mpt.setRoot(newRootHash)
+	}
+	for _, w := range writes {
+		mpt.markDirty(w.Path)
+	}
+	return nil
+}
+
+// mergeBatch - unsafe, merge the changes of the scratch trie of a batch and account the storage usage
+// over the paths written. The mutations of the batch are notified once all the new nodes are written,
+// the root, the changes and the dirty paths of the trie are updated after, so the trie is left unchanged
+// if the merge fails or is vetoed.
+func (mpt *MerklePatriciaTrie) mergeBatch(scratch *MerklePatriciaTrie, mutations []Mutation) (Key, error) {
+	written, err := mpt.putScratchNodes(scratch)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mutations {
+		if err := mpt.notify(m.Op, m.Path, m.OldValue, m.NewValue); err != nil {
+			return nil, err
+		}
+	}
+
+	paths := make([]Path, 0, len(scratch.dirtyPaths))
+	for p := range scratch.dirtyPaths {
+		paths = append(paths, Path(p))
+	}
+	before := mpt.startAccounting(paths...)
+	mpt.recordScratchChanges(scratch, written)
+	mpt.setRoot(scratch.root)
+	for _, p := range paths {
+		mpt.markDirty(p)
+	}
+	mpt.finishAccounting(before, false, paths...)
+	return mpt.root, nil
+}
+
+// applySubtreeWrites - apply the writes to the scratch trie of the subtree at the first path element of the writes,
+// the sub tries referenced by the values replaced are released as by Insert
+func (mpt *MerklePatriciaTrie) applySubtreeWrites(prefix Path, writes []BatchWrite) error {
+	for _, w := range writes {
+		eval, err := w.encode()
+		if err != nil {
+			return err
+		}
+		old, err := mpt.valueAt(w.Path[1:])
+		if err != nil {
+			return err
+		}
+		if err := mpt.releaseSubTrieRef(concat(prefix, w.Path[1:]...), old, eval); err != nil {
+			return err
+		}
+		var root Key
+		switch {
+		case eval == nil:
+			_, root, err = mpt.delete(mpt.root, prefix, w.Path[1:])
+		case mpt.root == nil:
+			_, root, err = mpt.insertLeaf(nil, &SecureSerializableValue{eval}, prefix, w.Path[1:])
+		default:
+			_, root, err = mpt.insert(&SecureSerializableValue{eval}, mpt.root, prefix, w.Path[1:])
+		}
+		if err != nil {
+			return err
+		}
+		mpt.setRoot(root)
+	}
+	return nil
+}
+
+// mergeScratchChanges - unsafe, apply the node changes of the scratch trie. The changes are only
+// recorded once all the new nodes are written, the nodes replaced are deleted after.
+func (mpt *MerklePatriciaTrie) mergeScratchChanges(scratch *MerklePatriciaTrie) error {
+	written, err := mpt.putScratchNodes(scratch)
+	if err != nil {
+		return err
+	}
+	mpt.recordScratchChanges(scratch, written)
+	return nil
+}
+
+// putScratchNodes - unsafe, write the new nodes of the scratch trie, returns the keys written. The new
+// nodes are complete already, so they are written as they are in any order.
+func (mpt *MerklePatriciaTrie) putScratchNodes(scratch *MerklePatriciaTrie) (map[string]struct{}, error) {
+	changes := scratch.ChangeCollector.GetChanges()
+	written := make(map[string]struct{}, len(changes))
+	for _, c := range changes {
+		ckey := c.New.GetHashBytes()
+		if err := mpt.db.PutNode(ckey, c.New); err != nil {
+			return nil, err
+		}
+		mpt.cache.Set(string(ckey), c.New)
+		written[string(ckey)] = struct{}{}
+	}
+	return written, nil
+}
+
+// recordScratchChanges - unsafe, record the node changes of the scratch trie whose new nodes are written,
+// the nodes replaced or deleted are removed from the db once the changes are recorded
+func (mpt *MerklePatriciaTrie) recordScratchChanges(scratch *MerklePatriciaTrie, written map[string]struct{}) {
+	changes := scratch.ChangeCollector.GetChanges()
+	removed := make(map[string]struct{})
+	for _, c := range changes {
+		mpt.ChangeCollector.AddChange(c.Old, c.New)
+		mpt.logNodeChange(c.Old, c.New)
+		if c.Old != nil {
+			removed[string(c.Old.GetHashBytes())] = struct{}{}
+		}
+	}
+	for _, d := range scratch.ChangeCollector.GetDeletes() {
+		dkey := string(d.GetHashBytes())
+		if _, ok := removed[dkey]; ok {
+			continue
+		}
+		mpt.ChangeCollector.DeleteChange(d)
+		mpt.logNodeChange(d, nil)
+		removed[dkey] = struct{}{}
+	}
+	for key := range removed {
+		if _, ok := written[key]; ok {
+			continue
+		}
+		if err := mpt.db.DeleteNode(Key(key)); err != nil {
+			logging.Logger.Error("merge scratch changes - delete node failed", zap.Error(err))
+			continue
+		}
+		mpt.cache.Remove(key)
+	}
+}
@@ -0,0 +1,282 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func batchTestTrie(t *testing.T, countMode bool, paths []Path) *MerklePatriciaTrie {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	mpt.SetCountMode(countMode)
+	for _, p := range paths {
+		_, err := mpt.Insert(p, &Txn{"base_" + string(p)})
+		require.NoError(t, err)
+	}
+	mpt.SetVersion(2)
+	mpt.ChangeCollector = NewChangeCollector(mpt.GetRoot())
+	return mpt
+}
+
+func changeKeys(mpt *MerklePatriciaTrie) (changes, deletes []string) {
+	_, cs, ds, _ := mpt.GetChanges()
+	for _, c := range cs {
+		changes = append(changes, c.New.GetHash())
+	}
+	for _, d := range ds {
+		deletes = append(deletes, d.GetHash())
+	}
+	sort.Strings(changes)
+	sort.Strings(deletes)
+	return changes, deletes
+}
+
+// checkBatch - the batch update gives the same root and changes as the writes applied one by one
+func checkBatch(t *testing.T, countMode bool, paths []Path, writes []BatchWrite) *MerklePatriciaTrie {
+	batch := batchTestTrie(t, countMode, paths)
+	root, err := batch.UpdateBatch(writes)
+	require.NoError(t, err)
+	require.Equal(t, root, batch.GetRoot())
+
+	serial := batchTestTrie(t, countMode, paths)
+	for _, w := range writes {
+		_, err := serial.Insert(w.Path, w.Value)
+		require.NoError(t, err)
+	}
+	require.Equal(t, serial.GetRoot(), root)
+	sc, sd := changeKeys(serial)
+	bc, bd := changeKeys(batch)
+	require.Equal(t, sc, bc)
+	require.Equal(t, sd, bd)
+	require.Equal(t, trieValues(t, serial), trieValues(t, batch))
+	if countMode {
+		values := trieValues(t, batch)
+		for _, prefix := range append([]string{""}, strings.Split(string(PathElements), "")...) {
+			var expected uint64
+			for p := range values {
+				if strings.HasPrefix(p, prefix) {
+					expected++
+				}
+			}
+			count, err := batch.CountPrefix(Path(prefix))
+			require.NoError(t, err)
+			require.Equal(t, expected, count, prefix)
+		}
+	}
+	return batch
+}
+
+func TestMerklePatriciaTrie_UpdateBatch(t *testing.T) {
+	var paths []Path
+	for i := 0; i < 200; i++ {
+		paths = append(paths, flatTestPath(i))
+	}
+	var writes []BatchWrite
+	for i := 0; i < 300; i += 3 {
+		if p := flatTestPath(i); p[0] != 'f' {
+			writes = append(writes, BatchWrite{Path: p, Value: &Txn{fmt.Sprintf("updated_%d", i)}})
+		}
+		if p := flatTestPath(i + 1); i+1 < len(paths) && p[0] != 'f' {
+			writes = append(writes, BatchWrite{Path: p})
+		}
+	}
+	// the later writes of a path win
+	writes = append(writes, BatchWrite{Path: flatTestPath(3), Value: &Txn{"last"}})
+	// the whole subtree of a path element is deleted
+	for _, p := range paths {
+		if p[0] == 'f' {
+			writes = append(writes, BatchWrite{Path: p})
+		}
+	}
+	// a value at the root, the writes are applied one by one
+	withRoot := append(append([]BatchWrite(nil), writes...), BatchWrite{Path: Path(""), Value: &Txn{"root"}})
+
+	for _, countMode := range []bool{false, true} {
+		t.Run(fmt.Sprintf("count mode %v", countMode), func(t *testing.T) {
+			checkBatch(t, countMode, paths, writes)
+			checkBatch(t, countMode, paths, withRoot)
+		})
+	}
+}
+
+func TestMerklePatriciaTrie_UpdateBatchCollapse(t *testing.T) {
+	paths := []Path{Path("0a01"), Path("0a02"), Path("1b01"), Path("2c01")}
+	// a single subtree is left, the root becomes an extension
+	mpt := checkBatch(t, true, paths, []BatchWrite{{Path: Path("1b01")}, {Path: Path("2c01")}})
+	node, err := mpt.getNode(mpt.GetRoot())
+	require.NoError(t, err)
+	require.IsType(t, &ExtensionNode{}, node)
+
+	// a single value is left, the root becomes a leaf
+	mpt = checkBatch(t, false, paths, []BatchWrite{{Path: Path("0a01")}, {Path: Path("1b01")}, {Path: Path("2c01")}})
+	node, err = mpt.getNode(mpt.GetRoot())
+	require.NoError(t, err)
+	require.IsType(t, &LeafNode{}, node)
+
+	// all the values are deleted
+	var writes []BatchWrite
+	for _, p := range paths {
+		writes = append(writes, BatchWrite{Path: p})
+	}
+	mpt = checkBatch(t, false, paths, writes)
+	require.Nil(t, mpt.GetRoot())
+}
+
+func TestMerklePatriciaTrie_UpdateBatchFailure(t *testing.T) {
+	paths := []Path{Path("0a01"), Path("1b01"), Path("2c01")}
+	mpt := batchTestTrie(t, false, paths)
+	root := mpt.GetRoot()
+	_, err := mpt.UpdateBatch([]BatchWrite{
+		{Path: Path("0a01"), Value: &Txn{"updated"}},
+		{Path: Path("1b01"), Value: &Txn{strings.Repeat("x", MPTMaxAllowableNodeSize+1)}},
+	})
+	require.Error(t, err)
+	_, err = mpt.UpdateBatch([]BatchWrite{{Path: Path("0a01")}, {Path: Path("2c02")}})
+	require.Equal(t, ErrValueNotPresent, err)
+	require.Equal(t, root, mpt.GetRoot())
+	require.Equal(t, 0, mpt.GetChangeCount())
+}
+
+func TestMerklePatriciaTrie_UpdateBatchRootOrder(t *testing.T) {
+	paths := []Path{Path("0a01"), Path("1b01")}
+	// the value at the root is kept on the full node only if written before the delete
+	mpt := checkBatch(t, false, paths, []BatchWrite{{Path: Path(""), Value: &Txn{"root"}}, {Path: Path("1b01")}})
+	node, err := mpt.getNode(mpt.GetRoot())
+	require.NoError(t, err)
+	require.IsType(t, &FullNode{}, node)
+	checkBatch(t, false, paths, []BatchWrite{{Path: Path("1b01")}, {Path: Path(""), Value: &Txn{"root"}}})
+}
+
+// failingPutNodeDB - fails the node puts when set
+type failingPutNodeDB struct {
+	*MemoryNodeDB
+	fail bool
+}
+
+func (f *failingPutNodeDB) PutNode(key Key, node Node) error {
+	if f.fail {
+		return errors.New("put failed")
+	}
+	return f.MemoryNodeDB.PutNode(key, node)
+}
+
+func TestMerklePatriciaTrie_UpdateBatchHooks(t *testing.T) {
+	paths := []Path{Path("0a01"), Path("1b01"), Path("2c01")}
+
+	t.Run("index", func(t *testing.T) {
+		mpt := batchTestTrie(t, false, paths)
+		idx := ownerIndex()
+		require.NoError(t, mpt.AddIndex(idx))
+		root := mpt.GetRoot()
+		_, err := mpt.UpdateBatch([]BatchWrite{
+			{Path: Path("0a02"), Value: &Txn{"aaaa_2"}},
+			{Path: Path("1b01"), Value: &Txn{strings.Repeat("x", MPTMaxAllowableNodeSize+1)}},
+		})
+		require.Error(t, err)
+		require.Equal(t, root, mpt.GetRoot())
+		require.Equal(t, 0, mpt.GetChangeCount())
+		keys, err := mpt.LookupIndex(idx, Path("aaaa"))
+		require.NoError(t, err)
+		require.Empty(t, keys)
+
+		_, err = mpt.UpdateBatch([]BatchWrite{{Path: Path("0a02"), Value: &Txn{"aaaa_2"}}})
+		require.NoError(t, err)
+		keys, err = mpt.LookupIndex(idx, Path("aaaa"))
+		require.NoError(t, err)
+		require.Equal(t, []Path{Path("0a02")}, keys)
+	})
+
+	t.Run("observer", func(t *testing.T) {
+		mpt := batchTestTrie(t, false, paths)
+		errVeto := errors.New("veto")
+		var mutations []Mutation
+		mpt.AddObserver(func(m Mutation) error {
+			if string(m.Path) == "2c01" {
+				return errVeto
+			}
+			mutations = append(mutations, m)
+			return nil
+		})
+		root := mpt.GetRoot()
+		_, err := mpt.UpdateBatch([]BatchWrite{{Path: Path("0a01")}, {Path: Path("2c01")}})
+		require.Equal(t, errVeto, err)
+		require.Equal(t, root, mpt.GetRoot())
+		require.Equal(t, 0, mpt.GetChangeCount())
+
+		mutations = nil
+		_, err = mpt.UpdateBatch([]BatchWrite{{Path: Path("0a01")}, {Path: Path("0a01"), Value: &Txn{"new"}}})
+		require.NoError(t, err)
+		require.Equal(t, []Mutation{
+			{Op: MutationDelete, Path: Path("0a01"), OldValue: encodeTxn(t, "base_0a01"), Round: 2},
+			{Op: MutationInsert, Path: Path("0a01"), NewValue: encodeTxn(t, "new"), Round: 2},
+		}, mutations)
+	})
+
+	t.Run("merge failure", func(t *testing.T) {
+		ndb := &failingPutNodeDB{MemoryNodeDB: NewMemoryNodeDB()}
+		mpt := NewMerklePatriciaTrie(ndb, Sequence(1), nil, statecache.NewEmpty())
+		for _, p := range paths {
+			_, err := mpt.Insert(p, &Txn{"base_" + string(p)})
+			require.NoError(t, err)
+		}
+		var mutations []Mutation
+		mpt.AddObserver(func(m Mutation) error {
+			mutations = append(mutations, m)
+			return nil
+		})
+		root := mpt.GetRoot()
+
+		// the observers don't see the changes of a batch that fails to merge
+		ndb.fail = true
+		_, err := mpt.UpdateBatch([]BatchWrite{{Path: Path("0a01"), Value: &Txn{"new"}}})
+		require.Error(t, err)
+		require.Empty(t, mutations)
+		require.Equal(t, root, mpt.GetRoot())
+
+		ndb.fail = false
+		_, err = mpt.UpdateBatch([]BatchWrite{{Path: Path("0a01"), Value: &Txn{"new"}}})
+		require.NoError(t, err)
+		require.Len(t, mutations, 1)
+	})
+}
+
+func TestMerklePatriciaTrie_UpdateBatchAccounting(t *testing.T) {
+	var paths []Path
+	for i := 0; i < 100; i++ {
+		paths = append(paths, flatTestPath(i))
+	}
+	paths = append(paths, Path("a1b2"), Path("a1b3"), Path("a1c"), Path("01"))
+
+	for name, rootWrite := range map[string]bool{"parallel": false, "one by one": true} {
+		t.Run(name, func(t *testing.T) {
+			mpt := batchTestTrie(t, false, paths)
+			require.NoError(t, mpt.SetStorageAccounting(nil, usageTestPrefixes...))
+			am := &AccessMeter{}
+			mpt.SetAccessMeter(am)
+
+			writes := []BatchWrite{
+				{Path: Path("a1b2"), Value: &Txn{"updated"}},
+				{Path: Path("a1b3")},
+				{Path: Path("a1b4"), Value: &Txn{"new"}},
+				{Path: Path("01")},
+				{Path: flatTestPath(1), Value: &Txn{"updated"}},
+			}
+			if rootWrite {
+				writes = append(writes, BatchWrite{Path: Path(""), Value: &Txn{"root"}})
+			}
+			_, err := mpt.UpdateBatch(writes)
+			require.NoError(t, err)
+			// updated by the batch, not counted again
+			require.True(t, mpt.usageValid())
+			requireUsageCounted(t, mpt)
+			require.GreaterOrEqual(t, am.Counts().NodeWrites, int64(mpt.GetChangeCount()))
+			require.NotZero(t, am.Counts().NodeWrites)
+		})
+	}
+}
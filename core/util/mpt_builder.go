@@ -0,0 +1,218 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/0chain/common/core/common"
+)
+
+// ErrUnsortedPaths - the paths added to the builder are not strictly increasing
+var ErrUnsortedPaths = errors.New("builder paths are not sorted")
+
+// builderBranch - an open full node on the right most path of the trie being built
+type builderBranch struct {
+	depth    int
+	children [16][]byte
+	value    MPTSerializable
+}
+
+// MPTBuilder - builds a trie from a stream of values sorted by path. Only the right most path
+// of the trie is kept in memory, the completed nodes are written to the node db as they are done.
+// The resulting trie is the same as inserting the values in path order in a trie of the same version.
+// With values on full nodes the shape of a trie depends on the insert order, so inserting the same
+// values in another order may give a different root.
+//
+//	b := util.NewMPTBuilder(ndb, version)
+//	for each path, value in sorted order {
+//		if err := b.Add(path, value); err != nil { ... }
+//	}
+//	root, err := b.Finish()
+type MPTBuilder struct {
+	ndb     NodeDB
+	version Sequence
+
+	stack []*builderBranch
+
+	// the last added value, placed when the next path is known
+	pending      Path
+	pendingValue MPTSerializable
+
+	root  Key
+	keys  []Key
+	nodes []Node
+	count int64
+}
+
+// NewMPTBuilder - create a new builder writing the nodes to the node db
+func NewMPTBuilder(ndb NodeDB, version Sequence) *MPTBuilder {
+	return &MPTBuilder{
+		ndb:     ndb,
+		version: version,
+		keys:    make([]Key, 0, BatchSize),
+		nodes:   make([]Node, 0, BatchSize),
+	}
+}
+
+// Count - number of values added
+func (b *MPTBuilder) Count() int64 {
+	return b.count
+}
+
+// Add - add the next value, the path must be greater than the previous one.
+// As with Insert, nil or empty encoded values are skipped.
+func (b *MPTBuilder) Add(path Path, value MPTSerializable) error {
+	if value == nil {
+		return nil
+	}
+	eval, err := value.MarshalMsg(nil)
+	if err != nil {
+		return err
+	}
+	if len(eval) == 0 {
+		return nil
+	}
+	if len(eval) > MPTMaxAllowableNodeSize {
+		msg := fmt.Sprintf("node exceeds maximum permissible size of %d bytes for path: %s", MPTMaxAllowableNodeSize, string(path))
+		return common.NewError("failed to insert node", msg)
+	}
+
+	if b.pending != nil {
+		if bytes.Compare(b.pending, path) >= 0 {
+			return ErrUnsortedPaths
+		}
+		if err := b.place(commonPrefixLen(b.pending, path)); err != nil {
+			return err
+		}
+	}
+	b.pending = concat(path)
+	b.pendingValue = &SecureSerializableValue{eval}
+	b.count++
+	return nil
+}
+
+// Finish - complete the trie and flush the remaining nodes, returns the root, nil if no value was added
+func (b *MPTBuilder) Finish() (Key, error) {
+	if b.pending == nil {
+		return nil, nil
+	}
+
+	if len(b.stack) == 0 {
+		// a single value
+		key, err := b.write(NewLeafNode(Path(""), b.pending, b.version, b.pendingValue))
+		if err != nil {
+			return nil, err
+		}
+		b.root = key
+	} else if err := b.place(-1); err != nil {
+		return nil, err
+	}
+	b.pending = nil
+
+	if err := b.flush(); err != nil {
+		return nil, err
+	}
+	return b.root, nil
+}
+
+// place - place the pending value and complete the branches deeper than
+// the common prefix length with the next path, -1 when there is no next path
+func (b *MPTBuilder) place(next int) error {
+	path := b.pending
+	if len(b.stack) == 0 || b.top().depth < next {
+		b.stack = append(b.stack, &builderBranch{depth: next})
+	}
+
+	top := b.top()
+	if top.depth == len(path) {
+		// the path is a prefix of the next one, the value goes on the branch
+		top.value = b.pendingValue
+	} else {
+		key, err := b.write(NewLeafNode(concat(path[:top.depth+1]), concat(path[top.depth+1:]), b.version, b.pendingValue))
+		if err != nil {
+			return err
+		}
+		top.children[builderChildIndex(path[top.depth])] = key
+	}
+
+	for len(b.stack) > 0 && b.top().depth > next {
+		branch := b.top()
+		b.stack = b.stack[:len(b.stack)-1]
+		fn := NewFullNode(branch.value)
+		fn.Children = branch.children
+		key, err := b.write(fn)
+		if err != nil {
+			return err
+		}
+
+		parentDepth := next
+		if len(b.stack) > 0 && b.top().depth > next {
+			parentDepth = b.top().depth
+		}
+		if parentDepth == -1 {
+			// the root, an extension is needed when all the paths share a prefix
+			if branch.depth > 0 {
+				if key, err = b.write(NewExtensionNode(concat(path[:branch.depth]), key)); err != nil {
+					return err
+				}
+			}
+			b.root = key
+			return nil
+		}
+		// the next path branches off between the parent and the completed branch
+		if len(b.stack) == 0 || b.top().depth < parentDepth {
+			b.stack = append(b.stack, &builderBranch{depth: parentDepth})
+		}
+		if branch.depth > parentDepth+1 {
+			if key, err = b.write(NewExtensionNode(concat(path[parentDepth+1:branch.depth]), key)); err != nil {
+				return err
+			}
+		}
+		b.top().children[builderChildIndex(path[parentDepth])] = key
+	}
+	return nil
+}
+
+func (b *MPTBuilder) top() *builderBranch {
+	return b.stack[len(b.stack)-1]
+}
+
+// write - queue the node for writing, the nodes are written in batches
+func (b *MPTBuilder) write(node Node) (Key, error) {
+	node.SetOrigin(b.version)
+	key := node.GetHashBytes()
+	b.keys = append(b.keys, key)
+	b.nodes = append(b.nodes, node)
+	if len(b.keys) >= BatchSize {
+		if err := b.flush(); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (b *MPTBuilder) flush() error {
+	if len(b.keys) == 0 {
+		return nil
+	}
+	if err := b.ndb.MultiPutNode(b.keys, b.nodes); err != nil {
+		return err
+	}
+	b.keys = make([]Key, 0, BatchSize)
+	b.nodes = make([]Node, 0, BatchSize)
+	return nil
+}
+
+// commonPrefixLen - the length of the common prefix of the two paths
+func commonPrefixLen(p1, p2 Path) int {
+	idx := 0
+	for ; idx < len(p1) && idx < len(p2) && p1[idx] == p2[idx]; idx++ {
+	}
+	return idx
+}
+
+// builderChildIndex - the child index of the path element
+func builderChildIndex(pe byte) int {
+	return int((&FullNode{}).index(pe))
+}
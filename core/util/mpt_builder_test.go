@@ -0,0 +1,90 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func testBuilderMatchesInsert(t *testing.T, paths []Path) {
+	sort.Slice(paths, func(i, j int) bool { return string(paths[i]) < string(paths[j]) })
+
+	version := Sequence(3)
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), version, nil, statecache.NewEmpty())
+	// with values on full nodes the shape of the trie depends on the insert order,
+	// the builder matches inserting in path order
+	for _, p := range paths {
+		_, err := mpt.Insert(p, &Txn{string(p)})
+		require.NoError(t, err)
+	}
+
+	ndb := NewMemoryNodeDB()
+	b := NewMPTBuilder(ndb, version)
+	for _, p := range paths {
+		require.NoError(t, b.Add(p, &Txn{string(p)}))
+	}
+	root, err := b.Finish()
+	require.NoError(t, err)
+	require.Equal(t, mpt.GetRoot(), root)
+	require.Equal(t, int64(len(paths)), b.Count())
+
+	// the built trie is complete and only the reachable nodes are written
+	bmpt := NewMerklePatriciaTrie(ndb, version, root, statecache.NewEmpty())
+	require.NoError(t, bmpt.Validate())
+	var reachable int64
+	err = bmpt.Iterate(context.TODO(), func(ctx context.Context, path Path, key Key, node Node) error {
+		reachable++
+		return nil
+	}, NodeTypeLeafNode|NodeTypeFullNode|NodeTypeExtensionNode)
+	require.NoError(t, err)
+	require.Equal(t, reachable, ndb.Size(context.TODO()))
+}
+
+func TestMPTBuilder(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		root, err := NewMPTBuilder(NewMemoryNodeDB(), 0).Finish()
+		require.NoError(t, err)
+		require.Nil(t, root)
+	})
+	t.Run("single", func(t *testing.T) {
+		testBuilderMatchesInsert(t, []Path{flatTestPath(1)})
+	})
+	t.Run("shared prefix", func(t *testing.T) {
+		testBuilderMatchesInsert(t, []Path{Path("0a1234"), Path("0a1256"), Path("0a12")})
+	})
+	t.Run("values on full nodes", func(t *testing.T) {
+		testBuilderMatchesInsert(t, []Path{Path("0a"), Path("0a12"), Path("0a1234"), Path("0a13"), Path("0b"), Path("1c")})
+	})
+	t.Run("random", func(t *testing.T) {
+		var paths []Path
+		for i := 0; i < 2000; i++ {
+			paths = append(paths, flatTestPath(i))
+		}
+		// values on full nodes and short paths
+		for i := 0; i < 50; i++ {
+			p := flatTestPath(i)
+			paths = append(paths, concat(p[:2+2*(i%8)], []byte(fmt.Sprintf("%02x", i))...))
+		}
+		seen := map[string]bool{}
+		var unique []Path
+		for _, p := range paths {
+			if !seen[string(p)] {
+				seen[string(p)] = true
+				unique = append(unique, p)
+			}
+		}
+		testBuilderMatchesInsert(t, unique)
+	})
+}
+
+func TestMPTBuilder_Unsorted(t *testing.T) {
+	b := NewMPTBuilder(NewMemoryNodeDB(), 0)
+	require.NoError(t, b.Add(Path("0b"), &Txn{"b"}))
+	require.Equal(t, ErrUnsortedPaths, b.Add(Path("0a"), &Txn{"a"}))
+	require.Equal(t, ErrUnsortedPaths, b.Add(Path("0b"), &Txn{"b"}))
+}
@@ -0,0 +1,329 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// errStopPage - stops the page walk once the limit is reached
+var errStopPage = errors.New("page complete")
+
+// countedNode - a node that can carry the leaf counts of its subtree
+type countedNode interface {
+	hasCounts() bool
+	encodeCounts() []byte
+	decodeCounts(buf []byte) ([]byte, error)
+}
+
+func (fn *FullNode) hasCounts() bool {
+	return len(fn.ChildCounts) == 16
+}
+
+func (fn *FullNode) encodeCounts() []byte {
+	buf := make([]byte, 0, 16*binary.MaxVarintLen64)
+	for _, c := range fn.ChildCounts {
+		buf = binary.AppendUvarint(buf, c)
+	}
+	return buf
+}
+
+func (fn *FullNode) decodeCounts(buf []byte) ([]byte, error) {
+	fn.ChildCounts = make([]uint64, 16)
+	for i := range fn.ChildCounts {
+		c, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, ErrInvalidEncoding
+		}
+		fn.ChildCounts[i] = c
+		buf = buf[n:]
+	}
+	return buf, nil
+}
+
+func (en *ExtensionNode) hasCounts() bool {
+	return en.LeafCount != nil
+}
+
+func (en *ExtensionNode) encodeCounts() []byte {
+	return binary.AppendUvarint(nil, *en.LeafCount)
+}
+
+func (en *ExtensionNode) decodeCounts(buf []byte) ([]byte, error) {
+	c, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrInvalidEncoding
+	}
+	en.LeafCount = &c
+	return buf[n:], nil
+}
+
+// nodeLeafCount - the number of values in the subtree of the node, false if the node carries no counts
+func nodeLeafCount(node Node) (uint64, bool) {
+	switch nodeImpl := node.(type) {
+	case *LeafNode:
+		if nodeImpl.HasValue() {
+			return 1, true
+		}
+		return 0, true
+	case *FullNode:
+		if !nodeImpl.hasCounts() {
+			return 0, false
+		}
+		var count uint64
+		if nodeImpl.HasValue() {
+			count++
+		}
+		for _, c := range nodeImpl.ChildCounts {
+			count += c
+		}
+		return count, true
+	case *ExtensionNode:
+		if !nodeImpl.hasCounts() {
+			return 0, false
+		}
+		return *nodeImpl.LeafCount, true
+	default:
+		return 0, false
+	}
+}
+
+// SetCountMode - when on, the full and extension nodes created by the trie keep the leaf counts
+// of their children, so CountPrefix and IteratePrefixPage run in O(depth). The counts are not part
+// of the node hash. Subtrees created without counts are counted on their first update.
+func (mpt *MerklePatriciaTrie) SetCountMode(on bool) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	mpt.countMode = on
+}
+
+// setNodeCounts - set the leaf counts of a new node, the counts of the children
+// unchanged from the old node are reused
+func (mpt *MerklePatriciaTrie) setNodeCounts(oldNode, newNode Node) error {
+	switch nodeImpl := newNode.(type) {
+	case *FullNode:
+		ofn, _ := oldNode.(*FullNode)
+		if ofn != nil && !ofn.hasCounts() {
+			ofn = nil
+		}
+		counts := make([]uint64, 16)
+		for i, ckey := range nodeImpl.Children {
+			if ckey == nil {
+				continue
+			}
+			if ofn != nil && bytes.Equal(ofn.Children[i], ckey) {
+				counts[i] = ofn.ChildCounts[i]
+				continue
+			}
+			c, err := mpt.subtreeCount(ckey)
+			if err != nil {
+				return err
+			}
+			counts[i] = c
+		}
+		nodeImpl.ChildCounts = counts
+	case *ExtensionNode:
+		if oen, ok := oldNode.(*ExtensionNode); ok && oen.hasCounts() && bytes.Equal(oen.NodeKey, nodeImpl.NodeKey) {
+			c := *oen.LeafCount
+			nodeImpl.LeafCount = &c
+			return nil
+		}
+		c, err := mpt.subtreeCount(nodeImpl.NodeKey)
+		if err != nil {
+			return err
+		}
+		nodeImpl.LeafCount = &c
+	}
+	return nil
+}
+
+// clearNodeCounts - drop the leaf counts of the node
+func clearNodeCounts(node Node) {
+	switch nodeImpl := node.(type) {
+	case *FullNode:
+		nodeImpl.ChildCounts = nil
+	case *ExtensionNode:
+		nodeImpl.LeafCount = nil
+	}
+}
+
+// subtreeCount - the number of values under the node key, walks the subtrees without counts
+func (mpt *MerklePatriciaTrie) subtreeCount(key Key) (uint64, error) {
+	node, err := mpt.getNode(key)
+	if err != nil {
+		return 0, err
+	}
+	return mpt.nodeSubtreeCount(node)
+}
+
+func (mpt *MerklePatriciaTrie) nodeSubtreeCount(node Node) (uint64, error) {
+	if c, ok := nodeLeafCount(node); ok {
+		return c, nil
+	}
+	switch nodeImpl := node.(type) {
+	case *FullNode:
+		var count uint64
+		if nodeImpl.HasValue() {
+			count++
+		}
+		for _, ckey := range nodeImpl.Children {
+			if ckey == nil {
+				continue
+			}
+			c, err := mpt.subtreeCount(ckey)
+			if err != nil {
+				return 0, err
+			}
+			count += c
+		}
+		return count, nil
+	case *ExtensionNode:
+		return mpt.subtreeCount(nodeImpl.NodeKey)
+	default:
+		panic(fmt.Sprintf("unknown node type: %T %v", node, node))
+	}
+}
+
+// findPrefixNode - the top most node whose subtree holds all the values with the prefix,
+// with the path leading to it, nil if there are none
+func (mpt *MerklePatriciaTrie) findPrefixNode(prefix Path) (Node, Path, error) {
+	if mpt.root == nil {
+		return nil, nil, nil
+	}
+	var (
+		key  = mpt.root
+		path = Path("")
+	)
+	for {
+		node, err := mpt.getNode(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(prefix) == 0 {
+			return node, path, nil
+		}
+		switch nodeImpl := node.(type) {
+		case *FullNode:
+			key = nodeImpl.GetChild(prefix[0])
+			if key == nil {
+				return nil, nil, nil
+			}
+			path = concat(path, prefix[0])
+			prefix = prefix[1:]
+		case *LeafNode:
+			if !bytes.HasPrefix(nodeImpl.Path, prefix) {
+				return nil, nil, nil
+			}
+			return node, path, nil
+		case *ExtensionNode:
+			if bytes.HasPrefix(nodeImpl.Path, prefix) {
+				return node, path, nil
+			}
+			if !bytes.HasPrefix(prefix, nodeImpl.Path) {
+				return nil, nil, nil
+			}
+			key = nodeImpl.NodeKey
+			path = concat(path, nodeImpl.Path...)
+			prefix = prefix[len(nodeImpl.Path):]
+		default:
+			panic(fmt.Sprintf("unknown node type: %T %v", node, node))
+		}
+	}
+}
+
+/*CountPrefix - the number of values with paths starting with the prefix, O(depth) in count mode */
+func (mpt *MerklePatriciaTrie) CountPrefix(prefix Path) (uint64, error) {
+	mpt.mutex.RLock()
+	defer mpt.mutex.RUnlock()
+
+	node, _, err := mpt.findPrefixNode(prefix)
+	if err != nil || node == nil {
+		return 0, err
+	}
+	return mpt.nodeSubtreeCount(node)
+}
+
+// IteratePrefixPage - visit the value nodes with paths starting with the prefix in path order,
+// skipping the first offset values and visiting at most limit values. In count mode the skipped
+// subtrees are not walked.
+func (mpt *MerklePatriciaTrie) IteratePrefixPage(ctx context.Context, prefix Path, offset, limit uint64, handler MPTIteratorHandler) error {
+	mpt.mutex.RLock()
+	defer mpt.mutex.RUnlock()
+
+	node, path, err := mpt.findPrefixNode(prefix)
+	if err != nil || node == nil || limit == 0 {
+		return err
+	}
+	err = mpt.iteratePage(ctx, path, node, &offset, &limit, handler)
+	if err == errStopPage {
+		return nil
+	}
+	return err
+}
+
+func (mpt *MerklePatriciaTrie) iteratePage(ctx context.Context, path Path, node Node, skip, limit *uint64, handler MPTIteratorHandler) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	if c, ok := nodeLeafCount(node); ok && *skip >= c {
+		*skip -= c
+		return nil
+	}
+
+	visit := func(path Path, vn *ValueNode) error {
+		if *skip > 0 {
+			*skip--
+			return nil
+		}
+		if err := handler(ctx, path, nil, vn); err != nil {
+			return err
+		}
+		*limit--
+		if *limit == 0 {
+			return errStopPage
+		}
+		return nil
+	}
+
+	switch nodeImpl := node.(type) {
+	case *LeafNode:
+		if nodeImpl.HasValue() {
+			return visit(concat(path, nodeImpl.Path...), nodeImpl.Value)
+		}
+	case *FullNode:
+		if nodeImpl.HasValue() {
+			if err := visit(path, nodeImpl.Value); err != nil {
+				return err
+			}
+		}
+		for i, pe := range PathElements {
+			ckey := nodeImpl.GetChild(pe)
+			if ckey == nil {
+				continue
+			}
+			if nodeImpl.hasCounts() && *skip >= nodeImpl.ChildCounts[i] {
+				*skip -= nodeImpl.ChildCounts[i]
+				continue
+			}
+			cnode, err := mpt.getNode(ckey)
+			if err != nil {
+				return err
+			}
+			if err := mpt.iteratePage(ctx, concat(path, pe), cnode, skip, limit, handler); err != nil {
+				return err
+			}
+		}
+	case *ExtensionNode:
+		cnode, err := mpt.getNode(nodeImpl.NodeKey)
+		if err != nil {
+			return err
+		}
+		return mpt.iteratePage(ctx, concat(path, nodeImpl.Path...), cnode, skip, limit, handler)
+	}
+	return nil
+}
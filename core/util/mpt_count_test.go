@@ -0,0 +1,164 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func countTestPrefixes() []string {
+	return []string{"", "0", "0a", "1", "ab", "f", "ff"}
+}
+
+func bruteCountPrefix(t *testing.T, mpt MerklePatriciaTrieI, prefix string) (uint64, []Path) {
+	var paths []Path
+	err := mpt.Iterate(context.TODO(), func(ctx context.Context, path Path, key Key, node Node) error {
+		if strings.HasPrefix(string(path), prefix) {
+			paths = append(paths, concat(path))
+		}
+		return nil
+	}, NodeTypeValueNode)
+	require.NoError(t, err)
+	return uint64(len(paths)), paths
+}
+
+func TestMerklePatriciaTrie_CountPrefix(t *testing.T) {
+	var (
+		rnd   = rand.New(rand.NewSource(1))
+		db    = NewMemoryNodeDB()
+		mpt   = NewMerklePatriciaTrie(db, Sequence(0), nil, statecache.NewEmpty())
+		plain = NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(0), nil, statecache.NewEmpty())
+		live  = map[int]bool{}
+	)
+	mpt.SetCountMode(true)
+	for i := 0; i < 500; i++ {
+		k := rnd.Intn(200)
+		if live[k] && rnd.Intn(3) == 0 {
+			_, err := mpt.Delete(flatTestPath(k))
+			require.NoError(t, err)
+			_, err = plain.Delete(flatTestPath(k))
+			require.NoError(t, err)
+			delete(live, k)
+			continue
+		}
+		v := &Txn{fmt.Sprintf("%d_%d", k, i)}
+		_, err := mpt.Insert(flatTestPath(k), v)
+		require.NoError(t, err)
+		_, err = plain.Insert(flatTestPath(k), v)
+		require.NoError(t, err)
+		live[k] = true
+	}
+
+	// the counts are not part of the hash
+	require.Equal(t, plain.GetRoot(), mpt.GetRoot())
+
+	for _, prefix := range countTestPrefixes() {
+		expected, _ := bruteCountPrefix(t, mpt, prefix)
+		count, err := mpt.CountPrefix(Path(prefix))
+		require.NoError(t, err)
+		require.Equal(t, expected, count, "prefix %q", prefix)
+
+		// the trie without counts walks the subtree
+		count, err = plain.CountPrefix(Path(prefix))
+		require.NoError(t, err)
+		require.Equal(t, expected, count, "prefix %q", prefix)
+	}
+
+	// the root carries the total count
+	root, err := mpt.getNode(mpt.GetRoot())
+	require.NoError(t, err)
+	total, ok := nodeLeafCount(root)
+	require.True(t, ok)
+	require.Equal(t, uint64(len(live)), total)
+}
+
+func TestMerklePatriciaTrie_CountsEncoding(t *testing.T) {
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+
+	mpt := NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), pndb, false), Sequence(0), nil, statecache.NewEmpty())
+	mpt.SetCountMode(true)
+	for i := 0; i < 100; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("%d", i)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, mpt.SaveChanges(context.TODO(), pndb, false))
+
+	// the counts survive the storage round trip
+	var counted int
+	err := pndb.Iterate(context.TODO(), func(ctx context.Context, key Key, node Node) error {
+		if cn, ok := node.(countedNode); ok {
+			require.True(t, cn.hasCounts())
+			counted++
+		}
+		require.Equal(t, key, Key(node.GetHashBytes()))
+		return nil
+	})
+	require.NoError(t, err)
+	require.NotZero(t, counted)
+
+	rmpt := NewMerklePatriciaTrie(pndb, Sequence(0), mpt.GetRoot(), statecache.NewEmpty())
+	count, err := rmpt.CountPrefix(Path(""))
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), count)
+
+	// an encoded node without counts decodes as before
+	fn := NewFullNode(&Txn{"x"})
+	fn.PutChild('1', Key(bytes.Repeat([]byte{1}, 32)))
+	node, err := CreateNode(bytes.NewReader(fn.Encode()))
+	require.NoError(t, err)
+	require.False(t, node.(*FullNode).hasCounts())
+
+	fn.ChildCounts = make([]uint64, 16)
+	fn.ChildCounts[1] = 300
+	node, err = CreateNode(bytes.NewReader(fn.Encode()))
+	require.NoError(t, err)
+	require.Equal(t, fn.ChildCounts, node.(*FullNode).ChildCounts)
+	require.Equal(t, fn.GetHashBytes(), node.GetHashBytes())
+}
+
+func TestMerklePatriciaTrie_IteratePrefixPage(t *testing.T) {
+	for _, countMode := range []bool{true, false} {
+		mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(0), nil, statecache.NewEmpty())
+		mpt.SetCountMode(countMode)
+		for i := 0; i < 300; i++ {
+			_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("%d", i)})
+			require.NoError(t, err)
+		}
+		// values on full nodes
+		for _, p := range []string{"0a", "ab"} {
+			_, err := mpt.Insert(Path(p), &Txn{p})
+			require.NoError(t, err)
+		}
+
+		for _, prefix := range countTestPrefixes() {
+			_, all := bruteCountPrefix(t, mpt, prefix)
+			for _, offset := range []uint64{0, 1, 7, 50, 299, 400} {
+				var page []Path
+				err := mpt.IteratePrefixPage(context.TODO(), Path(prefix), offset, 10,
+					func(ctx context.Context, path Path, key Key, node Node) error {
+						page = append(page, concat(path))
+						return nil
+					})
+				require.NoError(t, err)
+
+				var expected []Path
+				if offset < uint64(len(all)) {
+					end := offset + 10
+					if end > uint64(len(all)) {
+						end = uint64(len(all))
+					}
+					expected = all[offset:end]
+				}
+				require.Equal(t, expected, page, "prefix %q offset %d", prefix, offset)
+			}
+		}
+	}
+}
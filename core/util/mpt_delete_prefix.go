@@ -0,0 +1,133 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DeletePrefix - delete all the values with paths starting with the prefix in a single operation,
+// the subtree is detached and every removed node is recorded as deleted in the change collector.
+// The ancestors of the subtree are re-hashed once, the entries of the indexed values are deleted after.
+// Returns ErrValueNotPresent if there is no value under the prefix.
+func (mpt *MerklePatriciaTrie) DeletePrefix(prefix Path) (Key, error) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+
+	if mpt.root == nil {
+		return nil, ErrValueNotPresent
+	}
+	var changes []indexChange
+	if len(mpt.observers) > 0 || mpt.indexedPrefix(prefix) {
+		values, err := mpt.prefixValues(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, pv := range values {
+			if err := mpt.notify(MutationDelete, pv.path, pv.value, nil); err != nil {
+				return nil, err
+			}
+			if changes, err = mpt.addIndexChange(changes, pv.path, pv.value, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	_, newRootHash, err := mpt.deletePrefix(mpt.root, mpt.rootPrefix(), prefix)
+	if err != nil {
+		return nil, err
+	}
+	mpt.setRoot(newRootHash)
+	return mpt.updateIndexChanges(changes)
+}
+
+func (mpt *MerklePatriciaTrie) deletePrefix(key Key, prefix, path Path) (Node, Key, error) {
+	if key == nil {
+		return nil, nil, ErrValueNotPresent
+	}
+	node, err := mpt.getNode(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(path) == 0 {
+		return nil, nil, mpt.deleteSubtree(node, prefix)
+	}
+
+	switch nodeImpl := node.(type) {
+	case *FullNode:
+		_, ckey, err := mpt.deletePrefix(nodeImpl.GetChild(path[0]),
+			concat(prefix, path[:1]...), path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return mpt.deleteFullNodeChild(node, nodeImpl, prefix, path[0], ckey)
+	case *LeafNode:
+		if !bytes.HasPrefix(nodeImpl.Path, path) {
+			return nil, nil, ErrValueNotPresent
+		}
+		return nil, nil, mpt.deleteSubtree(node, prefix)
+	case *ExtensionNode:
+		if bytes.HasPrefix(nodeImpl.Path, path) {
+			return nil, nil, mpt.deleteSubtree(node, prefix)
+		}
+		matchPrefix := mpt.matchingPrefix(path, nodeImpl.Path)
+		if !bytes.Equal(matchPrefix, nodeImpl.Path) {
+			return nil, nil, ErrValueNotPresent
+		}
+
+		plen := len(matchPrefix)
+		cnode, ckey, err := mpt.deletePrefix(nodeImpl.NodeKey, concat(prefix, path[:plen]...), path[plen:])
+		if err != nil {
+			return nil, nil, err
+		}
+		if cnode == nil {
+			// the whole child is gone, so is the extension
+			return nil, nil, mpt.deleteNode(node)
+		}
+		return mpt.deleteExtensionChild(node, nodeImpl, prefix, cnode, ckey)
+	default:
+		panic(fmt.Sprintf("unknown node type: %T %v", node, node))
+	}
+}
+
+// deleteSubtree - delete the node and all its descendants along with the sub tries referenced by
+// the values, the paths of the removed values are marked dirty
+func (mpt *MerklePatriciaTrie) deleteSubtree(node Node, prefix Path) error {
+	switch nodeImpl := node.(type) {
+	case *FullNode:
+		if nodeImpl.HasValue() {
+			mpt.markDirty(prefix)
+			if err := mpt.releaseSubTrieRef(prefix, nodeImpl.GetValueBytes(), nil); err != nil {
+				return err
+			}
+		}
+		for _, pe := range PathElements {
+			ckey := nodeImpl.GetChild(pe)
+			if ckey == nil {
+				continue
+			}
+			cnode, err := mpt.getNode(ckey)
+			if err != nil {
+				return err
+			}
+			if err := mpt.deleteSubtree(cnode, concat(prefix, pe)); err != nil {
+				return err
+			}
+		}
+	case *LeafNode:
+		p := concat(nodeImpl.Prefix, nodeImpl.Path...)
+		mpt.markDirty(p)
+		if err := mpt.releaseSubTrieRef(p, nodeImpl.GetValueBytes(), nil); err != nil {
+			return err
+		}
+	case *ExtensionNode:
+		cnode, err := mpt.getNode(nodeImpl.NodeKey)
+		if err != nil {
+			return err
+		}
+		if err := mpt.deleteSubtree(cnode, concat(prefix, nodeImpl.Path...)); err != nil {
+			return err
+		}
+	default:
+		panic(fmt.Sprintf("unknown node type: %T %v", node, node))
+	}
+	return mpt.deleteNode(node)
+}
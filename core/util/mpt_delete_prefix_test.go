@@ -0,0 +1,124 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/encryption"
+	"github.com/0chain/common/core/statecache"
+)
+
+func deletePrefixTestPaths() []Path {
+	var paths []Path
+	for _, prefix := range []string{"0a", "0a12", "0b", "1f", "abcd"} {
+		for i := 0; i < 20; i++ {
+			h := encryption.Hash(fmt.Sprintf("%s_%d", prefix, i))
+			paths = append(paths, Path(prefix+h[:16]))
+		}
+	}
+	// values on full nodes
+	paths = append(paths, Path("0a"), Path("0a12"))
+	return paths
+}
+
+func newDeletePrefixTestMPT(t *testing.T, paths []Path) *MerklePatriciaTrie {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(0), nil, statecache.NewEmpty())
+	for _, p := range paths {
+		_, err := mpt.Insert(p, &Txn{string(p)})
+		require.NoError(t, err)
+	}
+	return mpt
+}
+
+func TestMerklePatriciaTrie_DeletePrefix(t *testing.T) {
+	paths := deletePrefixTestPaths()
+	for _, prefix := range []string{"0a", "0a1", "0a12", "0", "1f", "ab", "abcd", "0b"} {
+		t.Run(prefix, func(t *testing.T) {
+			mpt := newDeletePrefixTestMPT(t, paths)
+			expected := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(0), nil, statecache.NewEmpty())
+			var removed int
+			for _, p := range paths {
+				if strings.HasPrefix(string(p), prefix) {
+					removed++
+					continue
+				}
+				_, err := expected.Insert(p, &Txn{string(p)})
+				require.NoError(t, err)
+			}
+
+			root, err := mpt.DeletePrefix(Path(prefix))
+			require.NoError(t, err)
+			require.Equal(t, expected.GetRoot(), root)
+			require.NoError(t, mpt.Validate())
+
+			for _, p := range paths {
+				_, err := mpt.GetNodeValueRaw(p)
+				if strings.HasPrefix(string(p), prefix) {
+					require.Equal(t, ErrValueNotPresent, err)
+				} else {
+					require.NoError(t, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMerklePatriciaTrie_DeletePrefixChanges(t *testing.T) {
+	paths := deletePrefixTestPaths()
+	db := NewMemoryNodeDB()
+	mpt := NewMerklePatriciaTrie(db, Sequence(0), nil, statecache.NewEmpty())
+	for _, p := range paths {
+		_, err := mpt.Insert(p, &Txn{string(p)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, mpt.SaveChanges(context.TODO(), db, false))
+	start := mpt.GetRoot()
+
+	// the nodes of the subtree, collected before the delete
+	subtree := map[string]bool{}
+	err := mpt.Iterate(context.TODO(), func(ctx context.Context, path Path, key Key, node Node) error {
+		if strings.HasPrefix(string(path), "0a") {
+			subtree[string(key)] = true
+		}
+		return nil
+	}, NodeTypeLeafNode|NodeTypeFullNode|NodeTypeExtensionNode)
+	require.NoError(t, err)
+
+	mpt2 := NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), db, false), Sequence(1), start, statecache.NewEmpty())
+	_, err = mpt2.DeletePrefix(Path("0a"))
+	require.NoError(t, err)
+
+	deleted := map[string]bool{}
+	for _, d := range mpt2.GetDeletes() {
+		deleted[string(d.GetHashBytes())] = true
+	}
+	for k := range subtree {
+		require.True(t, deleted[k], "subtree node %s is not recorded as deleted", ToHex(Key(k)))
+	}
+
+	_, err = mpt2.DeletePrefix(Path("0a"))
+	require.Equal(t, ErrValueNotPresent, err)
+
+	root, err := mpt2.DeletePrefix(Path(""))
+	require.NoError(t, err)
+	require.Nil(t, root)
+}
+
+func TestMerklePatriciaTrie_DeleteKeepsPath(t *testing.T) {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	a, b := Path("0ab8b77cc7e918f8c2"), Path("0ab8b77cc7e918f8c3")
+	_, err := mpt.Insert(a, &Txn{"a"})
+	require.NoError(t, err)
+	_, err = mpt.Insert(b, &Txn{"b"})
+	require.NoError(t, err)
+
+	// the extension node merged with its child doesn't write to the inserted path
+	_, err = mpt.Delete(b)
+	require.NoError(t, err)
+	require.Equal(t, Path("0ab8b77cc7e918f8c3"), b)
+	doGetStrValue(t, mpt, string(a), "a")
+}
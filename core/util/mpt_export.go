@@ -0,0 +1,170 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// exported node types
+const (
+	ExportNodeTypeFull      = "full"
+	ExportNodeTypeLeaf      = "leaf"
+	ExportNodeTypeExtension = "extension"
+	ExportNodeTypeMissing   = "missing"
+)
+
+// ExportNode - a node of the exported trie structure
+type ExportNode struct {
+	Type      string `json:"type"`
+	Key       string `json:"key"`
+	Origin    int64  `json:"origin"`
+	Version   int64  `json:"version"`
+	Prefix    string `json:"prefix,omitempty"`
+	Path      string `json:"path,omitempty"`
+	ValueSize int    `json:"value_size,omitempty"`
+	// Children - the children of a full node by path element
+	Children map[string]*ExportNode `json:"children,omitempty"`
+	// Child - the child of an extension node
+	Child *ExportNode `json:"child,omitempty"`
+	// Truncated - the children are not exported because of the depth limit
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Export - export the structure of the subtree of the key, the root when the key is nil.
+// The nodes deeper than maxDepth are not exported, 0 means no limit. Missing nodes are exported
+// with their error so that partial states can be inspected.
+func (mpt *MerklePatriciaTrie) Export(key Key, maxDepth int) (*ExportNode, error) {
+	mpt.mutex.RLock()
+	defer mpt.mutex.RUnlock()
+	if key == nil {
+		key = mpt.root
+	}
+	if key == nil {
+		return nil, ErrNodeNotFound
+	}
+	return mpt.export(key, 0, maxDepth), nil
+}
+
+func (mpt *MerklePatriciaTrie) export(key Key, depth, maxDepth int) *ExportNode {
+	node, err := mpt.getNode(key)
+	if err != nil {
+		return &ExportNode{Type: ExportNodeTypeMissing, Key: ToHex(key), Error: err.Error()}
+	}
+
+	en := &ExportNode{
+		Key:     ToHex(key),
+		Origin:  int64(node.GetOrigin()),
+		Version: int64(node.GetVersion()),
+	}
+	truncated := maxDepth > 0 && depth >= maxDepth
+	switch nodeImpl := node.(type) {
+	case *LeafNode:
+		en.Type = ExportNodeTypeLeaf
+		en.Prefix = string(nodeImpl.Prefix)
+		en.Path = string(nodeImpl.Path)
+		en.ValueSize = len(nodeImpl.GetValueBytes())
+	case *FullNode:
+		en.Type = ExportNodeTypeFull
+		en.ValueSize = len(nodeImpl.GetValueBytes())
+		if truncated {
+			en.Truncated = nodeImpl.GetNumChildren() > 0
+			break
+		}
+		for _, pe := range PathElements {
+			if ckey := nodeImpl.GetChild(pe); ckey != nil {
+				if en.Children == nil {
+					en.Children = make(map[string]*ExportNode)
+				}
+				en.Children[string(pe)] = mpt.export(ckey, depth+1, maxDepth)
+			}
+		}
+	case *ExtensionNode:
+		en.Type = ExportNodeTypeExtension
+		en.Path = string(nodeImpl.Path)
+		if truncated {
+			en.Truncated = true
+			break
+		}
+		en.Child = mpt.export(nodeImpl.NodeKey, depth+1, maxDepth)
+	}
+	return en
+}
+
+// WriteJSON - write the structure of the subtree of the key as indented json
+func (mpt *MerklePatriciaTrie) WriteJSON(w io.Writer, key Key, maxDepth int) error {
+	en, err := mpt.Export(key, maxDepth)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(en)
+}
+
+// WriteDOT - write the structure of the subtree of the key as a graphviz digraph,
+// the edges are labeled with the path elements
+func (mpt *MerklePatriciaTrie) WriteDOT(w io.Writer, key Key, maxDepth int) error {
+	en, err := mpt.Export(key, maxDepth)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	sb.WriteString("digraph mpt {\n")
+	sb.WriteString("\tnode [shape=box, fontname=\"monospace\"];\n")
+	writeDOTNode(&sb, en)
+	sb.WriteString("}\n")
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+func writeDOTNode(sb *strings.Builder, en *ExportNode) {
+	short := en.Key
+	if len(short) > 12 {
+		short = short[:12]
+	}
+
+	var label, attrs string
+	switch en.Type {
+	case ExportNodeTypeFull:
+		label = fmt.Sprintf("F %s\no:%d v:%d", short, en.Origin, en.Version)
+	case ExportNodeTypeLeaf:
+		label = fmt.Sprintf("L %s\npath:%s\no:%d v:%d", short, en.Path, en.Origin, en.Version)
+		attrs = ", style=rounded"
+	case ExportNodeTypeExtension:
+		label = fmt.Sprintf("E %s\npath:%s\no:%d v:%d", short, en.Path, en.Origin, en.Version)
+		attrs = ", shape=cds"
+	default:
+		label = fmt.Sprintf("missing %s", short)
+		attrs = ", color=red"
+	}
+	if en.ValueSize > 0 {
+		label += fmt.Sprintf("\nvalue:%dB", en.ValueSize)
+	}
+	fmt.Fprintf(sb, "\t%q [label=%s%s];\n", en.Key, dotQuote(label), attrs)
+
+	if en.Truncated {
+		fmt.Fprintf(sb, "\t%q [label=\"...\", style=dashed];\n", en.Key+"_more")
+		fmt.Fprintf(sb, "\t%q -> %q [style=dashed];\n", en.Key, en.Key+"_more")
+	}
+	for _, pe := range PathElements {
+		child, ok := en.Children[string(pe)]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(sb, "\t%q -> %q [label=%q];\n", en.Key, child.Key, string(pe))
+		writeDOTNode(sb, child)
+	}
+	if en.Child != nil {
+		fmt.Fprintf(sb, "\t%q -> %q [label=%q];\n", en.Key, en.Child.Key, en.Path)
+		writeDOTNode(sb, en.Child)
+	}
+}
+
+// dotQuote - quote a graphviz label, the line breaks are kept as \n escapes
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,111 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func newExportTestMPT(t *testing.T) *MerklePatriciaTrie {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(2), nil, statecache.NewEmpty())
+	for i := 0; i < 50; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+	return mpt
+}
+
+func countExportNodes(en *ExportNode) (count int, leaves int) {
+	count = 1
+	if en.Type == ExportNodeTypeLeaf {
+		leaves = 1
+	}
+	children := make([]*ExportNode, 0, len(en.Children)+1)
+	for _, c := range en.Children {
+		children = append(children, c)
+	}
+	if en.Child != nil {
+		children = append(children, en.Child)
+	}
+	for _, c := range children {
+		n, l := countExportNodes(c)
+		count += n
+		leaves += l
+	}
+	return count, leaves
+}
+
+func TestMerklePatriciaTrie_ExportJSON(t *testing.T) {
+	mpt := newExportTestMPT(t)
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, mpt.WriteJSON(buf, nil, 0))
+	var en ExportNode
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &en))
+	require.Equal(t, ToHex(mpt.GetRoot()), en.Key)
+	require.Equal(t, ExportNodeTypeFull, en.Type)
+	require.Equal(t, int64(2), en.Origin)
+
+	_, leaves := countExportNodes(&en)
+	require.Equal(t, 50, leaves)
+
+	// depth limited
+	limited, err := mpt.Export(nil, 1)
+	require.NoError(t, err)
+	for _, c := range limited.Children {
+		require.Nil(t, c.Children)
+		require.Nil(t, c.Child)
+		if c.Type == ExportNodeTypeLeaf {
+			require.NotZero(t, c.ValueSize)
+		} else {
+			require.True(t, c.Truncated)
+		}
+	}
+
+	// a subtree by key
+	var child *ExportNode
+	for _, c := range en.Children {
+		child = c
+		break
+	}
+	sub, err := mpt.Export(Key(HashStringToBytes(child.Key)), 0)
+	require.NoError(t, err)
+	require.Equal(t, child, sub)
+}
+
+func TestMerklePatriciaTrie_ExportDOT(t *testing.T) {
+	mpt := newExportTestMPT(t)
+	en, err := mpt.Export(nil, 0)
+	require.NoError(t, err)
+	count, _ := countExportNodes(en)
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, mpt.WriteDOT(buf, nil, 0))
+	out := buf.String()
+	require.True(t, strings.HasPrefix(out, "digraph mpt {\n"))
+	require.True(t, strings.HasSuffix(out, "}\n"))
+	var nodes, edges int
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case strings.Contains(line, " -> "):
+			edges++
+		case strings.Contains(line, "[label="):
+			nodes++
+		}
+	}
+	require.Equal(t, count, nodes)
+	require.Equal(t, count-1, edges)
+	require.Contains(t, out, fmt.Sprintf("%q", ToHex(mpt.GetRoot())))
+
+	// missing nodes are rendered instead of failing
+	mpt2 := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(2), mpt.GetRoot(), statecache.NewEmpty())
+	buf.Reset()
+	require.NoError(t, mpt2.WriteDOT(buf, nil, 0))
+	require.Contains(t, buf.String(), "color=red")
+}
@@ -0,0 +1,246 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/0chain/common/core/logging"
+	"go.uber.org/zap"
+)
+
+// ErrFlatDBStale - the flat db is not at the start root of the changes being applied
+var ErrFlatDBStale = errors.New("flat db is stale")
+
+// errFullNodeValues - the changes have values on full nodes, which don't know their path
+var errFullNodeValues = errors.New("values on full nodes")
+
+// flatRebuildBatchSize - number of values written per batch when rebuilding a flat db
+const flatRebuildBatchSize = 1024
+
+// FlatDB - a flat index of the values of a state root by their full path.
+// It serves the reads at its root in a single lookup, the trie is still needed for hashing and proofs.
+type FlatDB interface {
+	// GetFlatRoot - the state root the index is up to date with
+	GetFlatRoot() Key
+	// GetFlatValue - the value of the path at the flat root, ErrValueNotPresent if not present
+	GetFlatValue(path Path) ([]byte, error)
+	// GetFlatValueAt - the value of the path when the flat root is root, checked and read atomically,
+	// ErrFlatDBStale if the index is not at root
+	GetFlatValueAt(root Key, path Path) ([]byte, error)
+	// UpdateFlat - atomically apply the value changes moving the index from startRoot to root,
+	// returns ErrFlatDBStale if the index is not at startRoot
+	UpdateFlat(startRoot, root Key, version Sequence, puts map[string][]byte, deletes []Path) error
+	// ClearFlat - remove all the values and the root
+	ClearFlat() error
+}
+
+// MemoryFlatDB - an in memory flat db
+type MemoryFlatDB struct {
+	root    Key
+	version Sequence
+	values  map[string][]byte
+	mutex   sync.RWMutex
+}
+
+// NewMemoryFlatDB - create a new in memory flat db
+func NewMemoryFlatDB() *MemoryFlatDB {
+	return &MemoryFlatDB{values: make(map[string][]byte)}
+}
+
+// GetFlatRoot - implement interface
+func (mfdb *MemoryFlatDB) GetFlatRoot() Key {
+	mfdb.mutex.RLock()
+	defer mfdb.mutex.RUnlock()
+	return mfdb.root
+}
+
+// GetFlatValue - implement interface
+func (mfdb *MemoryFlatDB) GetFlatValue(path Path) ([]byte, error) {
+	mfdb.mutex.RLock()
+	defer mfdb.mutex.RUnlock()
+	v, ok := mfdb.values[string(path)]
+	if !ok {
+		return nil, ErrValueNotPresent
+	}
+	return v, nil
+}
+
+// GetFlatValueAt - implement interface
+func (mfdb *MemoryFlatDB) GetFlatValueAt(root Key, path Path) ([]byte, error) {
+	mfdb.mutex.RLock()
+	defer mfdb.mutex.RUnlock()
+	if !bytes.Equal(mfdb.root, root) {
+		return nil, ErrFlatDBStale
+	}
+	v, ok := mfdb.values[string(path)]
+	if !ok {
+		return nil, ErrValueNotPresent
+	}
+	return v, nil
+}
+
+// UpdateFlat - implement interface
+func (mfdb *MemoryFlatDB) UpdateFlat(startRoot, root Key, version Sequence, puts map[string][]byte, deletes []Path) error {
+	mfdb.mutex.Lock()
+	defer mfdb.mutex.Unlock()
+	if !bytes.Equal(mfdb.root, startRoot) {
+		return ErrFlatDBStale
+	}
+	for _, p := range deletes {
+		delete(mfdb.values, string(p))
+	}
+	for p, v := range puts {
+		mfdb.values[p] = v
+	}
+	mfdb.root = root
+	mfdb.version = version
+	return nil
+}
+
+// ClearFlat - implement interface
+func (mfdb *MemoryFlatDB) ClearFlat() error {
+	mfdb.mutex.Lock()
+	defer mfdb.mutex.Unlock()
+	mfdb.values = make(map[string][]byte)
+	mfdb.root = nil
+	mfdb.version = 0
+	return nil
+}
+
+// Size - number of values in the db
+func (mfdb *MemoryFlatDB) Size() int {
+	mfdb.mutex.RLock()
+	defer mfdb.mutex.RUnlock()
+	return len(mfdb.values)
+}
+
+// RebuildFlatDB - rebuild the flat db from all the values of the trie
+func RebuildFlatDB(ctx context.Context, fdb FlatDB, mpt MerklePatriciaTrieI) error {
+	if err := fdb.ClearFlat(); err != nil {
+		return err
+	}
+
+	puts := make(map[string][]byte, flatRebuildBatchSize)
+	handler := func(ctx context.Context, path Path, key Key, node Node) error {
+		vn, ok := node.(*ValueNode)
+		if !ok {
+			return nil
+		}
+		puts[string(path)] = vn.GetValueBytes()
+		if len(puts) < flatRebuildBatchSize {
+			return nil
+		}
+		if err := fdb.UpdateFlat(nil, nil, mpt.GetVersion(), puts, nil); err != nil {
+			return err
+		}
+		puts = make(map[string][]byte, flatRebuildBatchSize)
+		return nil
+	}
+	if err := mpt.Iterate(ctx, handler, NodeTypeValueNode); err != nil {
+		return err
+	}
+
+	return fdb.UpdateFlat(nil, mpt.GetRoot(), mpt.GetVersion(), puts, nil)
+}
+
+// flatChanges - collect the value changes by full path from the node changes,
+// ok is false when a value can't be mapped to a path, full nodes don't know their path.
+// The values of the sub tries are not indexed.
+func flatChanges(changes []*NodeChange, deletes []Node) (puts map[string][]byte, dels []Path, ok bool) {
+	puts = make(map[string][]byte)
+	for _, c := range changes {
+		switch nodeImpl := c.New.(type) {
+		case *LeafNode:
+			if nodeImpl.HasValue() && !isSubTrieLeafPrefix(nodeImpl.Prefix) {
+				puts[string(concat(nodeImpl.Prefix, nodeImpl.Path...))] = nodeImpl.GetValueBytes()
+			}
+		case *FullNode:
+			if nodeImpl.HasValue() {
+				return nil, nil, false
+			}
+		}
+	}
+
+	for _, d := range deletes {
+		switch nodeImpl := d.(type) {
+		case *LeafNode:
+			p := concat(nodeImpl.Prefix, nodeImpl.Path...)
+			if _, ok := puts[string(p)]; !ok && !isSubTrieLeafPrefix(nodeImpl.Prefix) {
+				dels = append(dels, p)
+			}
+		case *FullNode:
+			if nodeImpl.HasValue() {
+				return nil, nil, false
+			}
+		}
+	}
+	return puts, dels, true
+}
+
+// SetFlatDB - set the flat db used to serve the reads and maintained by SaveChanges, the flat db
+// must be at the root of the trie, such as rebuilt by RebuildFlatDB
+func (mpt *MerklePatriciaTrie) SetFlatDB(fdb FlatDB) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	mpt.flat = fdb
+}
+
+// GetFlatDB - returns the flat db, nil if not set
+func (mpt *MerklePatriciaTrie) GetFlatDB() FlatDB {
+	mpt.mutex.RLock()
+	defer mpt.mutex.RUnlock()
+	return mpt.flat
+}
+
+// getFlatValue - unsafe, serves the read from the flat db when it's valid for the path, at the root of
+// the trie or at the start root of the changes not changing the path. The flat root is checked with the
+// read, the flat db may be updated meanwhile.
+func (mpt *MerklePatriciaTrie) getFlatValue(path Path) ([]byte, bool, error) {
+	if mpt.flat == nil {
+		return nil, false, nil
+	}
+	roots := []Key{mpt.root}
+	if mpt.ChangeCollector != nil {
+		if start := mpt.ChangeCollector.GetStartRoot(); !bytes.Equal(start, mpt.root) && mpt.indexValidFor(start, path) {
+			roots = append(roots, start)
+		}
+	}
+	for _, root := range roots {
+		if len(root) == 0 {
+			continue
+		}
+		v, err := mpt.flat.GetFlatValueAt(root, path)
+		if err == ErrFlatDBStale {
+			continue
+		}
+		return v, true, err
+	}
+	return nil, false, nil
+}
+
+// updateFlat - unsafe, apply the collected changes to the flat db. The flat db is to be dropped from the
+// trie by dropFlat when it can't be updated, it's set again once rebuilt by RebuildFlatDB.
+func (mpt *MerklePatriciaTrie) updateFlat(cc ChangeCollectorI) error {
+	if mpt.flat == nil {
+		return nil
+	}
+	puts, dels, ok := flatChanges(cc.GetChanges(), cc.GetDeletes())
+	if !ok {
+		return errFullNodeValues
+	}
+	return mpt.flat.UpdateFlat(cc.GetStartRoot(), mpt.root, mpt.Version, puts, dels)
+}
+
+// dropFlat - unsafe, requires the write lock, clear the flat db that can't be updated and stop using it
+func (mpt *MerklePatriciaTrie) dropFlat(reason error) {
+	logging.Logger.Error("MPT update flat db failed, drop flat db",
+		zap.String("flat root", ToHex(mpt.flat.GetFlatRoot())),
+		zap.String("root", ToHex(mpt.root)),
+		zap.Error(reason))
+	if err := mpt.flat.ClearFlat(); err != nil {
+		logging.Logger.Error("MPT clear flat db failed", zap.Error(err))
+	}
+	mpt.flat = nil
+}
@@ -0,0 +1,208 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/encryption"
+	"github.com/0chain/common/core/statecache"
+)
+
+func flatTestPath(i int) Path {
+	return Path(encryption.Hash(fmt.Sprintf("key_%d", i)))
+}
+
+// requireFlatMatchesTrie checks the flat db holds exactly the values of the trie
+func requireFlatMatchesTrie(t *testing.T, fdb FlatDB, size func() int, mpt MerklePatriciaTrieI) {
+	require.Equal(t, mpt.GetRoot(), fdb.GetFlatRoot())
+	count := 0
+	err := mpt.Iterate(context.TODO(), func(ctx context.Context, path Path, key Key, node Node) error {
+		count++
+		v, err := fdb.GetFlatValue(path)
+		require.NoError(t, err)
+		require.Equal(t, node.(*ValueNode).GetValueBytes(), v)
+		v, err = fdb.GetFlatValueAt(mpt.GetRoot(), path)
+		require.NoError(t, err)
+		require.Equal(t, node.(*ValueNode).GetValueBytes(), v)
+		_, err = fdb.GetFlatValueAt(Key("other"), path)
+		require.Equal(t, ErrFlatDBStale, err)
+		return nil
+	}, NodeTypeValueNode)
+	require.NoError(t, err)
+	require.Equal(t, count, size())
+}
+
+func testFlatDBRounds(t *testing.T, ndb NodeDB, fdb FlatDB, size func() int) {
+	var (
+		root Key
+		rnd  = rand.New(rand.NewSource(1))
+		live = map[int]bool{}
+	)
+	for round := int64(1); round <= 10; round++ {
+		mpt := NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), ndb, false), Sequence(round), root, statecache.NewEmpty())
+		mpt.SetFlatDB(fdb)
+		for i := 0; i < 50; i++ {
+			k := rnd.Intn(100)
+			if live[k] && rnd.Intn(3) == 0 {
+				_, err := mpt.Delete(flatTestPath(k))
+				require.NoError(t, err)
+				delete(live, k)
+				continue
+			}
+			_, err := mpt.Insert(flatTestPath(k), &Txn{fmt.Sprintf("%d_%d", k, round)})
+			require.NoError(t, err)
+			live[k] = true
+		}
+		require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+		root = mpt.GetRoot()
+
+		rmpt := NewMerklePatriciaTrie(ndb, Sequence(round), root, statecache.NewEmpty())
+		requireFlatMatchesTrie(t, fdb, size, rmpt)
+	}
+}
+
+func TestFlatDB_MemorySaveChanges(t *testing.T) {
+	fdb := NewMemoryFlatDB()
+	testFlatDBRounds(t, NewMemoryNodeDB(), fdb, fdb.Size)
+}
+
+func TestFlatDB_PNodeDBSaveChanges(t *testing.T) {
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+
+	size := func() int {
+		count := 0
+		it := pndb.db.NewIteratorCF(pndb.ro, pndb.flatCFH)
+		defer it.Close()
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			count++
+		}
+		return count - 1 // the root record
+	}
+	testFlatDBRounds(t, pndb, pndb, size)
+
+	root := pndb.GetFlatRoot()
+	require.NoError(t, pndb.loadFlatRoot())
+	require.Equal(t, root, pndb.GetFlatRoot())
+
+	require.NoError(t, pndb.ClearFlat())
+	require.Nil(t, pndb.GetFlatRoot())
+	require.Equal(t, -1, size())
+}
+
+func TestFlatDB_Reads(t *testing.T) {
+	mndb := NewMemoryNodeDB()
+	fdb := NewMemoryFlatDB()
+	mpt := NewMerklePatriciaTrie(mndb, Sequence(1), nil, statecache.NewEmpty())
+	for i := 0; i < 10; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("%d", i)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, RebuildFlatDB(context.TODO(), fdb, mpt))
+	requireFlatMatchesTrie(t, fdb, fdb.Size, mpt)
+
+	// the reads at the flat root are served without touching the node db
+	fmpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), mpt.GetRoot(), statecache.NewEmpty())
+	fmpt.SetFlatDB(fdb)
+	doGetStrValue(t, fmpt, string(flatTestPath(3)), "3")
+	_, err := fmpt.GetNodeValueRaw(flatTestPath(11))
+	require.Equal(t, ErrValueNotPresent, err)
+
+	// the changed paths are served by the trie, the others still by the flat db
+	cmpt := NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), mndb, false), Sequence(2), mpt.GetRoot(), statecache.NewEmpty())
+	cmpt.SetFlatDB(fdb)
+	_, err = cmpt.Insert(flatTestPath(3), &Txn{"33"})
+	require.NoError(t, err)
+	_, err = cmpt.Delete(flatTestPath(4))
+	require.NoError(t, err)
+	doGetStrValue(t, cmpt, string(flatTestPath(3)), "33")
+	_, err = cmpt.GetNodeValueRaw(flatTestPath(4))
+	require.Equal(t, ErrValueNotPresent, err)
+	doGetStrValue(t, cmpt, string(flatTestPath(5)), "5")
+}
+
+// racingFlatDB - reports the root of the flat db before its last update, as read before an update
+type racingFlatDB struct {
+	*MemoryFlatDB
+	root Key
+}
+
+func (r *racingFlatDB) GetFlatRoot() Key {
+	return r.root
+}
+
+func TestFlatDB_ReadsUpdated(t *testing.T) {
+	mndb := NewMemoryNodeDB()
+	fdb := NewMemoryFlatDB()
+	mpt := NewMerklePatriciaTrie(mndb, Sequence(1), nil, statecache.NewEmpty())
+	for i := 0; i < 10; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("%d", i)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, RebuildFlatDB(context.TODO(), fdb, mpt))
+	root := mpt.GetRoot()
+
+	// the flat db is moved to the next round while the trie at the previous root reads
+	rmpt := NewMerklePatriciaTrie(mndb, Sequence(1), root, statecache.NewEmpty())
+	rmpt.SetFlatDB(&racingFlatDB{MemoryFlatDB: fdb, root: root})
+	next := NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), mndb, false), Sequence(2), root, statecache.NewEmpty())
+	next.SetFlatDB(fdb)
+	_, err := next.Insert(flatTestPath(3), &Txn{"33"})
+	require.NoError(t, err)
+	require.NoError(t, next.SaveChanges(context.TODO(), mndb, false))
+	require.Equal(t, next.GetRoot(), fdb.GetFlatRoot())
+
+	doGetStrValue(t, rmpt, string(flatTestPath(3)), "3")
+	doGetStrValue(t, next, string(flatTestPath(3)), "33")
+}
+
+func TestFlatDB_FullNodeValues(t *testing.T) {
+	mndb := NewMemoryNodeDB()
+	fdb := NewMemoryFlatDB()
+	mpt := NewMerklePatriciaTrie(mndb, Sequence(1), nil, statecache.NewEmpty())
+	mpt.SetFlatDB(fdb)
+	doStrValInsert(t, mpt, "01", "1")
+	doStrValInsert(t, mpt, "0112", "2")
+	require.NoError(t, mpt.SaveChanges(context.TODO(), mndb, false))
+
+	// values on full nodes can't be indexed
+	require.Nil(t, fdb.GetFlatRoot())
+	require.Nil(t, mpt.GetFlatDB())
+	doGetStrValue(t, mpt, "01", "1")
+}
+
+func TestFlatDB_StaleDropped(t *testing.T) {
+	mndb := NewMemoryNodeDB()
+	fdb := NewMemoryFlatDB()
+	mpt := NewMerklePatriciaTrie(mndb, Sequence(1), nil, statecache.NewEmpty())
+	doStrValInsert(t, mpt, string(flatTestPath(1)), "1")
+	require.NoError(t, mpt.SaveChanges(context.TODO(), mndb, false))
+
+	// the flat db is not at the start root of the changes
+	mpt.SetFlatDB(fdb)
+	mpt.ChangeCollector = NewChangeCollector(mpt.GetRoot())
+	doStrValInsert(t, mpt, string(flatTestPath(2)), "2")
+	require.NoError(t, mpt.SaveChanges(context.TODO(), mndb, false))
+	require.Nil(t, mpt.GetFlatDB())
+	require.Nil(t, fdb.GetFlatRoot())
+
+	// used again once rebuilt
+	require.NoError(t, RebuildFlatDB(context.TODO(), fdb, mpt))
+	mpt.SetFlatDB(fdb)
+	mpt.ChangeCollector = NewChangeCollector(mpt.GetRoot())
+	doStrValInsert(t, mpt, string(flatTestPath(3)), "3")
+	require.NoError(t, mpt.SaveChanges(context.TODO(), mndb, false))
+	require.Equal(t, fdb, mpt.GetFlatDB())
+	requireFlatMatchesTrie(t, fdb, fdb.Size, mpt)
+}
+
+func TestFlatDB_Stale(t *testing.T) {
+	fdb := NewMemoryFlatDB()
+	require.NoError(t, fdb.UpdateFlat(nil, Key("root1"), 1, map[string][]byte{"01": []byte("1")}, nil))
+	require.Equal(t, ErrFlatDBStale, fdb.UpdateFlat(Key("root0"), Key("root2"), 2, nil, nil))
+	require.Equal(t, Key("root1"), fdb.GetFlatRoot())
+}
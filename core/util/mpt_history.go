@@ -0,0 +1,170 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/0chain/common/core/logging"
+	"go.uber.org/zap"
+)
+
+// ErrHistoryNotEnabled - no history db is set or the path is not tracked
+var ErrHistoryNotEnabled = errors.New("value history not enabled for the path")
+
+// ValueVersion - the value of a path written by a round with the state root of the round,
+// a nil value is a delete
+type ValueVersion struct {
+	Round int64
+	Root  Key
+	Value []byte
+}
+
+// HistoryDB - an index of the rounds changing the values of the paths
+type HistoryDB interface {
+	// UpdateHistory - record the values changed by the round with its root, a nil value is a delete.
+	// Recording a round again replaces the versions of the paths changed again.
+	UpdateHistory(round int64, root Key, changes map[string][]byte) error
+	// History - the versions of the value at the path, the oldest first
+	History(path Path) ([]ValueVersion, error)
+}
+
+// MemoryHistoryDB - an in memory history db
+type MemoryHistoryDB struct {
+	versions map[string][]ValueVersion
+	mutex    sync.RWMutex
+}
+
+// NewMemoryHistoryDB - create a new in memory history db
+func NewMemoryHistoryDB() *MemoryHistoryDB {
+	return &MemoryHistoryDB{versions: make(map[string][]ValueVersion)}
+}
+
+// UpdateHistory - implement interface
+func (mhdb *MemoryHistoryDB) UpdateHistory(round int64, root Key, changes map[string][]byte) error {
+	mhdb.mutex.Lock()
+	defer mhdb.mutex.Unlock()
+	for p, v := range changes {
+		versions := mhdb.versions[p]
+		idx := sort.Search(len(versions), func(i int) bool {
+			return versions[i].Round >= round
+		})
+		vv := ValueVersion{Round: round, Root: concat(root), Value: v}
+		if idx < len(versions) && versions[idx].Round == round {
+			versions[idx] = vv
+			continue
+		}
+		versions = append(versions, ValueVersion{})
+		copy(versions[idx+1:], versions[idx:])
+		versions[idx] = vv
+		mhdb.versions[p] = versions
+	}
+	return nil
+}
+
+// History - implement interface
+func (mhdb *MemoryHistoryDB) History(path Path) ([]ValueVersion, error) {
+	mhdb.mutex.RLock()
+	defer mhdb.mutex.RUnlock()
+	return append([]ValueVersion(nil), mhdb.versions[string(path)]...), nil
+}
+
+// SetHistoryDB - set the history db recording the value changes of the paths with the prefixes
+// when the changes are saved, all the paths are recorded if no prefix is given
+func (mpt *MerklePatriciaTrie) SetHistoryDB(hdb HistoryDB, prefixes ...Path) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	mpt.history = hdb
+	mpt.historyPrefixes = prefixes
+}
+
+// History - the versions of the value at the path recorded by the history db, the oldest first
+func (mpt *MerklePatriciaTrie) History(path Path) ([]ValueVersion, error) {
+	mpt.mutex.RLock()
+	hdb, tracked := mpt.history, mpt.historyTracks(path)
+	mpt.mutex.RUnlock()
+	if hdb == nil || !tracked {
+		return nil, ErrHistoryNotEnabled
+	}
+	return hdb.History(path)
+}
+
+// historyTracks - unsafe, true if the changes of the path are recorded
+func (mpt *MerklePatriciaTrie) historyTracks(path Path) bool {
+	if len(mpt.historyPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range mpt.historyPrefixes {
+		if bytes.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateHistory - record the value changes of the tracked paths in the history db, the changes
+// are found by comparing the start root with the root when they can't be told from the changed nodes
+func (mpt *MerklePatriciaTrie) updateHistory(cc ChangeCollectorI) {
+	if mpt.history == nil {
+		return
+	}
+	changes := make(map[string][]byte)
+	puts, dels, ok := flatChanges(cc.GetChanges(), cc.GetDeletes())
+	if ok {
+		// the leaves split or merged by the changes of their siblings are re-created with the same value
+		olds := make(map[string][]byte)
+		for _, d := range cc.GetDeletes() {
+			if ln, ok := d.(*LeafNode); ok && ln.HasValue() {
+				olds[string(concat(ln.Prefix, ln.Path...))] = ln.GetValueBytes()
+			}
+		}
+		for p, v := range puts {
+			if old, ok := olds[p]; ok && bytes.Equal(old, v) {
+				continue
+			}
+			changes[p] = v
+		}
+		for _, p := range dels {
+			changes[string(p)] = nil
+		}
+	} else {
+		err := diffValues(mergeCursorFor(mpt.startRootGetNode(cc), cc.GetStartRoot()),
+			mergeCursorFor(mpt.getNode, mpt.root), nil, changes)
+		if err != nil {
+			logging.Logger.Error("MPT update history - diff values failed",
+				zap.Int64("round", int64(mpt.Version)),
+				zap.Error(err))
+			return
+		}
+	}
+
+	for p := range changes {
+		if !mpt.historyTracks(Path(p)) {
+			delete(changes, p)
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	if err := mpt.history.UpdateHistory(int64(mpt.Version), mpt.root, changes); err != nil {
+		logging.Logger.Error("MPT update history failed",
+			zap.Int64("round", int64(mpt.Version)),
+			zap.Error(err))
+	}
+}
+
+// startRootGetNode - unsafe, get the nodes of the start root of the collected changes, the changed
+// nodes may be deleted from the db already and are taken from the deletes
+func (mpt *MerklePatriciaTrie) startRootGetNode(cc ChangeCollectorI) func(Key) (Node, error) {
+	olds := make(map[string]Node)
+	for _, d := range cc.GetDeletes() {
+		olds[string(d.GetHashBytes())] = d
+	}
+	return func(key Key) (Node, error) {
+		if n, ok := olds[string(key)]; ok {
+			return n, nil
+		}
+		return mpt.getNode(key)
+	}
+}
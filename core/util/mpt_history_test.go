@@ -0,0 +1,175 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/encryption"
+	"github.com/0chain/common/core/statecache"
+)
+
+func historyTestPath(prefix string, i int) Path {
+	return Path(prefix + encryption.Hash(fmt.Sprintf("%s_%d", prefix, i))[:16])
+}
+
+func testHistory(t *testing.T, hdb HistoryDB) {
+	var (
+		ndb     = NewMemoryNodeDB()
+		tracked = historyTestPath("0a", 1)
+		other   = historyTestPath("1f", 1)
+		roots   = make(map[int64]Key)
+		root    Key
+	)
+	for round := int64(1); round <= 4; round++ {
+		mpt := NewMerklePatriciaTrie(ndb, Sequence(round), root, statecache.NewEmpty())
+		mpt.SetHistoryDB(hdb, Path("0a"))
+		for i := 0; i < 10; i++ {
+			_, err := mpt.Insert(historyTestPath("0a", i), &Txn{fmt.Sprintf("value_%d", round)})
+			require.NoError(t, err)
+		}
+		_, err := mpt.Insert(other, &Txn{fmt.Sprintf("value_%d", round)})
+		require.NoError(t, err)
+		switch round {
+		case 2:
+			// a value on a full node, the changes are found by comparing the roots
+			_, err = mpt.Insert(Path("0a"), &Txn{"full"})
+			require.NoError(t, err)
+		case 3:
+			_, err = mpt.Delete(tracked)
+			require.NoError(t, err)
+		case 4:
+			_, err = mpt.Delete(Path("0a"))
+			require.NoError(t, err)
+		}
+		require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+		root = mpt.GetRoot()
+		roots[round] = root
+	}
+
+	mpt := NewMerklePatriciaTrie(ndb, Sequence(4), root, statecache.NewEmpty())
+	mpt.SetHistoryDB(hdb, Path("0a"))
+	versions, err := mpt.History(tracked)
+	require.NoError(t, err)
+	require.Len(t, versions, 4)
+	for i, vv := range versions {
+		round := int64(i + 1)
+		require.Equal(t, round, vv.Round)
+		require.Equal(t, roots[round], vv.Root)
+		if round == 3 {
+			// deleted in round 3, inserted again in round 4
+			require.Nil(t, vv.Value)
+			continue
+		}
+		ev, err := (&Txn{fmt.Sprintf("value_%d", round)}).MarshalMsg(nil)
+		require.NoError(t, err)
+		require.Equal(t, ev, vv.Value)
+	}
+
+	versions, err = mpt.History(Path("0a"))
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	require.Equal(t, int64(2), versions[0].Round)
+	require.NotNil(t, versions[0].Value)
+	require.Equal(t, int64(4), versions[1].Round)
+	require.Nil(t, versions[1].Value)
+
+	_, err = mpt.History(other)
+	require.Equal(t, ErrHistoryNotEnabled, err)
+}
+
+func TestMerklePatriciaTrie_History(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testHistory(t, NewMemoryHistoryDB())
+	})
+	t.Run("pnodedb", func(t *testing.T) {
+		pndb, cleanup := newPNodeDB(t)
+		defer cleanup()
+		testHistory(t, pndb)
+	})
+}
+
+func TestMerklePatriciaTrie_HistorySiblings(t *testing.T) {
+	var (
+		ndb     = NewMemoryNodeDB()
+		hdb     = NewMemoryHistoryDB()
+		tracked = historyTestPath("0a", 1)
+		sibling = concat(Path(nil), tracked...)
+		root    Key
+	)
+	sibling[len(sibling)-1] = PathElements[(bytes.IndexByte(PathElements, sibling[len(sibling)-1])+1)%len(PathElements)]
+	for round := int64(1); round <= 3; round++ {
+		mpt := NewMerklePatriciaTrie(ndb, Sequence(round), root, statecache.NewEmpty())
+		mpt.SetHistoryDB(hdb, Path("0a"))
+		var err error
+		switch round {
+		case 1:
+			_, err = mpt.Insert(tracked, &Txn{"value"})
+		case 2:
+			// the leaf of the tracked value is split
+			_, err = mpt.Insert(sibling, &Txn{"sibling"})
+		case 3:
+			// and merged again
+			_, err = mpt.Delete(sibling)
+		}
+		require.NoError(t, err)
+		require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+		root = mpt.GetRoot()
+	}
+
+	mpt := NewMerklePatriciaTrie(ndb, Sequence(3), root, statecache.NewEmpty())
+	mpt.SetHistoryDB(hdb, Path("0a"))
+	versions, err := mpt.History(tracked)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, int64(1), versions[0].Round)
+
+	versions, err = mpt.History(sibling)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	require.Equal(t, int64(2), versions[0].Round)
+	require.Equal(t, int64(3), versions[1].Round)
+	require.Nil(t, versions[1].Value)
+}
+
+func TestPNodeDB_DeleteHistoryAfter(t *testing.T) {
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+
+	path := historyTestPath("0a", 1)
+	// a longer path with the same prefix
+	longer := concat(path, '0')
+	for round := int64(1); round <= 3; round++ {
+		require.NoError(t, pndb.UpdateHistory(round, Key(fmt.Sprintf("root_%d", round)), map[string][]byte{
+			string(path):   []byte(fmt.Sprintf("value_%d", round)),
+			string(longer): nil,
+		}))
+	}
+	versions, err := pndb.History(path)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+
+	require.NoError(t, pndb.deleteHistoryAfter(1))
+	versions, err = pndb.History(path)
+	require.NoError(t, err)
+	require.Equal(t, []ValueVersion{{Round: 1, Root: Key("root_1"), Value: []byte("value_1")}}, versions)
+	versions, err = pndb.History(longer)
+	require.NoError(t, err)
+	require.Equal(t, []ValueVersion{{Round: 1, Root: Key("root_1")}}, versions)
+
+	// the rounds are written again after the deleted ones
+	require.NoError(t, pndb.UpdateHistory(2, Key("root_2"), map[string][]byte{string(longer): []byte("value")}))
+	require.NoError(t, pndb.deleteHistoryAfter(0))
+	for _, p := range []Path{path, longer} {
+		versions, err = pndb.History(p)
+		require.NoError(t, err)
+		require.Empty(t, versions)
+	}
+	it := pndb.db.NewIteratorCF(pndb.ro, pndb.historyCFH)
+	defer it.Close()
+	it.SeekToFirst()
+	require.False(t, it.Valid())
+}
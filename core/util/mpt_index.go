@@ -0,0 +1,200 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrIndexOverlap - the prefixes of the index overlap an indexed prefix or the entries of another index
+var ErrIndexOverlap = errors.New("index prefix overlap")
+
+// IndexExtractor - the index keys of a decoded value. The keys of an index should be of the same
+// length, such as hashes, so that the entries of a key are exactly the paths starting with it.
+type IndexExtractor func(value MPTSerializable) ([]Path, error)
+
+// SecondaryIndex - an index of the values under the primary prefix by the keys extracted from them,
+// such as the allocations by owner. An entry is kept at the index prefix followed by the key and
+// the primary path, with the primary path as its value.
+type SecondaryIndex struct {
+	Primary Path                   // the prefix of the indexed values
+	Index   Path                   // the prefix of the index entries
+	New     func() MPTSerializable // a new value of the type of the indexed values
+	Extract IndexExtractor
+}
+
+func (idx *SecondaryIndex) entryPath(key, path Path) Path {
+	return concat(concat(idx.Index, key...), path...)
+}
+
+// keys - the index keys of the encoded value, none for a missing value
+func (idx *SecondaryIndex) keys(value []byte) ([]Path, error) {
+	if value == nil {
+		return nil, nil
+	}
+	v := idx.New()
+	if _, err := v.UnmarshalMsg(value); err != nil {
+		return nil, err
+	}
+	return idx.Extract(v)
+}
+
+func prefixesOverlap(p1, p2 Path) bool {
+	return bytes.HasPrefix(p1, p2) || bytes.HasPrefix(p2, p1)
+}
+
+// AddIndex - keep the secondary index in sync with the values inserted, deleted, migrated and merged by
+// MergeSiblings and MergeDB under its primary prefix, the entries are written along with the values so
+// they are part of the same changes. The existing values are not indexed, see BuildIndex. The changes
+// merged by MergeChanges carry the entries written by the other trie, and RewindTo moves the entries
+// back along with the values.
+func (mpt *MerklePatriciaTrie) AddIndex(idx *SecondaryIndex) error {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	if prefixesOverlap(idx.Primary, idx.Index) {
+		return ErrIndexOverlap
+	}
+	for _, other := range mpt.indexes {
+		if prefixesOverlap(idx.Index, other.Primary) || prefixesOverlap(idx.Index, other.Index) ||
+			prefixesOverlap(idx.Primary, other.Index) {
+			return ErrIndexOverlap
+		}
+	}
+	mpt.indexes = append(mpt.indexes, idx)
+	return nil
+}
+
+// BuildIndex - write the index entries of the existing values under the primary prefix
+func (mpt *MerklePatriciaTrie) BuildIndex(idx *SecondaryIndex) (Key, error) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	values, err := mpt.prefixValues(idx.Primary)
+	if err != nil {
+		return nil, err
+	}
+	for _, pv := range values {
+		keys, err := idx.keys(pv.value)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if _, err := mpt.insertValue(idx.entryPath(key, pv.path), pv.path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return mpt.root, nil
+}
+
+// LookupIndex - the paths of the values with the index key in path order
+func (mpt *MerklePatriciaTrie) LookupIndex(idx *SecondaryIndex, key Path) ([]Path, error) {
+	mpt.mutex.RLock()
+	defer mpt.mutex.RUnlock()
+	entries, err := mpt.prefixValues(concat(idx.Index, key...))
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]Path, 0, len(entries))
+	for _, e := range entries {
+		paths = append(paths, Path(e.value))
+	}
+	return paths, nil
+}
+
+// indexed - unsafe, true if the value at the path is indexed
+func (mpt *MerklePatriciaTrie) indexed(path Path) bool {
+	for _, idx := range mpt.indexes {
+		if bytes.HasPrefix(path, idx.Primary) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexUpdates - unsafe, the paths of the index entries to delete and to add when the value at the path changes
+func (mpt *MerklePatriciaTrie) indexUpdates(path Path, old, value []byte) (dels, puts []Path, err error) {
+	for _, idx := range mpt.indexes {
+		if !bytes.HasPrefix(path, idx.Primary) {
+			continue
+		}
+		oldKeys, err := idx.keys(old)
+		if err != nil {
+			return nil, nil, err
+		}
+		newKeys, err := idx.keys(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		kept := make(map[string]bool, len(newKeys))
+		for _, key := range newKeys {
+			kept[string(key)] = false
+		}
+		for _, key := range oldKeys {
+			if _, ok := kept[string(key)]; ok {
+				kept[string(key)] = true
+				continue
+			}
+			dels = append(dels, idx.entryPath(key, path))
+		}
+		for _, key := range newKeys {
+			if !kept[string(key)] {
+				puts = append(puts, idx.entryPath(key, path))
+			}
+		}
+	}
+	return dels, puts, nil
+}
+
+// updateIndexes - unsafe, write the index entry changes of the value at the path, the missing
+// entries of the values written before the index was added are skipped
+func (mpt *MerklePatriciaTrie) updateIndexes(path Path, dels, puts []Path) (Key, error) {
+	for _, p := range dels {
+		if _, err := mpt.deleteValue(p); err != nil && err != ErrValueNotPresent {
+			return nil, err
+		}
+	}
+	for _, p := range puts {
+		if _, err := mpt.insertValue(p, path); err != nil {
+			return nil, err
+		}
+	}
+	return mpt.root, nil
+}
+
+// indexChange - the index entry changes of the value at the path
+type indexChange struct {
+	path Path
+	dels []Path
+	puts []Path
+}
+
+// indexedPrefix - unsafe, true if some values under the prefix are indexed
+func (mpt *MerklePatriciaTrie) indexedPrefix(prefix Path) bool {
+	for _, idx := range mpt.indexes {
+		if prefixesOverlap(prefix, idx.Primary) {
+			return true
+		}
+	}
+	return false
+}
+
+// addIndexChange - unsafe, append the index entry changes of the value at the path if it is indexed
+func (mpt *MerklePatriciaTrie) addIndexChange(changes []indexChange, path Path, old, value []byte) ([]indexChange, error) {
+	if !mpt.indexed(path) {
+		return changes, nil
+	}
+	dels, puts, err := mpt.indexUpdates(path, old, value)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, indexChange{path: path, dels: dels, puts: puts}), nil
+}
+
+// updateIndexChanges - unsafe, write the index entry changes of the values
+func (mpt *MerklePatriciaTrie) updateIndexChanges(changes []indexChange) (Key, error) {
+	for _, c := range changes {
+		if _, err := mpt.updateIndexes(c.path, c.dels, c.puts); err != nil {
+			return nil, err
+		}
+	}
+	return mpt.root, nil
+}
@@ -0,0 +1,164 @@
+package util
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+// ownerIndex - indexes the values under 0a by the owner in the first 4 characters of the data
+func ownerIndex() *SecondaryIndex {
+	return &SecondaryIndex{
+		Primary: Path("0a"),
+		Index:   Path("0b"),
+		New:     func() MPTSerializable { return &Txn{} },
+		Extract: func(value MPTSerializable) ([]Path, error) {
+			return []Path{Path(value.(*Txn).Data[:4])}, nil
+		},
+	}
+}
+
+func TestMerklePatriciaTrie_SecondaryIndex(t *testing.T) {
+	ndb := NewMemoryNodeDB()
+	mpt := NewMerklePatriciaTrie(ndb, Sequence(1), nil, statecache.NewEmpty())
+	idx := ownerIndex()
+	require.NoError(t, mpt.AddIndex(idx))
+
+	_, err := mpt.Insert(Path("0a01"), &Txn{"aaaa_1"})
+	require.NoError(t, err)
+	_, err = mpt.Insert(Path("0a02"), &Txn{"aaaa_2"})
+	require.NoError(t, err)
+	_, err = mpt.Insert(Path("0a03"), &Txn{"bbbb_3"})
+	require.NoError(t, err)
+	// not indexed
+	_, err = mpt.Insert(Path("0c01"), &Txn{"cccc_1"})
+	require.NoError(t, err)
+
+	paths, err := mpt.LookupIndex(idx, Path("aaaa"))
+	require.NoError(t, err)
+	require.Equal(t, []Path{Path("0a01"), Path("0a02")}, paths)
+
+	// the owner changes
+	_, err = mpt.Insert(Path("0a02"), &Txn{"bbbb_2"})
+	require.NoError(t, err)
+	_, err = mpt.Delete(Path("0a01"))
+	require.NoError(t, err)
+	paths, err = mpt.LookupIndex(idx, Path("aaaa"))
+	require.NoError(t, err)
+	require.Empty(t, paths)
+	paths, err = mpt.LookupIndex(idx, Path("bbbb"))
+	require.NoError(t, err)
+	require.Equal(t, []Path{Path("0a02"), Path("0a03")}, paths)
+
+	// the entries are saved with the values
+	require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+	saved := NewMerklePatriciaTrie(ndb, Sequence(1), mpt.GetRoot(), statecache.NewEmpty())
+	paths, err = saved.LookupIndex(idx, Path("bbbb"))
+	require.NoError(t, err)
+	require.Equal(t, []Path{Path("0a02"), Path("0a03")}, paths)
+	require.Equal(t, map[string]string{
+		"0a02":       string(encodeTxn(t, "bbbb_2")),
+		"0a03":       string(encodeTxn(t, "bbbb_3")),
+		"0c01":       string(encodeTxn(t, "cccc_1")),
+		"0bbbbb0a02": "0a02",
+		"0bbbbb0a03": "0a03",
+	}, trieValues(t, saved))
+}
+
+func TestMerklePatriciaTrie_BuildIndex(t *testing.T) {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	_, err := mpt.Insert(Path("0a01"), &Txn{"aaaa_1"})
+	require.NoError(t, err)
+	_, err = mpt.Insert(Path("0a02"), &Txn{"bbbb_2"})
+	require.NoError(t, err)
+
+	idx := ownerIndex()
+	require.NoError(t, mpt.AddIndex(idx))
+	paths, err := mpt.LookupIndex(idx, Path("aaaa"))
+	require.NoError(t, err)
+	require.Empty(t, paths)
+
+	_, err = mpt.BuildIndex(idx)
+	require.NoError(t, err)
+	paths, err = mpt.LookupIndex(idx, Path("aaaa"))
+	require.NoError(t, err)
+	require.Equal(t, []Path{Path("0a01")}, paths)
+	paths, err = mpt.LookupIndex(idx, Path("bbbb"))
+	require.NoError(t, err)
+	require.Equal(t, []Path{Path("0a02")}, paths)
+}
+
+func TestMerklePatriciaTrie_AddIndexOverlap(t *testing.T) {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	require.Equal(t, ErrIndexOverlap, mpt.AddIndex(&SecondaryIndex{Primary: Path("0a"), Index: Path("0a1")}))
+	require.NoError(t, mpt.AddIndex(ownerIndex()))
+	// another index of the same values
+	require.NoError(t, mpt.AddIndex(&SecondaryIndex{Primary: Path("0a"), Index: Path("0c")}))
+	// the entries of the index would be indexed
+	require.Equal(t, ErrIndexOverlap, mpt.AddIndex(&SecondaryIndex{Primary: Path("0b"), Index: Path("0d")}))
+	require.Equal(t, ErrIndexOverlap, mpt.AddIndex(&SecondaryIndex{Primary: Path("0d"), Index: Path("0b1")}))
+}
+
+func TestMerklePatriciaTrie_IndexBulkChanges(t *testing.T) {
+	newIndexedTrie := func(ndb NodeDB, root Key) (*MerklePatriciaTrie, *SecondaryIndex) {
+		mpt := NewMerklePatriciaTrie(ndb, Sequence(1), root, statecache.NewEmpty())
+		idx := ownerIndex()
+		require.NoError(t, mpt.AddIndex(idx))
+		return mpt, idx
+	}
+	lookup := func(mpt *MerklePatriciaTrie, idx *SecondaryIndex, key string) []Path {
+		paths, err := mpt.LookupIndex(idx, Path(key))
+		require.NoError(t, err)
+		return paths
+	}
+
+	ndb := NewMemoryNodeDB()
+	base, _ := newIndexedTrie(ndb, nil)
+	for _, p := range []string{"0a01", "0a02", "0a11"} {
+		_, err := base.Insert(Path(p), &Txn{"aaaa_" + p})
+		require.NoError(t, err)
+	}
+	require.NoError(t, base.SaveChanges(context.TODO(), ndb, false))
+
+	t.Run("DeletePrefix", func(t *testing.T) {
+		mpt, idx := newIndexedTrie(NewLevelNodeDB(NewMemoryNodeDB(), ndb, false), base.GetRoot())
+		_, err := mpt.DeletePrefix(Path("0a0"))
+		require.NoError(t, err)
+		require.Equal(t, []Path{Path("0a11")}, lookup(mpt, idx, "aaaa"))
+	})
+
+	t.Run("MergeSiblings", func(t *testing.T) {
+		mpt, idx := newIndexedTrie(NewLevelNodeDB(NewMemoryNodeDB(), ndb, false), base.GetRoot())
+		// a sibling without the index
+		mpt1 := NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), ndb, false), Sequence(1), base.GetRoot(), statecache.NewEmpty())
+		_, err := mpt1.Insert(Path("0a01"), &Txn{"bbbb_1"})
+		require.NoError(t, err)
+		// and one with it
+		mpt2, _ := newIndexedTrie(NewLevelNodeDB(NewMemoryNodeDB(), ndb, false), base.GetRoot())
+		_, err = mpt2.Delete(Path("0a02"))
+		require.NoError(t, err)
+
+		_, err = mpt.MergeSiblings(mpt1, mpt2)
+		require.NoError(t, err)
+		require.Equal(t, []Path{Path("0a11")}, lookup(mpt, idx, "aaaa"))
+		require.Equal(t, []Path{Path("0a01")}, lookup(mpt, idx, "bbbb"))
+	})
+
+	t.Run("MergeDB", func(t *testing.T) {
+		mpt, idx := newIndexedTrie(NewLevelNodeDB(NewMemoryNodeDB(), ndb, false), base.GetRoot())
+		other := NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), ndb, false), Sequence(1), base.GetRoot(), statecache.NewEmpty())
+		_, err := other.Insert(Path("0a01"), &Txn{"bbbb_1"})
+		require.NoError(t, err)
+		_, err = other.Delete(Path("0a11"))
+		require.NoError(t, err)
+		mdb := NewMemoryNodeDB()
+		require.NoError(t, other.SaveChanges(context.TODO(), mdb, false))
+
+		require.NoError(t, mpt.MergeDB(mdb, other.GetRoot(), nil))
+		require.Equal(t, []Path{Path("0a02")}, lookup(mpt, idx, "aaaa"))
+		require.Equal(t, []Path{Path("0a01")}, lookup(mpt, idx, "bbbb"))
+	})
+}
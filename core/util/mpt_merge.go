@@ -0,0 +1,289 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// ErrMergeConflict - the sibling tries wrote different values to the same paths
+	ErrMergeConflict = errors.New("merge conflict")
+	// ErrMergeBaseMismatch - the sibling tries are not derived from the root of the trie
+	ErrMergeBaseMismatch = errors.New("merge base mismatch")
+)
+
+// MergeConflict - a path written by both sibling tries, a nil value is a delete
+type MergeConflict struct {
+	Path   Path
+	Value1 []byte
+	Value2 []byte
+}
+
+// MergeSiblings - three way merge of two tries derived from the root of this trie, such as
+// transactions executed in parallel. The value changes of both tries are applied to this trie
+// when their write sets don't overlap, otherwise the conflicting paths are returned with
+// ErrMergeConflict. Writing the same value on both sides is not a conflict. The values are written
+// to a scratch trie with the entries of the indexed values and the nodes of the sub tries written by
+// the siblings, then merged at once as by MergeChanges, so the trie is left unchanged on any error.
+func (mpt *MerklePatriciaTrie) MergeSiblings(mpt1, mpt2 MerklePatriciaTrieI) ([]MergeConflict, error) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+
+	for _, m := range []MerklePatriciaTrieI{mpt1, mpt2} {
+		if _, _, _, startRoot := m.GetChanges(); !bytes.Equal(startRoot, mpt.root) {
+			return nil, ErrMergeBaseMismatch
+		}
+	}
+
+	base := mergeCursorFor(mpt.getNode, mpt.root)
+	diff1 := make(map[string][]byte)
+	if err := diffValues(base, mergeCursorFor(mpt1.GetNodeDB().GetNode, mpt1.GetRoot()), nil, diff1); err != nil {
+		return nil, err
+	}
+	diff2 := make(map[string][]byte)
+	if err := diffValues(base, mergeCursorFor(mpt2.GetNodeDB().GetNode, mpt2.GetRoot()), nil, diff2); err != nil {
+		return nil, err
+	}
+
+	var conflicts []MergeConflict
+	for p, v1 := range diff1 {
+		v2, ok := diff2[p]
+		if !ok || bytes.Equal(v1, v2) && (v1 == nil) == (v2 == nil) {
+			continue
+		}
+		conflicts = append(conflicts, MergeConflict{Path: Path(p), Value1: v1, Value2: v2})
+	}
+	if len(conflicts) > 0 {
+		sort.Slice(conflicts, func(i, j int) bool {
+			return bytes.Compare(conflicts[i].Path, conflicts[j].Path) < 0
+		})
+		return conflicts, ErrMergeConflict
+	}
+
+	// the values are written on a scratch trie and merged at once, the sibling of each path
+	// carries the nodes of the sub trie referenced by its value
+	siblings := make(map[string]*mergeSibling, len(diff1)+len(diff2))
+	s1, s2 := newMergeSibling(mpt1), newMergeSibling(mpt2)
+	for p := range diff1 {
+		siblings[p] = s1
+	}
+	for p, v := range diff2 {
+		diff1[p] = v
+		siblings[p] = s2
+	}
+	paths := make([]string, 0, len(diff1))
+	for p := range diff1 {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var (
+		scratch = mpt.scratchTrie(mpt.root)
+		changes []indexChange
+	)
+	for _, p := range paths {
+		path, value := Path(p), diff1[p]
+		old, err := scratch.valueAt(path)
+		if err != nil {
+			return nil, err
+		}
+		if changes, err = scratch.addIndexChange(changes, path, old, value); err != nil {
+			return nil, err
+		}
+		if err := scratch.mergeSiblingValue(siblings[p], path, old, value); err != nil {
+			return nil, fmt.Errorf("merge path %s: %w", p, err)
+		}
+	}
+	if _, err := scratch.updateIndexChanges(changes); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(scratch.root, mpt.root) {
+		return nil, nil
+	}
+
+	written := make([]Path, 0, len(scratch.dirtyPaths))
+	for p := range scratch.dirtyPaths {
+		written = append(written, Path(p))
+	}
+	cc := scratch.ChangeCollector
+	before := mpt.startAccounting(written...)
+	err := mpt.mergeChanges(scratch.root, cc.GetChanges(), cc.GetDeletes(), mpt.root)
+	mpt.finishAccounting(before, err != nil, written...)
+	return nil, err
+}
+
+// mergeSibling - the nodes added and deleted by a sibling trie by key
+type mergeSibling struct {
+	news map[string]Node
+	dels map[string]Node
+}
+
+func newMergeSibling(m MerklePatriciaTrieI) *mergeSibling {
+	_, changes, deletes, _ := m.GetChanges()
+	ms := &mergeSibling{news: make(map[string]Node, len(changes)), dels: make(map[string]Node, len(deletes))}
+	for _, c := range changes {
+		ms.news[string(c.New.GetHashBytes())] = c.New
+	}
+	for _, d := range deletes {
+		ms.dels[string(d.GetHashBytes())] = d
+	}
+	return ms
+}
+
+// setNodes - the nodes of the set reachable from the key through nodes of the set, children first
+func setNodes(set map[string]Node, key Key, nodes []Node) []Node {
+	node, ok := set[string(key)]
+	if !ok {
+		return nodes
+	}
+	for _, ckey := range nodeRefs(node) {
+		nodes = setNodes(set, ckey, nodes)
+	}
+	return append(nodes, node)
+}
+
+// mergeSiblingValue - unsafe, write the value merged from the sibling at the path. The new nodes of the sub
+// trie referenced by the value are carried over from the sibling, and the nodes of the sub trie referenced by
+// the old value the sibling deleted are recorded as deleted. Other values are written by insertValue and
+// deleteValue, releasing the sub trie referenced by the old value.
+func (mpt *MerklePatriciaTrie) mergeSiblingValue(sibling *mergeSibling, path Path, old, value []byte) error {
+	nref, ok := decodeSubTrieRef(value)
+	if !ok {
+		var err error
+		if value == nil {
+			_, err = mpt.deleteValue(path)
+		} else {
+			_, err = mpt.insertValue(path, value)
+		}
+		return err
+	}
+	for _, node := range setNodes(sibling.news, nref.Root, nil) {
+		node = node.CloneNode()
+		if err := mpt.db.PutNode(node.GetHashBytes(), node); err != nil {
+			return err
+		}
+		mpt.ChangeCollector.AddChange(nil, node)
+	}
+	if oref, ok := decodeSubTrieRef(old); ok && len(oref.Root) > 0 && !bytes.Equal(oref.Root, nref.Root) {
+		for _, node := range setNodes(sibling.dels, oref.Root, nil) {
+			mpt.ChangeCollector.DeleteChange(node)
+		}
+	}
+	_, err := mpt.putValue(path, value)
+	return err
+}
+
+// mergeCursor - a position in a trie at a nibble granularity, skip nibbles of the
+// leaf or extension node path are already consumed
+type mergeCursor struct {
+	getNode func(Key) (Node, error)
+	key     Key
+	node    Node
+	skip    int
+}
+
+func mergeCursorFor(getNode func(Key) (Node, error), root Key) *mergeCursor {
+	if root == nil {
+		return nil
+	}
+	return &mergeCursor{getNode: getNode, key: root}
+}
+
+func (c *mergeCursor) same(o *mergeCursor) bool {
+	if c == nil || o == nil {
+		return c == o
+	}
+	return c.skip == o.skip && bytes.Equal(c.key, o.key)
+}
+
+// expand - the value at the cursor position, nil if none, and the cursors of the children by path element
+func (c *mergeCursor) expand() ([]byte, map[byte]*mergeCursor, error) {
+	if c == nil {
+		return nil, nil, nil
+	}
+	if c.node == nil {
+		node, err := c.getNode(c.key)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.node = node
+	}
+
+	switch nodeImpl := c.node.(type) {
+	case *FullNode:
+		var value []byte
+		if nodeImpl.HasValue() {
+			value = nodeImpl.GetValueBytes()
+		}
+		children := make(map[byte]*mergeCursor)
+		for _, pe := range PathElements {
+			if ckey := nodeImpl.GetChild(pe); ckey != nil {
+				children[pe] = &mergeCursor{getNode: c.getNode, key: ckey}
+			}
+		}
+		return value, children, nil
+	case *LeafNode:
+		rest := nodeImpl.Path[c.skip:]
+		if len(rest) == 0 {
+			return nodeImpl.GetValueBytes(), nil, nil
+		}
+		return nil, map[byte]*mergeCursor{
+			rest[0]: {getNode: c.getNode, key: c.key, node: c.node, skip: c.skip + 1},
+		}, nil
+	case *ExtensionNode:
+		rest := nodeImpl.Path[c.skip:]
+		if len(rest) == 1 {
+			return nil, map[byte]*mergeCursor{
+				rest[0]: {getNode: c.getNode, key: nodeImpl.NodeKey},
+			}, nil
+		}
+		return nil, map[byte]*mergeCursor{
+			rest[0]: {getNode: c.getNode, key: c.key, node: c.node, skip: c.skip + 1},
+		}, nil
+	default:
+		panic(fmt.Sprintf("unknown node type: %T %v", c.node, c.node))
+	}
+}
+
+// diffValues - collect the values of other that differ from base by path, nil for the deleted values.
+// The subtrees shared by both tries are skipped.
+func diffValues(base, other *mergeCursor, path Path, out map[string][]byte) error {
+	return walkValueDiff(base, other, path, func(path Path, _, value []byte) error {
+		out[string(path)] = value
+		return nil
+	})
+}
+
+// walkValueDiff - call the handler with the old and new value of the paths whose value differs
+// between base and other in path order, nil for a missing value. The subtrees shared by both tries are skipped.
+func walkValueDiff(base, other *mergeCursor, path Path, handler func(path Path, old, value []byte) error) error {
+	if base.same(other) {
+		return nil
+	}
+	bv, bchildren, err := base.expand()
+	if err != nil {
+		return err
+	}
+	ov, ochildren, err := other.expand()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(bv, ov) || (bv == nil) != (ov == nil) {
+		if err := handler(path, bv, ov); err != nil {
+			return err
+		}
+	}
+	for _, pe := range PathElements {
+		bc, oc := bchildren[pe], ochildren[pe]
+		if bc == nil && oc == nil {
+			continue
+		}
+		if err := walkValueDiff(bc, oc, concat(path, pe), handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func newMergeTestTries(t *testing.T) (*MerklePatriciaTrie, func() *MerklePatriciaTrie) {
+	db := NewMemoryNodeDB()
+	base := NewMerklePatriciaTrie(db, Sequence(0), nil, statecache.NewEmpty())
+	for i := 0; i < 100; i++ {
+		_, err := base.Insert(flatTestPath(i), &Txn{fmt.Sprintf("%d", i)})
+		require.NoError(t, err)
+	}
+	root := base.GetRoot()
+	sibling := func() *MerklePatriciaTrie {
+		return NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), db, false), Sequence(1), root, statecache.NewEmpty())
+	}
+	return NewMerklePatriciaTrie(db, Sequence(1), root, statecache.NewEmpty()), sibling
+}
+
+func TestMerklePatriciaTrie_MergeSiblings(t *testing.T) {
+	mpt, sibling := newMergeTestTries(t)
+	mpt1, mpt2, serial := sibling(), sibling(), sibling()
+
+	for _, m := range []*MerklePatriciaTrie{mpt1, serial} {
+		for i := 0; i < 10; i++ {
+			_, err := m.Insert(flatTestPath(i), &Txn{"updated by 1"})
+			require.NoError(t, err)
+		}
+		_, err := m.Insert(flatTestPath(200), &Txn{"new by 1"})
+		require.NoError(t, err)
+		_, err = m.Delete(flatTestPath(50))
+		require.NoError(t, err)
+		// the same write on both sides is not a conflict
+		_, err = m.Insert(flatTestPath(99), &Txn{"same"})
+		require.NoError(t, err)
+	}
+	for _, m := range []*MerklePatriciaTrie{mpt2, serial} {
+		for i := 10; i < 20; i++ {
+			_, err := m.Insert(flatTestPath(i), &Txn{"updated by 2"})
+			require.NoError(t, err)
+		}
+		_, err := m.Delete(flatTestPath(60))
+		require.NoError(t, err)
+		_, err = m.Insert(flatTestPath(99), &Txn{"same"})
+		require.NoError(t, err)
+		// values on full nodes
+		_, err = m.Insert(flatTestPath(70)[:4], &Txn{"short"})
+		require.NoError(t, err)
+	}
+
+	conflicts, err := mpt.MergeSiblings(mpt1, mpt2)
+	require.NoError(t, err)
+	require.Empty(t, conflicts)
+	require.Equal(t, serial.GetRoot(), mpt.GetRoot())
+	require.NoError(t, mpt.Validate())
+}
+
+func TestMerklePatriciaTrie_MergeSiblingsConflict(t *testing.T) {
+	mpt, sibling := newMergeTestTries(t)
+	mpt1, mpt2 := sibling(), sibling()
+	root := mpt.GetRoot()
+
+	_, err := mpt1.Insert(flatTestPath(1), &Txn{"a"})
+	require.NoError(t, err)
+	_, err = mpt1.Insert(flatTestPath(3), &Txn{"c"})
+	require.NoError(t, err)
+	_, err = mpt2.Insert(flatTestPath(1), &Txn{"b"})
+	require.NoError(t, err)
+	_, err = mpt2.Delete(flatTestPath(2))
+	require.NoError(t, err)
+	_, err = mpt1.Insert(flatTestPath(2), &Txn{"a"})
+	require.NoError(t, err)
+
+	conflicts, err := mpt.MergeSiblings(mpt1, mpt2)
+	require.Equal(t, ErrMergeConflict, err)
+	require.Len(t, conflicts, 2)
+	for _, c := range conflicts {
+		v1, err := (&Txn{"a"}).MarshalMsg(nil)
+		require.NoError(t, err)
+		require.Equal(t, v1, c.Value1)
+		switch string(c.Path) {
+		case string(flatTestPath(1)):
+			v2, err := (&Txn{"b"}).MarshalMsg(nil)
+			require.NoError(t, err)
+			require.Equal(t, v2, c.Value2)
+		case string(flatTestPath(2)):
+			require.Nil(t, c.Value2)
+		default:
+			t.Fatalf("unexpected conflict path: %s", c.Path)
+		}
+	}
+	// the trie is unchanged
+	require.Equal(t, root, mpt.GetRoot())
+
+	// siblings of a different parent
+	other := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	_, err = mpt.MergeSiblings(mpt1, other)
+	require.Equal(t, ErrMergeBaseMismatch, err)
+}
+
+func TestMerklePatriciaTrie_MergeSiblingsSubTries(t *testing.T) {
+	db := NewMemoryNodeDB()
+	base, accounts, storage := newSubTrieTestMPT(t, NewMemoryNodeDB())
+	require.NoError(t, base.SaveChanges(context.Background(), db, false))
+	root := base.GetRoot()
+	sibling := func() *MerklePatriciaTrie {
+		return NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), db, false), Sequence(2), root, statecache.NewEmpty())
+	}
+	mpt1, mpt2, serial := sibling(), sibling(), sibling()
+
+	// the first sibling updates a sub trie, the second replaces one with a plain value
+	for _, m := range []*MerklePatriciaTrie{mpt1, serial} {
+		sub, err := m.OpenSubTrie(accounts[0])
+		require.NoError(t, err)
+		_, err = sub.Insert(storage[0], &Txn{"updated"})
+		require.NoError(t, err)
+		_, err = m.InsertSubTrie(accounts[0], sub, []byte("updated"))
+		require.NoError(t, err)
+	}
+	for _, m := range []*MerklePatriciaTrie{mpt2, serial} {
+		_, err := m.Insert(accounts[1], &Txn{"plain"})
+		require.NoError(t, err)
+	}
+
+	// a veto leaves the trie unchanged
+	mpt := NewMerklePatriciaTrie(db, Sequence(2), root, statecache.NewEmpty())
+	veto := errors.New("veto")
+	mpt.AddObserver(func(m Mutation) error { return veto })
+	_, err := mpt.MergeSiblings(mpt1, mpt2)
+	require.ErrorIs(t, err, veto)
+	require.Equal(t, root, mpt.GetRoot())
+	_, changes, _, _ := mpt.GetChanges()
+	require.Empty(t, changes)
+
+	mpt = NewMerklePatriciaTrie(db, Sequence(2), root, statecache.NewEmpty())
+	replaced := subTrieNodeKeys(t, mpt, accounts[1])
+	for _, d := range mpt1.GetDeletes() {
+		replaced[string(d.GetHashBytes())] = true
+	}
+	conflicts, err := mpt.MergeSiblings(mpt1, mpt2)
+	require.NoError(t, err)
+	require.Empty(t, conflicts)
+	require.Equal(t, serial.GetRoot(), mpt.GetRoot())
+
+	// the nodes of the replaced sub tries are dead
+	for _, d := range mpt.GetDeletes() {
+		delete(replaced, string(d.GetHashBytes()))
+	}
+	require.Empty(t, replaced)
+
+	// the nodes of the updated sub trie are carried over from the sibling
+	require.NoError(t, mpt.SaveChanges(context.Background(), db, false))
+	merged := NewMerklePatriciaTrie(db, Sequence(2), mpt.GetRoot(), statecache.NewEmpty())
+	sub, err := merged.OpenSubTrie(accounts[0])
+	require.NoError(t, err)
+	require.NoError(t, sub.Validate())
+	v, err := sub.GetNodeValueRaw(storage[0])
+	require.NoError(t, err)
+	updated, err := (&Txn{"updated"}).MarshalMsg(nil)
+	require.NoError(t, err)
+	require.Equal(t, updated, v)
+	for _, p := range storage[1:] {
+		_, err := sub.GetNodeValueRaw(p)
+		require.NoError(t, err)
+	}
+}
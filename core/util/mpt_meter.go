@@ -0,0 +1,84 @@
+package util
+
+import "sync/atomic"
+
+// AccessMeter - counts the work done by the trie operations, such as to charge gas in proportion
+// to it. A meter can be attached to the trie of a transaction and shared by the tries it opens.
+type AccessMeter struct {
+	nodeReads   int64
+	cacheHits   int64
+	nodeWrites  int64
+	bytesHashed int64
+}
+
+// AccessCounts - the counts of a meter
+type AccessCounts struct {
+	NodeReads   int64 // the nodes read from the node db
+	CacheHits   int64 // the nodes read from the cache
+	NodeWrites  int64 // the nodes written
+	BytesHashed int64 // the bytes hashed for the nodes written, their origin and encoding
+}
+
+// Sub - the counts since the earlier counts, such as of a single operation
+func (ac AccessCounts) Sub(earlier AccessCounts) AccessCounts {
+	return AccessCounts{
+		NodeReads:   ac.NodeReads - earlier.NodeReads,
+		CacheHits:   ac.CacheHits - earlier.CacheHits,
+		NodeWrites:  ac.NodeWrites - earlier.NodeWrites,
+		BytesHashed: ac.BytesHashed - earlier.BytesHashed,
+	}
+}
+
+// Counts - the counts of the meter so far
+func (am *AccessMeter) Counts() AccessCounts {
+	return AccessCounts{
+		NodeReads:   atomic.LoadInt64(&am.nodeReads),
+		CacheHits:   atomic.LoadInt64(&am.cacheHits),
+		NodeWrites:  atomic.LoadInt64(&am.nodeWrites),
+		BytesHashed: atomic.LoadInt64(&am.bytesHashed),
+	}
+}
+
+// Reset - clear the counts, returning the counts before
+func (am *AccessMeter) Reset() AccessCounts {
+	return AccessCounts{
+		NodeReads:   atomic.SwapInt64(&am.nodeReads, 0),
+		CacheHits:   atomic.SwapInt64(&am.cacheHits, 0),
+		NodeWrites:  atomic.SwapInt64(&am.nodeWrites, 0),
+		BytesHashed: atomic.SwapInt64(&am.bytesHashed, 0),
+	}
+}
+
+func (am *AccessMeter) read(cached bool) {
+	if am == nil {
+		return
+	}
+	if cached {
+		atomic.AddInt64(&am.cacheHits, 1)
+		return
+	}
+	atomic.AddInt64(&am.nodeReads, 1)
+}
+
+func (am *AccessMeter) write(hashed int) {
+	if am == nil {
+		return
+	}
+	atomic.AddInt64(&am.nodeWrites, 1)
+	atomic.AddInt64(&am.bytesHashed, int64(hashed))
+}
+
+// SetAccessMeter - count the node reads and writes of the trie with the meter, nil to stop counting.
+// The sub tries opened after are counted with the same meter.
+func (mpt *MerklePatriciaTrie) SetAccessMeter(am *AccessMeter) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	mpt.meter = am
+}
+
+// GetAccessMeter - the meter of the trie, nil if not counted
+func (mpt *MerklePatriciaTrie) GetAccessMeter() *AccessMeter {
+	mpt.mutex.RLock()
+	defer mpt.mutex.RUnlock()
+	return mpt.meter
+}
@@ -0,0 +1,88 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func TestMerklePatriciaTrie_AccessMeter(t *testing.T) {
+	ndb := NewMemoryNodeDB()
+	mpt := NewMerklePatriciaTrie(ndb, Sequence(1), nil, statecache.NewEmpty())
+	for i := 0; i < 100; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+	// a path with siblings branching off at every element
+	deep := flatTestPath(1000)
+	for k := 4; k < 12; k++ {
+		sibling := concat(Path(nil), deep...)
+		sibling[k] = PathElements[(bytes.IndexByte(PathElements, deep[k])+1)%len(PathElements)]
+		_, err := mpt.Insert(sibling, &Txn{"sibling"})
+		require.NoError(t, err)
+	}
+	_, err := mpt.Insert(deep, &Txn{"deep"})
+	require.NoError(t, err)
+	require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+
+	am := &AccessMeter{}
+	mpt = NewMerklePatriciaTrie(ndb, Sequence(2), mpt.GetRoot(), statecache.NewEmpty())
+	mpt.SetAccessMeter(am)
+	require.Equal(t, am, mpt.GetAccessMeter())
+
+	// read from the db, then from the cache
+	var v Txn
+	require.NoError(t, mpt.GetNodeValue(flatTestPath(1), &v))
+	first := am.Counts()
+	require.NotZero(t, first.NodeReads)
+	require.Zero(t, first.CacheHits)
+	require.NoError(t, mpt.GetNodeValue(flatTestPath(1), &v))
+	second := am.Counts().Sub(first)
+	require.Zero(t, second.NodeReads)
+	require.Equal(t, first.NodeReads, second.CacheHits)
+
+	// the deeper path costs more
+	before := am.Counts()
+	require.NoError(t, mpt.GetNodeValue(deep, &v))
+	deepRead := am.Counts().Sub(before)
+	require.Greater(t, deepRead.NodeReads+deepRead.CacheHits, second.CacheHits)
+
+	// the written nodes are counted with the size of their hashed encoding
+	before = am.Counts()
+	_, err = mpt.Insert(flatTestPath(2), &Txn{"updated"})
+	require.NoError(t, err)
+	write := am.Counts().Sub(before)
+	require.NotZero(t, write.NodeWrites)
+	var size int64
+	_, changes, _, _ := mpt.GetChanges()
+	for _, c := range changes {
+		hash, hashed := nodeHashLen(c.New)
+		require.Equal(t, c.New.GetHashBytes(), []byte(hash))
+		size += int64(hashed)
+	}
+	require.Equal(t, int64(len(changes)), write.NodeWrites)
+	require.Equal(t, size, write.BytesHashed)
+
+	// not counted once detached
+	require.Equal(t, before.NodeWrites+write.NodeWrites, am.Reset().NodeWrites)
+	mpt.SetAccessMeter(nil)
+	_, err = mpt.Insert(flatTestPath(3), &Txn{"updated"})
+	require.NoError(t, err)
+	require.Equal(t, AccessCounts{}, am.Counts())
+}
+
+func TestMerklePatriciaTrie_AccessMeterSubTrie(t *testing.T) {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	am := &AccessMeter{}
+	mpt.SetAccessMeter(am)
+	sub, err := mpt.OpenSubTrie(Path("0a"))
+	require.NoError(t, err)
+	_, err = sub.Insert(Path("01"), &Txn{"value"})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), am.Counts().NodeWrites)
+}
@@ -0,0 +1,127 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+// ErrMigrateConflict - the migration writes more than one value to the same path
+var ErrMigrateConflict = errors.New("migrate conflict")
+
+// MigrateFunc - called with each value under the migrated prefix, returns the path and value
+// to write instead. Returning the same path rewrites the value, another path moves it and a nil
+// value deletes it.
+type MigrateFunc func(path Path, value []byte) (Path, []byte, error)
+
+// MigratePrefix - rewrite, move or delete all the values with paths starting with the prefix.
+// All the values are read before any change, so fn always sees the values of the current root.
+// The changes are applied as a single set of changes on top of the current root, the moved values
+// replace the values at their new paths. The trie is left unchanged if fn fails or two values are
+// written to the same path. Observers see the changes as merged changes.
+func (mpt *MerklePatriciaTrie) MigratePrefix(prefix Path, fn MigrateFunc) (Key, error) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+
+	entries, err := mpt.prefixValues(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		dels []Path
+		puts = make(map[string][]byte)
+	)
+	for _, e := range entries {
+		np, nv, err := fn(e.path, e.value)
+		if err != nil {
+			return nil, err
+		}
+		moved := !bytes.Equal(np, e.path)
+		if moved || len(nv) == 0 {
+			dels = append(dels, e.path)
+		}
+		if len(nv) == 0 || !moved && bytes.Equal(nv, e.value) {
+			continue
+		}
+		if _, ok := puts[string(np)]; ok {
+			return nil, ErrMigrateConflict
+		}
+		puts[string(np)] = nv
+	}
+	if len(dels) == 0 && len(puts) == 0 {
+		return mpt.root, nil
+	}
+
+	// the changes are made on a scratch trie over the db of the trie and merged at once
+	scratch := mpt.scratchTrie(mpt.root)
+	for _, p := range dels {
+		if _, err := scratch.Delete(p); err != nil {
+			return nil, err
+		}
+	}
+	paths := make([]string, 0, len(puts))
+	for p := range puts {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if _, err := scratch.Insert(Path(p), &SecureSerializableValue{puts[p]}); err != nil {
+			return nil, err
+		}
+	}
+
+	if bytes.Equal(scratch.root, mpt.root) {
+		return mpt.root, nil
+	}
+	cc := scratch.ChangeCollector
+	if err := mpt.mergeChanges(scratch.root, cc.GetChanges(), cc.GetDeletes(), mpt.root); err != nil {
+		return nil, err
+	}
+	return mpt.root, nil
+}
+
+// scratchTrie - unsafe, a trie at the root over the db of the trie, its changes are kept apart
+// from the db until merged into the trie
+func (mpt *MerklePatriciaTrie) scratchTrie(root Key) *MerklePatriciaTrie {
+	return &MerklePatriciaTrie{
+		mutex:           &sync.RWMutex{},
+		root:            root,
+		db:              NewLevelNodeDB(NewMemoryNodeDB(), mpt.db, false),
+		ChangeCollector: NewChangeCollector(root),
+		Version:         mpt.Version,
+		cache:           statecache.NewEmpty(),
+		countMode:       mpt.countMode,
+		subPrefix:       mpt.subPrefix,
+		indexes:         mpt.indexes,
+		meter:           mpt.meter,
+	}
+}
+
+type pathValue struct {
+	path  Path
+	value []byte
+}
+
+// prefixValues - unsafe, copies of the values with paths starting with the prefix in path order
+func (mpt *MerklePatriciaTrie) prefixValues(prefix Path) ([]pathValue, error) {
+	node, path, err := mpt.findPrefixNode(prefix)
+	if err != nil || node == nil {
+		return nil, err
+	}
+	var (
+		values []pathValue
+		skip   uint64
+		limit  uint64 = math.MaxUint64
+	)
+	err = mpt.iteratePage(context.TODO(), path, node, &skip, &limit, func(_ context.Context, path Path, _ Key, node Node) error {
+		values = append(values, pathValue{path: concat(path), value: concat(node.(*ValueNode).GetValueBytes())})
+		return nil
+	})
+	return values, err
+}
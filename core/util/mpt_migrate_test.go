@@ -0,0 +1,127 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func trieValues(t *testing.T, mpt MerklePatriciaTrieI) map[string]string {
+	values := make(map[string]string)
+	err := mpt.Iterate(context.TODO(), func(ctx context.Context, path Path, key Key, node Node) error {
+		values[string(path)] = string(node.(*ValueNode).GetValueBytes())
+		return nil
+	}, NodeTypeValueNode)
+	require.NoError(t, err)
+	return values
+}
+
+func TestMerklePatriciaTrie_MigratePrefix(t *testing.T) {
+	ndb := NewMemoryNodeDB()
+	mpt := NewMerklePatriciaTrie(ndb, Sequence(1), nil, statecache.NewEmpty())
+	for i := 0; i < 20; i++ {
+		_, err := mpt.Insert(Path(fmt.Sprintf("0a%02d", i)), &Txn{fmt.Sprintf("v%d", i)})
+		require.NoError(t, err)
+	}
+	_, err := mpt.Insert(Path("1b00"), &Txn{"other"})
+	require.NoError(t, err)
+	require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+
+	mpt = NewMerklePatriciaTrie(ndb, Sequence(2), mpt.GetRoot(), statecache.NewEmpty())
+	var visited int
+	root, err := mpt.MigratePrefix(Path("0a"), func(path Path, value []byte) (Path, []byte, error) {
+		visited++
+		var v Txn
+		if _, err := v.UnmarshalMsg(value); err != nil {
+			return nil, nil, err
+		}
+		i := strings.TrimPrefix(string(path), "0a")
+		switch {
+		case i < "05":
+			// deleted
+			return path, nil, nil
+		case i < "10":
+			// moved
+			return Path("0c" + i), value, nil
+		case i == "10":
+			// kept as is
+			return path, value, nil
+		}
+		nv, err := (&Txn{v.Data + "_migrated"}).MarshalMsg(nil)
+		return path, nv, err
+	})
+	require.NoError(t, err)
+	require.Equal(t, 20, visited)
+	require.Equal(t, root, mpt.GetRoot())
+
+	// the same values as writing them one by one
+	expected := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(2), nil, statecache.NewEmpty())
+	for i := 0; i < 20; i++ {
+		var (
+			path  = Path(fmt.Sprintf("0a%02d", i))
+			value = fmt.Sprintf("v%d", i)
+		)
+		switch {
+		case i < 5:
+			continue
+		case i < 10:
+			path = Path(fmt.Sprintf("0c%02d", i))
+		case i > 10:
+			value += "_migrated"
+		}
+		_, err := expected.Insert(path, &Txn{value})
+		require.NoError(t, err)
+	}
+	_, err = expected.Insert(Path("1b00"), &Txn{"other"})
+	require.NoError(t, err)
+	require.Equal(t, trieValues(t, expected), trieValues(t, mpt))
+
+	// the changes are saved as one set of changes
+	require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+	saved := NewMerklePatriciaTrie(ndb, Sequence(2), root, statecache.NewEmpty())
+	var v Txn
+	require.NoError(t, saved.GetNodeValue(Path("0c07"), &v))
+	require.Equal(t, "v7", v.Data)
+	require.NoError(t, saved.GetNodeValue(Path("0a15"), &v))
+	require.Equal(t, "v15_migrated", v.Data)
+	require.Equal(t, ErrValueNotPresent, saved.GetNodeValue(Path("0a03"), &v))
+	require.Equal(t, ErrValueNotPresent, saved.GetNodeValue(Path("0a07"), &v))
+}
+
+func TestMerklePatriciaTrie_MigratePrefixUnchanged(t *testing.T) {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	for i := 0; i < 5; i++ {
+		_, err := mpt.Insert(Path(fmt.Sprintf("0a%02d", i)), &Txn{fmt.Sprintf("v%d", i)})
+		require.NoError(t, err)
+	}
+	root := mpt.GetRoot()
+	changes := mpt.GetChangeCount()
+
+	errFailed := errors.New("failed")
+	_, err := mpt.MigratePrefix(Path("0a"), func(path Path, value []byte) (Path, []byte, error) {
+		if string(path) == "0a03" {
+			return nil, nil, errFailed
+		}
+		return path, nil, nil
+	})
+	require.Equal(t, errFailed, err)
+
+	_, err = mpt.MigratePrefix(Path("0a"), func(path Path, value []byte) (Path, []byte, error) {
+		return Path("0b"), value, nil
+	})
+	require.Equal(t, ErrMigrateConflict, err)
+
+	got, err := mpt.MigratePrefix(Path("0f"), func(path Path, value []byte) (Path, []byte, error) {
+		return path, nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, root, got)
+	require.Equal(t, root, mpt.GetRoot())
+	require.Equal(t, changes, mpt.GetChangeCount())
+}
@@ -7,7 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"sync"
 
 	"github.com/0chain/common/core/encryption"
 	"github.com/0chain/common/core/logging"
@@ -21,6 +21,9 @@ const (
 	NodeTypeFullNode      = 4
 	NodeTypeExtensionNode = 8
 	NodeTypesAll          = NodeTypeValueNode | NodeTypeLeafNode | NodeTypeFullNode | NodeTypeExtensionNode
+
+	// NodeCountsFlag - set on the serialization prefix of the nodes carrying leaf counts
+	NodeCountsFlag = 16
 )
 
 // Separator - used to separate fields when creating data array to hash
@@ -108,6 +111,10 @@ func (otn *OriginTrackerNode) GetOriginTracker() OriginTrackerI {
 type ValueNode struct {
 	Value              MPTSerializable `json:"v"`
 	*OriginTrackerNode `json:"o,omitempty"`
+
+	// decoded - the value of a decoded node, Value points to it. It wraps the encoded bytes
+	// without copying them, they are only unmarshalled by the reader of the value.
+	decoded SecureSerializableValue
 }
 
 // NewValueNode - create a new value node
@@ -127,20 +134,44 @@ func (vn *ValueNode) CloneNode() Node {
 	return clone
 }
 
+// Clone - implement statecache.Value interface, the value is decoupled from the
+// value object the node was created with
 func (vn *ValueNode) Clone() statecache.Value {
-	vv := vn.Encode()
-	if len(vv) == 0 {
-		panic("clone ValueNode encode failed")
+	clone := NewValueNode()
+	clone.OriginTrackerNode = vn.OriginTrackerNode.Clone()
+	if vn.Value != nil {
+		clone.setDecoded(vn.frozenValue())
 	}
+	return clone
+}
 
-	clone, err := CreateNode(bytes.NewBuffer(vv))
-	if err != nil {
-		panic(fmt.Errorf("clone ValueNode decode failed: %v", err))
+// cloneValueNode - the value of a leaf or full node clone, the origin of the value is not kept
+func cloneValueNode(vn *ValueNode, freeze bool) *ValueNode {
+	clone := NewValueNode()
+	if vn == nil || vn.Value == nil {
+		return clone
+	}
+	if !freeze {
+		clone.SetValue(vn.GetValue())
+	} else if v := vn.frozenValue(); len(v) > 0 {
+		clone.setDecoded(v)
 	}
-
 	return clone
 }
 
+func (vn *ValueNode) setDecoded(buf []byte) {
+	vn.decoded.Buffer = buf
+	vn.Value = &vn.decoded
+}
+
+// frozenValue - the value bytes, the bytes of a decoded value are never updated in place and are shared
+func (vn *ValueNode) frozenValue() []byte {
+	if vn.Value == &vn.decoded {
+		return vn.decoded.Buffer
+	}
+	return vn.GetValueBytes()
+}
+
 func (vn *ValueNode) CopyFrom(v interface{}) bool {
 	vv, ok := v.(*ValueNode)
 	if !ok {
@@ -165,7 +196,7 @@ func (vn *ValueNode) GetHash() string {
 
 /*GetHashBytes - implement SecureSerializableValue interface */
 func (vn *ValueNode) GetHashBytes() []byte {
-	v := vn.GetValueBytes()
+	v := vn.valueBytes()
 	if len(v) == 0 {
 		return nil
 	}
@@ -192,6 +223,14 @@ func (vn *ValueNode) GetValueBytes() []byte {
 	return v
 }
 
+// valueBytes - the value bytes to encode or hash, not copied for a decoded value so they must not be modified
+func (vn *ValueNode) valueBytes() []byte {
+	if vn.Value == &vn.decoded {
+		return vn.decoded.Buffer
+	}
+	return vn.GetValueBytes()
+}
+
 /*SetValue - set the value stored in this node */
 func (vn *ValueNode) SetValue(value MPTSerializable) {
 	vn.Value = value
@@ -207,21 +246,16 @@ func (vn *ValueNode) Encode() []byte {
 		return nil
 	}
 
-	v := vn.GetValueBytes()
+	v := vn.valueBytes()
 	if len(v) > 0 {
 		buf.Write(v)
 	}
 	return buf.Bytes()
 }
 
-/*Decode - overwrite interface method */
+/*Decode - overwrite interface method, the value keeps the buffer which must not be modified afterwards */
 func (vn *ValueNode) Decode(buf []byte) error {
-	pspv := &SecureSerializableValue{}
-	_, err := pspv.UnmarshalMsg(buf)
-	if err != nil {
-		return err
-	}
-	vn.SetValue(pspv)
+	vn.setDecoded(buf[:len(buf):len(buf)])
 	return nil
 }
 
@@ -251,14 +285,7 @@ func (ln *LeafNode) GetHash() string {
 
 /*GetHashBytes - implement interface */
 func (ln *LeafNode) GetHashBytes() []byte {
-	buf := bytes.NewBuffer(nil)
-	if err := binary.Write(buf, binary.LittleEndian, ln.GetOrigin()); err != nil {
-		// TODO: return error
-		logging.Logger.Error("leaf node GetHashBytes failed", zap.Error(err))
-		return nil
-	}
-	ln.encode(buf)
-	return encryption.RawHash(buf.Bytes())
+	return hashNode(ln.GetOrigin(), ln.encode)
 }
 
 /*Encode - implement interface */
@@ -283,25 +310,23 @@ func (ln *LeafNode) encode(buf *bytes.Buffer) {
 	}
 	buf.WriteByte(Separator)
 	if ln.HasValue() {
-		v, err := ln.GetValue().MarshalMsg(nil)
-		if err != nil {
-			panic(err)
-		}
-
-		buf.Write(v)
+		buf.Write(ln.Value.valueBytes())
 	}
 }
 
-/*Decode - implement interface */
+/*Decode - implement interface, the node keeps sub slices of the buffer which must not be modified afterwards */
 func (ln *LeafNode) Decode(buf []byte) error {
 	idx := bytes.IndexByte(buf, Separator)
 	if idx < 0 {
 		return ErrInvalidEncoding
 	}
-	ln.Prefix = buf[:idx]
+	ln.Prefix = buf[:idx:idx]
 	buf = buf[idx+1:]
 	idx = bytes.IndexByte(buf, Separator)
-	ln.Path = buf[:idx]
+	if idx < 0 {
+		return ErrInvalidEncoding
+	}
+	ln.Path = buf[:idx:idx]
 	buf = buf[idx+1:]
 	if len(buf) == 0 {
 		ln.SetValue(nil)
@@ -322,21 +347,18 @@ func (ln *LeafNode) CloneNode() Node {
 	clone.Prefix = concat(ln.Prefix)
 	clone.Path = concat(ln.Path)
 	// path will never be updated inplace and so ok
-	clone.SetValue(ln.GetValue())
+	clone.Value = cloneValueNode(ln.Value, false)
 	return clone
 }
 
+// Clone - implement statecache.Value interface, the value is decoupled from the
+// value object the node was created with
 func (ln *LeafNode) Clone() statecache.Value {
-	vv := ln.Encode()
-	if len(vv) == 0 {
-		panic("clone LeafNode encode failed")
-	}
-
-	clone, err := CreateNode(bytes.NewBuffer(vv))
-	if err != nil {
-		panic(fmt.Errorf("clone LeafNode create node failed: %v", err))
-	}
-
+	clone := &LeafNode{}
+	clone.OriginTrackerNode = ln.OriginTrackerNode.Clone()
+	clone.Prefix = ln.Prefix // path will never be updated inplace and so ok
+	clone.Path = ln.Path
+	clone.Value = cloneValueNode(ln.Value, true)
 	return clone
 }
 
@@ -390,6 +412,7 @@ func (ln *LeafNode) GetValueBytes() []byte {
 type FullNode struct {
 	Children           [16][]byte `json:"c"`
 	Value              *ValueNode `json:"v,omitempty"` // This may not be needed as our path is fixed in size
+	ChildCounts        []uint64   `json:"n,omitempty"` // leaf counts of the children, only kept in count mode
 	*OriginTrackerNode `json:"o,omitempty"`
 }
 
@@ -408,14 +431,7 @@ func (fn *FullNode) GetHash() string {
 
 /*GetHashBytes - implement interface */
 func (fn *FullNode) GetHashBytes() []byte {
-	buf := bytes.NewBuffer(nil)
-	if err := binary.Write(buf, binary.LittleEndian, fn.GetOrigin()); err != nil {
-		// TODO: return error
-		logging.Logger.Error("full node GetHashBytes failed", zap.Error(err))
-		return nil
-	}
-	fn.encode(buf)
-	return encryption.RawHash(buf.Bytes())
+	return hashNode(fn.GetOrigin(), fn.encode)
 }
 
 /*Encode - implement interface */
@@ -430,39 +446,53 @@ func (fn *FullNode) Encode() []byte {
 }
 
 func (fn *FullNode) encode(buf *bytes.Buffer) {
-	for i := byte(0); i < 16; i++ {
-		child := fn.GetChild(fn.indexToByte(i))
+	var hexKey [2 * 64]byte
+	for _, child := range fn.Children {
 		if child != nil {
-			buf.Write([]byte(ToHex(child)))
+			if len(child) <= 64 {
+				buf.Write(hexKey[:hex.Encode(hexKey[:], child)])
+			} else {
+				buf.WriteString(ToHex(child))
+			}
 		}
 		buf.WriteByte(Separator)
 	}
 	if fn.HasValue() {
-		v, err := fn.GetValue().MarshalMsg(nil)
-		if err != nil {
-			panic(err)
-		}
-		buf.Write(v)
+		buf.Write(fn.Value.valueBytes())
 	}
 }
 
-/*Decode - implement interface */
+/*Decode - implement interface, the value is kept as a sub slice of the buffer which must not be modified afterwards */
 func (fn *FullNode) Decode(buf []byte) error {
-	for i := byte(0); i < 16; i++ {
-		idx := bytes.IndexByte(buf, Separator)
+	var (
+		ends [16]int
+		rest = buf
+		size int
+	)
+	for i := range ends {
+		idx := bytes.IndexByte(rest, Separator)
 		if idx < 0 {
 			return ErrInvalidEncoding
 		}
-		if idx > 0 {
-			key := make([]byte, 32)
-			_, err := hex.Decode(key, buf[:idx])
+		ends[i] = len(buf) - len(rest) + idx
+		size += hex.DecodedLen(idx)
+		rest = rest[idx+1:]
+	}
+	// the children keys share a single allocation
+	keys := make([]byte, size)
+	start := 0
+	for i, end := range ends {
+		if end > start {
+			n, err := hex.Decode(keys, buf[start:end])
 			if err != nil {
 				return err
 			}
-			fn.PutChild(fn.indexToByte(i), key)
+			fn.Children[i] = keys[:n:n]
+			keys = keys[n:]
 		}
-		buf = buf[idx+1:]
+		start = end + 1
 	}
+	buf = rest
 	if len(buf) == 0 {
 		fn.SetValue(nil)
 	} else {
@@ -477,31 +507,26 @@ func (fn *FullNode) Decode(buf []byte) error {
 
 /*Clone - implement interface */
 func (fn *FullNode) CloneNode() Node {
-	clone := &FullNode{}
-	clone.OriginTrackerNode = fn.OriginTrackerNode.Clone()
-	for idx, ckey := range fn.Children {
-		if len(ckey) > 0 {
-			clone.Children[idx] = make([]byte, len(ckey))
-			copy(clone.Children[idx], ckey) // ckey will never be updated inplace and so ok
-		}
-	}
-	if fn.HasValue() {
-		clone.SetValue(fn.GetValue())
-	}
-	return clone
+	return fn.clone(false)
 }
 
+// Clone - implement statecache.Value interface, the value is decoupled from the
+// value object the node was created with
 func (fn *FullNode) Clone() statecache.Value {
-	vv := fn.Encode()
-	if len(vv) == 0 {
-		panic("clone FullNode encode failed")
-	}
+	return fn.clone(true)
+}
 
-	clone, err := CreateNode(bytes.NewBuffer(vv))
-	if err != nil {
-		panic(fmt.Errorf("clone FullNode decode failed: %v", err))
+func (fn *FullNode) clone(freeze bool) *FullNode {
+	clone := &FullNode{}
+	clone.OriginTrackerNode = fn.OriginTrackerNode.Clone()
+	// the children keys will never be updated inplace and so ok
+	clone.Children = fn.Children
+	if fn.HasValue() {
+		clone.Value = cloneValueNode(fn.Value, freeze)
+	}
+	if fn.ChildCounts != nil {
+		clone.ChildCounts = append([]uint64(nil), fn.ChildCounts...)
 	}
-
 	return clone
 }
 
@@ -594,8 +619,9 @@ func (fn *FullNode) SetValue(value MPTSerializable) {
 
 /*ExtensionNode - a multi-char length path along which there are no branches, at the end of this path there should be full node */
 type ExtensionNode struct {
-	Path               Path `json:"p"`
-	NodeKey            Key  `json:"k"`
+	Path               Path    `json:"p"`
+	NodeKey            Key     `json:"k"`
+	LeafCount          *uint64 `json:"n,omitempty"` // leaf count of the child, only kept in count mode
 	*OriginTrackerNode `json:"o,omitempty"`
 }
 
@@ -615,14 +641,7 @@ func (en *ExtensionNode) GetHash() string {
 
 /*GetHashBytes - implement interface */
 func (en *ExtensionNode) GetHashBytes() []byte {
-	buf := bytes.NewBuffer(nil)
-	if err := binary.Write(buf, binary.LittleEndian, en.GetOrigin()); err != nil {
-		// TODO: return error
-		logging.Logger.Error("full node GetHashBytes failed", zap.Error(err))
-		return nil
-	}
-	en.encode(buf)
-	return encryption.RawHash(buf.Bytes())
+	return hashNode(en.GetOrigin(), en.encode)
 }
 
 /*Encode - implement interface */
@@ -642,18 +661,14 @@ func (en *ExtensionNode) encode(buf *bytes.Buffer) {
 	buf.Write(en.NodeKey)
 }
 
-/*Decode - implement interface */
+/*Decode - implement interface, the node keeps sub slices of the buffer which must not be modified afterwards */
 func (en *ExtensionNode) Decode(buf []byte) error {
 	idx := bytes.IndexByte(buf, Separator)
 	if idx < 0 {
 		return ErrInvalidEncoding
 	}
-	en.Path = make([]byte, idx)
-	copy(en.Path, buf[:idx])
-	// en.Path = buf[:idx]
-	buf = buf[idx+1:]
-	en.NodeKey = make(Key, len(buf))
-	copy(en.NodeKey, buf)
+	en.Path = buf[:idx:idx]
+	en.NodeKey = buf[idx+1 : len(buf) : len(buf)]
 	return nil
 }
 
@@ -663,21 +678,16 @@ func (en *ExtensionNode) CloneNode() Node {
 	clone.OriginTrackerNode = en.OriginTrackerNode.Clone()
 	clone.Path = en.Path       // path will never be updated inplace and so ok
 	clone.NodeKey = en.NodeKey // nodekey will never be updated inplace and so ok
+	if en.LeafCount != nil {
+		count := *en.LeafCount
+		clone.LeafCount = &count
+	}
 	return clone
 }
 
+// Clone - implement statecache.Value interface
 func (en *ExtensionNode) Clone() statecache.Value {
-	vv := en.Encode()
-	if len(vv) == 0 {
-		panic("clone ExtensionNode encode failed")
-	}
-
-	sclone, err := CreateNode(bytes.NewBuffer(vv))
-	if err != nil {
-		panic(fmt.Errorf("clone ExtensionNode decode failed: %v", err))
-	}
-
-	return sclone
+	return en.CloneNode()
 }
 
 func (en *ExtensionNode) CopyFrom(v interface{}) bool {
@@ -735,14 +745,81 @@ func IncludesNodeType(nodeTypes byte, nodeType byte) bool {
 	return (nodeTypes & nodeType) == nodeType
 }
 
+// nodeBufferPool - scratch buffers to hash and read the nodes
+var nodeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, 1024))
+	},
+}
+
+// maxPooledNodeBuffer - bigger buffers are left to the gc, so that a few large values don't pin memory
+const maxPooledNodeBuffer = 64 * 1024
+
+func getNodeBuffer() *bytes.Buffer {
+	buf := nodeBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putNodeBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledNodeBuffer {
+		nodeBufferPool.Put(buf)
+	}
+}
+
+// hashNode - the hash of the little endian origin followed by the node encoding
+func hashNode(origin Sequence, encode func(buf *bytes.Buffer)) []byte {
+	hash, _ := hashNodeLen(origin, encode)
+	return hash
+}
+
+// hashNodeLen - the hash of the node as by hashNode and the number of bytes hashed
+func hashNodeLen(origin Sequence, encode func(buf *bytes.Buffer)) ([]byte, int) {
+	buf := getNodeBuffer()
+	defer putNodeBuffer(buf)
+	var o [8]byte
+	binary.LittleEndian.PutUint64(o[:], uint64(origin))
+	buf.Write(o[:])
+	encode(buf)
+	return encryption.RawHash(buf.Bytes()), buf.Len()
+}
+
+// nodeHashLen - the hash of the node and the number of bytes hashed for it
+func nodeHashLen(node Node) (Key, int) {
+	switch nodeImpl := node.(type) {
+	case *LeafNode:
+		return hashNodeLen(nodeImpl.GetOrigin(), nodeImpl.encode)
+	case *FullNode:
+		return hashNodeLen(nodeImpl.GetOrigin(), nodeImpl.encode)
+	case *ExtensionNode:
+		return hashNodeLen(nodeImpl.GetOrigin(), nodeImpl.encode)
+	}
+	return node.GetHashBytes(), len(node.Encode())
+}
+
 /*CreateNode - create a node based on the serialization prefix */
 func CreateNode(r io.Reader) (Node, error) {
-	buf := []byte{0}
-	n, err := r.Read(buf)
-	if err != nil {
+	buf := getNodeBuffer()
+	defer putNodeBuffer(buf)
+	if _, err := buf.ReadFrom(r); err != nil {
 		return nil, err
 	}
-	if n == 0 {
+	if buf.Len() == 0 {
+		return nil, io.EOF
+	}
+	return DecodeNode(buf.Bytes())
+}
+
+// DecodeNode - create a node from its encoding. The data is borrowed, such as a db slice freed
+// after the call: it's copied once and the decoded node keeps sub slices of the copy rather than
+// allocating its fields one by one. The value wraps its bytes, they are unmarshalled by its reader.
+func DecodeNode(data []byte) (Node, error) {
+	return decodeNode(concat(data))
+}
+
+// decodeNode - create a node from its encoding, the node keeps sub slices of the buffer
+func decodeNode(buf []byte) (Node, error) {
+	if len(buf) == 0 {
 		return nil, ErrInvalidEncoding
 	}
 	code := buf[0]
@@ -759,21 +836,48 @@ func CreateNode(r io.Reader) (Node, error) {
 	default:
 		panic(fmt.Sprintf("unknown node type: %v", code))
 	}
-	var ot OriginTracker
-	_ = ot.Read(r)
-	node.SetOriginTracker(&ot)
-	buf, err = ioutil.ReadAll(r)
-	if err != nil {
-		return nil, err
+	ot := &OriginTracker{}
+	if len(buf) >= 9 {
+		ot.Version = Sequence(binary.LittleEndian.Uint64(buf[1:]))
+	}
+	if len(buf) >= 17 {
+		ot.Origin = Sequence(binary.LittleEndian.Uint64(buf[9:]))
+		buf = buf[17:]
+	} else {
+		// a truncated origin tracker leaves nothing to decode
+		buf = nil
+	}
+	node.SetOriginTracker(ot)
+	var err error
+	if code&NodeCountsFlag != 0 {
+		cn, ok := node.(countedNode)
+		if !ok {
+			return nil, ErrInvalidEncoding
+		}
+		if buf, err = cn.decodeCounts(buf); err != nil {
+			return nil, err
+		}
 	}
 	err = node.Decode(buf)
 	return node, err
 }
 
 func writeNodePrefix(w io.Writer, node Node) error {
-	_, err := w.Write([]byte{GetSerializationPrefix(node)})
+	prefix := GetSerializationPrefix(node)
+	cn, counted := node.(countedNode)
+	counted = counted && cn.hasCounts()
+	if counted {
+		prefix |= NodeCountsFlag
+	}
+	_, err := w.Write([]byte{prefix})
 	if err != nil {
 		return err
 	}
-	return node.GetOriginTracker().Write(w)
+	if err := node.GetOriginTracker().Write(w); err != nil {
+		return err
+	}
+	if counted {
+		_, err = w.Write(cn.encodeCounts())
+	}
+	return err
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"runtime"
 	"runtime/debug"
 	"sync"
 
@@ -12,6 +13,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// UpdateChangesWorkers - max number of workers hashing the changed nodes concurrently in UpdateChanges
+var UpdateChangesWorkers = runtime.NumCPU()
+
 /*NodeChange - track a change to the node */
 type NodeChange struct {
 	Old Node
@@ -134,26 +138,24 @@ func (cc *ChangeCollector) GetDeletes() []Node {
 
 /*UpdateChanges - update all the changes collected to a database */
 func (cc *ChangeCollector) UpdateChanges(ndb NodeDB, origin Sequence, includeDeletes bool) error {
+	return cc.updateChanges(ndb, includeDeletes, nil)
+}
+
+// updateChanges - write the changes, registering the root with the nodes when set
+func (cc *ChangeCollector) updateChanges(ndb NodeDB, includeDeletes bool, rc *rootCommit) error {
 	cc.mutex.RLock()
 	defer cc.mutex.RUnlock()
-	keys := make([]Key, len(cc.Changes))
-	keysStr := make([]string, len(keys))
-	nodes := make([]Node, len(cc.Changes))
-	idx := 0
+	nodes := make([]Node, 0, len(cc.Changes))
 	for _, c := range cc.Changes {
-		nodes[idx] = c.New.CloneNode()
-		keys[idx] = nodes[idx].GetHashBytes()
-		keysStr[idx] = nodes[idx].GetHash()
-		idx++
+		nodes = append(nodes, c.New)
 	}
 
-	logging.Logger.Debug("MPT - update changes", zap.Int("changes", len(keys)))
-	err := ndb.MultiPutNode(keys, nodes)
-	if err != nil {
+	logging.Logger.Debug("MPT - update changes", zap.Int("changes", len(nodes)))
+	if err := multiPutNodes(ndb, nodes, rc); err != nil {
 		return err
 	}
 
-	logging.Logger.Debug("MPT - update changes done", zap.Int("changes", len(keys)))
+	logging.Logger.Debug("MPT - update changes done", zap.Int("changes", len(nodes)))
 	if includeDeletes {
 		for _, d := range cc.Deletes {
 			err := ndb.DeleteNode(d.GetHashBytes())
@@ -174,6 +176,138 @@ func (cc *ChangeCollector) UpdateChanges(ndb NodeDB, origin Sequence, includeDel
 	return nil
 }
 
+// rootCommit - the root of the round registered with the nodes written
+type rootCommit struct {
+	round int64
+	root  Key
+}
+
+// encodedNodeWriter - a node db writing the nodes encoded by the workers of multiPutNodes as they are,
+// a batch at a time
+type encodedNodeWriter interface {
+	newEncodedWrite() encodedWrite
+}
+
+// encodedWrite - the encoded nodes put are written at once by commit
+type encodedWrite interface {
+	put(key Key, value []byte)
+	// commit - write the nodes put, registering the root when set
+	commit(rc *rootCommit) error
+	destroy()
+}
+
+// nodesBatch - a batch of nodes hashed and encoded, or cloned, by a worker of multiPutNodes
+type nodesBatch struct {
+	nodes  []Node
+	keys   []Key
+	values [][]byte // the encoded nodes for an encodedNodeWriter
+	clone  []Node   // the cloned nodes otherwise
+	done   chan struct{}
+}
+
+func (b *nodesBatch) hash(encode bool) {
+	b.keys = make([]Key, len(b.nodes))
+	if encode {
+		b.values = make([][]byte, len(b.nodes))
+	} else {
+		b.clone = make([]Node, len(b.nodes))
+	}
+	for i, n := range b.nodes {
+		if encode {
+			b.keys[i] = n.GetHashBytes()
+			b.values[i] = n.Encode()
+			continue
+		}
+		b.clone[i] = n.CloneNode()
+		b.keys[i] = b.clone[i].GetHashBytes()
+	}
+	close(b.done)
+}
+
+// multiPutNodes - hash and encode the nodes with a pool of at most UpdateChangesWorkers workers, in
+// batches of BatchSize, and write them in order while the next batches are encoded. A node db that is
+// an encodedNodeWriter commits the encoded nodes of each batch as they are, any other node db writes
+// each batch with MultiPutNode. The root is registered with the last batch, so a failed write leaves
+// the batches written before it in the node db but the root is not registered then.
+func multiPutNodes(ndb NodeDB, nodes []Node, rc *rootCommit) error {
+	writer, encode := ndb.(encodedNodeWriter)
+	batches := make([]*nodesBatch, 0, (len(nodes)+BatchSize-1)/BatchSize)
+	for i := 0; i < len(nodes); i += BatchSize {
+		batches = append(batches, &nodesBatch{
+			nodes: nodes[i:min(i+BatchSize, len(nodes))],
+			done:  make(chan struct{}),
+		})
+	}
+	write := func(keys []Key, values [][]byte, clone []Node, last bool) error {
+		var root *rootCommit
+		if last {
+			root = rc
+		}
+		switch {
+		case encode:
+			ew := writer.newEncodedWrite()
+			defer ew.destroy()
+			for j, key := range keys {
+				ew.put(key, values[j])
+			}
+			return ew.commit(root)
+		case root != nil:
+			return ndb.(RootRegistry).MultiPutNodeWithRoot(keys, clone, root.round, root.root)
+		default:
+			return ndb.MultiPutNode(keys, clone)
+		}
+	}
+	if len(batches) == 0 {
+		if rc == nil {
+			return nil
+		}
+		return write(nil, nil, nil, true)
+	}
+	if len(batches) == 1 {
+		b := batches[0]
+		b.hash(encode)
+		return write(b.keys, b.values, b.clone, true)
+	}
+
+	workers := min(max(UpdateChangesWorkers, 1), len(batches))
+	var (
+		wg    sync.WaitGroup
+		quit  = make(chan struct{})
+		nextC = make(chan *nodesBatch)
+	)
+	// stop hashing and wait for the workers when a write fails
+	defer wg.Wait()
+	defer close(quit)
+
+	go func() {
+		defer close(nextC)
+		for _, b := range batches {
+			select {
+			case nextC <- b:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for b := range nextC {
+				b.hash(encode)
+			}
+		}()
+	}
+
+	for i, b := range batches {
+		<-b.done
+		if err := write(b.keys, b.values, b.clone, i == len(batches)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func PrintChanges(w io.Writer, changes []*NodeChange) {
 	for idx, c := range changes {
 		if c.Old != nil {
@@ -202,8 +336,9 @@ func (cc *ChangeCollector) Clone() ChangeCollectorI {
 	defer cc.mutex.RUnlock()
 
 	c := &ChangeCollector{
-		Changes: make(map[string]*NodeChange),
-		Deletes: make(map[string]Node),
+		startRoot: cc.startRoot,
+		Changes:   make(map[string]*NodeChange),
+		Deletes:   make(map[string]Node),
 	}
 
 	for k, v := range cc.Changes {
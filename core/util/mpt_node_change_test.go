@@ -2,12 +2,16 @@ package util
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
 
 	"github.com/linxGnu/grocksdb"
 	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
 )
 
 func TestChangeCollector_AddChange(t *testing.T) {
@@ -285,3 +289,152 @@ func TestChangeCollector_Clone(t *testing.T) {
 		})
 	}
 }
+
+// countingNodeDB - counts the MultiPutNode calls and fails after maxPuts calls
+type countingNodeDB struct {
+	*MemoryNodeDB
+	puts    int
+	maxPuts int
+}
+
+func (c *countingNodeDB) MultiPutNode(keys []Key, nodes []Node) error {
+	c.puts++
+	if c.maxPuts > 0 && c.puts > c.maxPuts {
+		return errors.New("put failed")
+	}
+	return c.MemoryNodeDB.MultiPutNode(keys, nodes)
+}
+
+func TestChangeCollector_UpdateChangesParallel(t *testing.T) {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	for i := 0; i < 2000; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+	changes := mpt.ChangeCollector.GetChanges()
+	require.Greater(t, len(changes), BatchSize)
+
+	defer func(workers int) { UpdateChangesWorkers = workers }(UpdateChangesWorkers)
+	for _, workers := range []int{1, 4, 16} {
+		UpdateChangesWorkers = workers
+		ndb := &countingNodeDB{MemoryNodeDB: NewMemoryNodeDB()}
+		require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+		require.Equal(t, (len(changes)+BatchSize-1)/BatchSize, ndb.puts)
+
+		// the same nodes as writing the changes one by one
+		require.Equal(t, int64(len(changes)), ndb.Size(context.TODO()))
+		for _, c := range changes {
+			node, err := ndb.GetNode(c.New.GetHashBytes())
+			require.NoError(t, err)
+			require.Equal(t, c.New.Encode(), node.Encode())
+		}
+		smpt := NewMerklePatriciaTrie(ndb, Sequence(1), mpt.GetRoot(), statecache.NewEmpty())
+		require.NoError(t, smpt.Validate())
+	}
+
+	// a failed write stops the pipeline
+	UpdateChangesWorkers = 4
+	ndb := &countingNodeDB{MemoryNodeDB: NewMemoryNodeDB(), maxPuts: 2}
+	require.Error(t, mpt.ChangeCollector.UpdateChanges(ndb, Sequence(1), false))
+	require.Equal(t, 3, ndb.puts)
+	require.Equal(t, int64(2*BatchSize), ndb.Size(context.TODO()))
+}
+
+// encodedMemoryNodeDB - writes the encoded nodes of a batch on commit, records the roots committed
+// and fails the commits after maxCommits commits
+type encodedMemoryNodeDB struct {
+	*countingNodeDB
+	commits    int
+	maxCommits int
+	roots      []*rootCommit
+}
+
+type memoryEncodedWrite struct {
+	ndb    *encodedMemoryNodeDB
+	keys   []Key
+	values [][]byte
+}
+
+func (ndb *encodedMemoryNodeDB) newEncodedWrite() encodedWrite {
+	return &memoryEncodedWrite{ndb: ndb}
+}
+
+func (ew *memoryEncodedWrite) put(key Key, value []byte) {
+	ew.keys = append(ew.keys, key)
+	ew.values = append(ew.values, value)
+}
+
+func (ew *memoryEncodedWrite) commit(rc *rootCommit) error {
+	ew.ndb.commits++
+	if ew.ndb.maxCommits > 0 && ew.ndb.commits > ew.ndb.maxCommits {
+		return errors.New("commit failed")
+	}
+	ew.ndb.roots = append(ew.ndb.roots, rc)
+	for i, key := range ew.keys {
+		node, err := DecodeNode(ew.values[i])
+		if err != nil {
+			return err
+		}
+		if err := ew.ndb.MemoryNodeDB.PutNode(key, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ew *memoryEncodedWrite) destroy() {}
+
+func TestChangeCollector_UpdateChangesEncoded(t *testing.T) {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	for i := 0; i < 2000; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+	changes := mpt.ChangeCollector.GetChanges()
+	require.Greater(t, len(changes), BatchSize)
+
+	// the encoded nodes are written as they are, a batch at a time, the root with the last one
+	nodes := make([]Node, 0, len(changes))
+	for _, c := range changes {
+		nodes = append(nodes, c.New)
+	}
+	rc := &rootCommit{round: 1, root: mpt.GetRoot()}
+	ndb := &encodedMemoryNodeDB{countingNodeDB: &countingNodeDB{MemoryNodeDB: NewMemoryNodeDB()}}
+	require.NoError(t, multiPutNodes(ndb, nodes, rc))
+	require.Zero(t, ndb.puts)
+	batches := (len(changes) + BatchSize - 1) / BatchSize
+	require.Equal(t, batches, ndb.commits)
+	require.Equal(t, append(make([]*rootCommit, batches-1), rc), ndb.roots)
+	require.Equal(t, int64(len(changes)), ndb.Size(context.TODO()))
+	for _, c := range changes {
+		node, err := ndb.GetNode(c.New.GetHashBytes())
+		require.NoError(t, err)
+		require.Equal(t, c.New.Encode(), node.Encode())
+	}
+
+	// a failed commit stops the pipeline, the root is not committed
+	ndb = &encodedMemoryNodeDB{countingNodeDB: &countingNodeDB{MemoryNodeDB: NewMemoryNodeDB()}, maxCommits: 2}
+	require.Error(t, multiPutNodes(ndb, nodes, rc))
+	require.Equal(t, 3, ndb.commits)
+	require.Equal(t, []*rootCommit{nil, nil}, ndb.roots)
+	require.Equal(t, int64(2*BatchSize), ndb.Size(context.TODO()))
+}
+
+func TestPNodeDB_UpdateChangesWithRoot(t *testing.T) {
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+
+	mpt := NewMerklePatriciaTrie(pndb, Sequence(3), nil, statecache.NewEmpty())
+	for i := 0; i < 1000; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+	require.Greater(t, mpt.GetChangeCount(), BatchSize)
+	require.NoError(t, mpt.SaveChanges(context.TODO(), pndb, false))
+
+	round, root, err := pndb.LatestRoot()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), round)
+	require.Equal(t, mpt.GetRoot(), root)
+	require.NoError(t, NewMerklePatriciaTrie(pndb, Sequence(3), root, statecache.NewEmpty()).Validate())
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func decodeTestNodes() []Node {
+	leaf := NewLeafNode(Path("ab"), Path("cdef"), Sequence(3), &AState{balance: 100})
+	leaf.SetVersion(4)
+
+	full := NewFullNode(&AState{balance: 200})
+	full.PutChild('1', Key("key_1"))
+	full.PutChild('f', Key("key_f"))
+	full.SetOrigin(5)
+
+	counted := NewFullNode(nil)
+	counted.PutChild('2', Key("key_2"))
+	counted.PutChild('a', Key("key_a"))
+	counted.ChildCounts = make([]uint64, 16)
+	counted.ChildCounts[2] = 7
+	counted.ChildCounts[10] = 9
+
+	ext := NewExtensionNode(Path("0123"), Key("key_ext"))
+	ext.SetOrigin(6)
+
+	vn := NewValueNode()
+	vn.SetValue(&AState{balance: 300})
+
+	return []Node{leaf, full, counted, ext, vn}
+}
+
+func TestDecodeNode(t *testing.T) {
+	for _, node := range decodeTestNodes() {
+		data := node.Encode()
+		decoded, err := DecodeNode(data)
+		require.NoError(t, err)
+		require.Equal(t, data, decoded.Encode())
+		require.Equal(t, node.GetHashBytes(), decoded.GetHashBytes())
+
+		// the data is borrowed, the node must not change when it's reused
+		for i := range data {
+			data[i] = 0
+		}
+		require.Equal(t, node.Encode(), decoded.Encode())
+		require.Equal(t, node.GetHashBytes(), decoded.GetHashBytes())
+
+		read, err := CreateNode(bytes.NewReader(node.Encode()))
+		require.NoError(t, err)
+		require.Equal(t, node.Encode(), read.Encode())
+	}
+}
+
+func TestDecodeNode_Value(t *testing.T) {
+	leaf := NewLeafNode(nil, Path("ab"), Sequence(1), &AState{balance: 42})
+	decoded, err := DecodeNode(leaf.Encode())
+	require.NoError(t, err)
+
+	var as AState
+	_, err = as.UnmarshalMsg(decoded.(*LeafNode).GetValueBytes())
+	require.NoError(t, err)
+	require.Equal(t, int64(42), as.balance)
+}
+
+func TestDecodeNode_Invalid(t *testing.T) {
+	_, err := DecodeNode(nil)
+	require.Error(t, err)
+
+	_, err = CreateNode(bytes.NewReader(nil))
+	require.Error(t, err)
+
+	leaf := NewLeafNode(nil, Path("ab"), Sequence(1), &AState{balance: 42})
+	data := leaf.Encode()
+	// the path and value separator is missing
+	_, err = DecodeNode(data[:bytes.IndexByte(data[17:], Separator)+17])
+	require.Error(t, err)
+}
+
+func TestNodeClone_FreezesValue(t *testing.T) {
+	as := &AState{balance: 10}
+	leaf := NewLeafNode(nil, Path("ab"), Sequence(1), as)
+	clone := leaf.Clone().(*LeafNode)
+	hash := leaf.GetHashBytes()
+
+	// the clone doesn't follow the updates of the value object
+	as.balance = 20
+	require.Equal(t, hash, clone.GetHashBytes())
+	require.NotEqual(t, hash, leaf.GetHashBytes())
+
+	full := NewFullNode(as)
+	fclone := full.Clone().(*FullNode)
+	fhash := full.GetHashBytes()
+	as.balance = 30
+	require.Equal(t, fhash, fclone.GetHashBytes())
+	require.NotEqual(t, fhash, full.GetHashBytes())
+}
@@ -224,36 +224,17 @@ func (mndb *MemoryNodeDB) RecordDeadNodes([]Node, int64) error {
 
 // unsafe
 func (mndb *MemoryNodeDB) reachable(node, node2 Node) (ok bool) {
-	switch nodeImpl := node.(type) {
-	case *ExtensionNode:
-		fn, err := mndb.getNode(nodeImpl.NodeKey)
+	for _, ckey := range nodeRefs(node) {
+		cnode, err := mndb.getNode(ckey)
 		if err != nil && err != ErrNodeNotFound {
 			panic(err)
 		}
-		if fn == nil {
-			return false
+		if cnode == nil {
+			continue
 		}
-		if node2 == fn {
+		if node2 == cnode || mndb.reachable(cnode, node2) {
 			return true
 		}
-		return mndb.reachable(fn, node2)
-	case *FullNode:
-		for i := byte(0); i < 16; i++ {
-			child := nodeImpl.GetChild(nodeImpl.indexToByte(i))
-			if child == nil {
-				continue
-			}
-			childNode, err := mndb.getNode(child)
-			if err != nil {
-				continue
-			}
-			if node2 == childNode {
-				return true
-			}
-			if mndb.reachable(childNode, node2) {
-				return true
-			}
-		}
 	}
 	return false
 }
@@ -316,19 +297,7 @@ func (mndb *MemoryNodeDB) validate(root Node) error {
 	}
 	var iterate func(node Node)
 	iterate = func(node Node) {
-		switch nodeImpl := node.(type) {
-		case *FullNode:
-			for _, ckey := range nodeImpl.Children {
-				if ckey != nil {
-					cnode, err := mndb.getNode(ckey)
-					if err == nil {
-						nodes[StrKey(ckey)] = cnode
-						iterate(cnode)
-					}
-				}
-			}
-		case *ExtensionNode:
-			ckey := nodeImpl.NodeKey
+		for _, ckey := range nodeRefs(node) {
 			cnode, err := mndb.getNode(ckey)
 			if err == nil {
 				nodes[StrKey(ckey)] = cnode
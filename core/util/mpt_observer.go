@@ -0,0 +1,76 @@
+package util
+
+import "errors"
+
+// ErrObserved - the change can't be reported to the observers of the trie
+var ErrObserved = errors.New("trie change can't be observed")
+
+// MutationOp - the operation changing a value of the trie
+type MutationOp byte
+
+const (
+	// MutationInsert - a value inserted or updated by Insert
+	MutationInsert MutationOp = iota + 1
+	// MutationDelete - a value deleted by Delete or DeletePrefix
+	MutationDelete
+	// MutationMerge - a value changed by merging the changes of other tries or of a node db
+	MutationMerge
+)
+
+// Mutation - a change of the value at a path, a nil value is a missing one
+type Mutation struct {
+	Op       MutationOp
+	Path     Path
+	OldValue []byte
+	NewValue []byte
+	Round    Sequence
+}
+
+// MPTObserver - called with the value changes of the trie before they are applied,
+// returning an error vetoes the change which is then not applied and the error is returned to the caller
+type MPTObserver func(m Mutation) error
+
+// AddObserver - register an observer of the Insert, Delete, DeletePrefix, UpdateBatch, MergeChanges,
+// MergeMPTChanges, MergeSiblings, MergeDB and MigratePrefix calls. SaveChanges writes the changes already
+// observed and is not reported. The observers are called synchronously in the registration order while
+// the trie is locked, so they must not use the trie. RewindTo fails with
+// ErrObserved while observers are registered as the values it discards are no longer known.
+func (mpt *MerklePatriciaTrie) AddObserver(o MPTObserver) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	mpt.observers = append(mpt.observers, o)
+}
+
+// notify - unsafe, call the observers with the mutation, stop at the first veto
+func (mpt *MerklePatriciaTrie) notify(op MutationOp, path Path, old, value []byte) error {
+	m := Mutation{Op: op, Path: path, OldValue: old, NewValue: value, Round: mpt.Version}
+	for _, o := range mpt.observers {
+		if err := o(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyDiff - unsafe, call the observers with the value changes between the roots in path order
+func (mpt *MerklePatriciaTrie) notifyDiff(op MutationOp, base, other *mergeCursor) error {
+	return walkValueDiff(base, other, nil, func(path Path, old, value []byte) error {
+		return mpt.notify(op, path, old, value)
+	})
+}
+
+// valueAt - unsafe, the value at the path, nil if not present
+func (mpt *MerklePatriciaTrie) valueAt(path Path) ([]byte, error) {
+	if len(mpt.root) == 0 {
+		return nil, nil
+	}
+	rootNode, err := mpt.getNode(mpt.root)
+	if err != nil {
+		return nil, err
+	}
+	v, err := mpt.getNodeValueRaw(path, rootNode)
+	if err == ErrValueNotPresent {
+		return nil, nil
+	}
+	return v, err
+}
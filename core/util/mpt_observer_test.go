@@ -0,0 +1,211 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func encodeTxn(t *testing.T, data string) []byte {
+	v, err := (&Txn{data}).MarshalMsg(nil)
+	require.NoError(t, err)
+	return v
+}
+
+func TestMerklePatriciaTrie_Observers(t *testing.T) {
+	ndb := NewMemoryNodeDB()
+	mpt := NewMerklePatriciaTrie(ndb, Sequence(7), nil, statecache.NewEmpty())
+
+	var mutations []Mutation
+	mpt.AddObserver(func(m Mutation) error {
+		mutations = append(mutations, m)
+		return nil
+	})
+
+	_, err := mpt.Insert(Path("01"), &Txn{"a"})
+	require.NoError(t, err)
+	_, err = mpt.Insert(Path("01"), &Txn{"b"})
+	require.NoError(t, err)
+	_, err = mpt.Delete(Path("01"))
+	require.NoError(t, err)
+	// deleting a missing value is not a change
+	_, _ = mpt.Delete(Path("02"))
+
+	require.Equal(t, []Mutation{
+		{Op: MutationInsert, Path: Path("01"), NewValue: encodeTxn(t, "a"), Round: 7},
+		{Op: MutationInsert, Path: Path("01"), OldValue: encodeTxn(t, "a"), NewValue: encodeTxn(t, "b"), Round: 7},
+		{Op: MutationDelete, Path: Path("01"), OldValue: encodeTxn(t, "b"), Round: 7},
+	}, mutations)
+
+	_, err = mpt.Insert(Path("01"), &Txn{"c"})
+	require.NoError(t, err)
+	_, err = mpt.Insert(Path("0123"), &Txn{"d"})
+	require.NoError(t, err)
+	require.Equal(t, []Mutation{
+		{Op: MutationInsert, Path: Path("01"), NewValue: encodeTxn(t, "c"), Round: 7},
+		{Op: MutationInsert, Path: Path("0123"), NewValue: encodeTxn(t, "d"), Round: 7},
+	}, mutations[3:])
+
+	// the changes saved are already observed
+	mutations = nil
+	require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+	require.Empty(t, mutations)
+}
+
+func TestMerklePatriciaTrie_ObserverVeto(t *testing.T) {
+	errVeto := errors.New("veto")
+	ndb := NewMemoryNodeDB()
+	mpt := NewMerklePatriciaTrie(ndb, Sequence(1), nil, statecache.NewEmpty())
+	_, err := mpt.Insert(Path("01"), &Txn{"a"})
+	require.NoError(t, err)
+	root := mpt.GetRoot()
+
+	mpt.AddObserver(func(m Mutation) error {
+		if string(m.Path) == "02" {
+			return errVeto
+		}
+		return nil
+	})
+
+	_, err = mpt.Insert(Path("02"), &Txn{"b"})
+	require.Equal(t, errVeto, err)
+	_, err = mpt.Delete(Path("01"))
+	require.NoError(t, err)
+	_, err = mpt.Insert(Path("01"), &Txn{"a"})
+	require.NoError(t, err)
+	require.Equal(t, root, mpt.GetRoot())
+
+	// the save is not vetoed, the trie saved is the one observed
+	saved := NewMemoryNodeDB()
+	require.NoError(t, mpt.SaveChanges(context.TODO(), saved, false))
+	require.NoError(t, NewMerklePatriciaTrie(saved, Sequence(1), root, statecache.NewEmpty()).Validate())
+}
+
+func TestMerklePatriciaTrie_ObserveMergeChanges(t *testing.T) {
+	ndb := NewMemoryNodeDB()
+	mpt := NewMerklePatriciaTrie(ndb, Sequence(3), nil, statecache.NewEmpty())
+	_, err := mpt.Insert(Path("01"), &Txn{"a"})
+	require.NoError(t, err)
+	_, err = mpt.Insert(Path("02"), &Txn{"b"})
+	require.NoError(t, err)
+
+	var mutations []Mutation
+	mpt.AddObserver(func(m Mutation) error {
+		mutations = append(mutations, m)
+		return nil
+	})
+
+	mpt2 := NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), ndb, false), Sequence(3), mpt.GetRoot(), statecache.NewEmpty())
+	_, err = mpt2.Insert(Path("01"), &Txn{"c"})
+	require.NoError(t, err)
+	_, err = mpt2.Delete(Path("02"))
+	require.NoError(t, err)
+	_, err = mpt2.Insert(Path("03"), &Txn{"d"})
+	require.NoError(t, err)
+
+	require.NoError(t, mpt.MergeChanges(mpt2.GetChanges()))
+	require.Equal(t, mpt2.GetRoot(), mpt.GetRoot())
+	require.Equal(t, []Mutation{
+		{Op: MutationMerge, Path: Path("01"), OldValue: encodeTxn(t, "a"), NewValue: encodeTxn(t, "c"), Round: 3},
+		{Op: MutationMerge, Path: Path("02"), OldValue: encodeTxn(t, "b"), Round: 3},
+		{Op: MutationMerge, Path: Path("03"), NewValue: encodeTxn(t, "d"), Round: 3},
+	}, mutations)
+}
+
+func TestMerklePatriciaTrie_ObserveBulkChanges(t *testing.T) {
+	var mutations []Mutation
+	observe := func(m Mutation) error {
+		mutations = append(mutations, m)
+		return nil
+	}
+
+	t.Run("DeletePrefix", func(t *testing.T) {
+		mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(2), nil, statecache.NewEmpty())
+		for _, p := range []string{"0101", "0102", "02"} {
+			_, err := mpt.Insert(Path(p), &Txn{p})
+			require.NoError(t, err)
+		}
+		root := mpt.GetRoot()
+		errVeto := errors.New("veto")
+		mpt.AddObserver(func(m Mutation) error {
+			if string(m.Path) == "0102" {
+				return errVeto
+			}
+			return nil
+		})
+		_, err := mpt.DeletePrefix(Path("01"))
+		require.Equal(t, errVeto, err)
+		require.Equal(t, root, mpt.GetRoot())
+
+		mpt.observers = nil
+		mpt.AddObserver(observe)
+		mutations = nil
+		_, err = mpt.DeletePrefix(Path("01"))
+		require.NoError(t, err)
+		require.Equal(t, []Mutation{
+			{Op: MutationDelete, Path: Path("0101"), OldValue: encodeTxn(t, "0101"), Round: 2},
+			{Op: MutationDelete, Path: Path("0102"), OldValue: encodeTxn(t, "0102"), Round: 2},
+		}, mutations)
+	})
+
+	t.Run("MergeSiblings", func(t *testing.T) {
+		mpt, sibling := newMergeTestTries(t)
+		mpt1, mpt2 := sibling(), sibling()
+		_, err := mpt1.Insert(flatTestPath(1), &Txn{"x"})
+		require.NoError(t, err)
+		_, err = mpt2.Delete(flatTestPath(2))
+		require.NoError(t, err)
+
+		mpt.AddObserver(observe)
+		mutations = nil
+		_, err = mpt.MergeSiblings(mpt1, mpt2)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []Mutation{
+			{Op: MutationMerge, Path: flatTestPath(1), OldValue: encodeTxn(t, "1"), NewValue: encodeTxn(t, "x"), Round: 1},
+			{Op: MutationMerge, Path: flatTestPath(2), OldValue: encodeTxn(t, "2"), Round: 1},
+		}, mutations)
+	})
+
+	t.Run("MergeDB", func(t *testing.T) {
+		ndb := NewMemoryNodeDB()
+		mpt := NewMerklePatriciaTrie(ndb, Sequence(3), nil, statecache.NewEmpty())
+		_, err := mpt.Insert(Path("01"), &Txn{"a"})
+		require.NoError(t, err)
+		_, err = mpt.Insert(Path("02"), &Txn{"b"})
+		require.NoError(t, err)
+
+		mpt2 := NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), ndb, false), Sequence(3), mpt.GetRoot(), statecache.NewEmpty())
+		_, err = mpt2.Insert(Path("01"), &Txn{"c"})
+		require.NoError(t, err)
+		_, err = mpt2.Delete(Path("02"))
+		require.NoError(t, err)
+		mdb := NewMemoryNodeDB()
+		require.NoError(t, mpt2.SaveChanges(context.TODO(), mdb, false))
+
+		mpt.AddObserver(observe)
+		mutations = nil
+		require.NoError(t, mpt.MergeDB(mdb, mpt2.GetRoot(), nil))
+		require.Equal(t, mpt2.GetRoot(), mpt.GetRoot())
+		require.Equal(t, []Mutation{
+			{Op: MutationMerge, Path: Path("01"), OldValue: encodeTxn(t, "a"), NewValue: encodeTxn(t, "c"), Round: 3},
+			{Op: MutationMerge, Path: Path("02"), OldValue: encodeTxn(t, "b"), Round: 3},
+		}, mutations)
+	})
+
+	t.Run("RewindTo", func(t *testing.T) {
+		pndb, cleanup := newReverseDiffPNodeDB(t, 10)
+		defer cleanup()
+		var root Key
+		for round := int64(1); round <= 2; round++ {
+			root = saveReverseDiffRound(t, pndb, root, round)
+		}
+		mpt := NewMerklePatriciaTrie(pndb, Sequence(2), root, statecache.NewEmpty())
+		mpt.AddObserver(observe)
+		require.Equal(t, ErrObserved, mpt.RewindTo(context.TODO(), 1))
+		require.Equal(t, root, mpt.GetRoot())
+	})
+}
@@ -0,0 +1,286 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync"
+
+	"github.com/0chain/common/core/logging"
+	"go.uber.org/zap"
+)
+
+// ErrPathFilterStale - the path filter is not at the start root of the changes being applied
+var ErrPathFilterStale = errors.New("path filter is stale")
+
+// ErrInvalidPathFilter - the encoded path filter can't be decoded
+var ErrInvalidPathFilter = errors.New("invalid path filter")
+
+// pathFilterPageWords - the filter bits are persisted in pages of this many words,
+// so that a round only rewrites the pages it touched
+const pathFilterPageWords = 512
+
+const pathFilterEncodingVersion = 1
+
+// PathFilterStore - a node db that can persist a path filter next to the nodes
+type PathFilterStore interface {
+	// LoadPathFilter - load the persisted filter, nil if there is none
+	LoadPathFilter() (*PathFilter, error)
+	// SavePathFilter - persist the pages of the filter changed since the last save
+	SavePathFilter(pf *PathFilter) error
+}
+
+// PathFilter - a bloom filter of the value paths of a state, answers "definitely absent"
+// without walking the trie. Paths are only added, a deleted path stays a false positive
+// until the filter is rebuilt, so a filter updated up to a root covers the paths of that root.
+type PathFilter struct {
+	mutex sync.RWMutex
+	root  Key
+	k     uint32
+	bits  []uint64
+	count uint64
+	dirty map[uint32]struct{} // pages changed since the last save
+}
+
+// NewPathFilter - create a path filter sized for the expected number of paths and false positive rate
+func NewPathFilter(expected uint64, fpRate float64) *PathFilter {
+	if expected == 0 {
+		expected = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.01
+	}
+	m := math.Ceil(-float64(expected) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := uint32(math.Round(m / float64(expected) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	pages := (uint64(m)/64 + pathFilterPageWords) / pathFilterPageWords
+	pf := newPathFilter(k, pages*pathFilterPageWords)
+	// a new filter overwrites all the pages of a previously saved one
+	pf.markAllDirty()
+	return pf
+}
+
+func newPathFilter(k uint32, words uint64) *PathFilter {
+	return &PathFilter{
+		k:     k,
+		bits:  make([]uint64, words),
+		dirty: make(map[uint32]struct{}),
+	}
+}
+
+// GetRoot - the state root the filter is up to date with
+func (pf *PathFilter) GetRoot() Key {
+	pf.mutex.RLock()
+	defer pf.mutex.RUnlock()
+	return pf.root
+}
+
+// Count - number of paths added to the filter
+func (pf *PathFilter) Count() uint64 {
+	pf.mutex.RLock()
+	defer pf.mutex.RUnlock()
+	return pf.count
+}
+
+// MayContain - false if the path is definitely not in the filter
+func (pf *PathFilter) MayContain(path Path) bool {
+	pf.mutex.RLock()
+	defer pf.mutex.RUnlock()
+	m := uint64(len(pf.bits)) * 64
+	h1, h2 := pathFilterHash(path)
+	for i := uint32(0); i < pf.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if pf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Update - add the paths moving the filter from startRoot to root,
+// returns ErrPathFilterStale if the filter is not at startRoot
+func (pf *PathFilter) Update(startRoot, root Key, paths []Path) error {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	if !bytes.Equal(pf.root, startRoot) {
+		return ErrPathFilterStale
+	}
+	for _, p := range paths {
+		pf.add(p)
+	}
+	pf.root = concat(root)
+	return nil
+}
+
+// Reset - remove all the paths and the root
+func (pf *PathFilter) Reset() {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	for i := range pf.bits {
+		pf.bits[i] = 0
+	}
+	pf.markAllDirty()
+	pf.root = nil
+	pf.count = 0
+}
+
+func (pf *PathFilter) markAllDirty() {
+	for page := 0; page < len(pf.bits)/pathFilterPageWords; page++ {
+		pf.dirty[uint32(page)] = struct{}{}
+	}
+}
+
+func (pf *PathFilter) add(path Path) {
+	m := uint64(len(pf.bits)) * 64
+	h1, h2 := pathFilterHash(path)
+	for i := uint32(0); i < pf.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		pf.bits[bit/64] |= 1 << (bit % 64)
+		pf.dirty[uint32(bit/64/pathFilterPageWords)] = struct{}{}
+	}
+	pf.count++
+}
+
+// pathFilterHash - the two base hashes of the double hashing scheme
+func pathFilterHash(path Path) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write(path)
+	h1 := h.Sum64()
+	_, _ = h.Write([]byte{0xff})
+	h2 := h.Sum64() | 1
+	return h1, h2
+}
+
+// encodeHeader - version, k, number of words, count and root
+func (pf *PathFilter) encodeHeader() []byte {
+	buf := make([]byte, 0, 21+len(pf.root))
+	buf = append(buf, pathFilterEncodingVersion)
+	buf = binary.BigEndian.AppendUint32(buf, pf.k)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(pf.bits)))
+	buf = binary.BigEndian.AppendUint64(buf, pf.count)
+	return append(buf, pf.root...)
+}
+
+func decodePathFilterHeader(buf []byte) (*PathFilter, error) {
+	if len(buf) < 21 || buf[0] != pathFilterEncodingVersion {
+		return nil, ErrInvalidPathFilter
+	}
+	k := binary.BigEndian.Uint32(buf[1:])
+	words := binary.BigEndian.Uint64(buf[5:])
+	if k == 0 || words == 0 || words%pathFilterPageWords != 0 {
+		return nil, ErrInvalidPathFilter
+	}
+	pf := newPathFilter(k, words)
+	pf.count = binary.BigEndian.Uint64(buf[13:])
+	if len(buf) > 21 {
+		pf.root = concat(buf[21:])
+	}
+	return pf, nil
+}
+
+// encodePage - the little endian words of the page
+func (pf *PathFilter) encodePage(page uint32) []byte {
+	words := pf.bits[page*pathFilterPageWords : (page+1)*pathFilterPageWords]
+	buf := make([]byte, 0, len(words)*8)
+	for _, w := range words {
+		buf = binary.LittleEndian.AppendUint64(buf, w)
+	}
+	return buf
+}
+
+// decodePage - pages out of the filter range are left by a bigger filter saved before, skip them
+func (pf *PathFilter) decodePage(page uint32, buf []byte) error {
+	if uint64(page+1)*pathFilterPageWords > uint64(len(pf.bits)) {
+		return nil
+	}
+	if len(buf) != pathFilterPageWords*8 {
+		return ErrInvalidPathFilter
+	}
+	words := pf.bits[page*pathFilterPageWords : (page+1)*pathFilterPageWords]
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	return nil
+}
+
+// RebuildPathFilter - rebuild the filter from all the value paths of the trie
+func RebuildPathFilter(ctx context.Context, pf *PathFilter, mpt MerklePatriciaTrieI) error {
+	pf.Reset()
+	var paths []Path
+	handler := func(ctx context.Context, path Path, key Key, node Node) error {
+		if _, ok := node.(*ValueNode); ok {
+			paths = append(paths, concat(path))
+		}
+		return nil
+	}
+	if err := mpt.Iterate(ctx, handler, NodeTypeValueNode); err != nil {
+		return err
+	}
+	return pf.Update(nil, mpt.GetRoot(), paths)
+}
+
+// SetPathFilter - set the path filter used to short cut the reads of absent paths, it must be at the
+// root of the trie, such as rebuilt by RebuildPathFilter. It's updated by SaveChanges and persisted
+// when the node db is a PathFilterStore.
+func (mpt *MerklePatriciaTrie) SetPathFilter(pf *PathFilter) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	mpt.pathFilter = pf
+}
+
+// GetPathFilter - returns the path filter, nil if not set
+func (mpt *MerklePatriciaTrie) GetPathFilter() *PathFilter {
+	mpt.mutex.RLock()
+	defer mpt.mutex.RUnlock()
+	return mpt.pathFilter
+}
+
+// pathAbsent - unsafe, true if the path filter is valid for the path and it's definitely absent
+func (mpt *MerklePatriciaTrie) pathAbsent(path Path) bool {
+	if mpt.pathFilter == nil || !mpt.indexValidFor(mpt.pathFilter.GetRoot(), path) {
+		return false
+	}
+	return !mpt.pathFilter.MayContain(path)
+}
+
+// updatePathFilter - unsafe, add the paths of the collected changes to the filter and persist it. The
+// filter is to be dropped from the trie by dropPathFilter when it can't be updated, it's set again once
+// rebuilt by RebuildPathFilter.
+func (mpt *MerklePatriciaTrie) updatePathFilter(cc ChangeCollectorI, ndb NodeDB) error {
+	if mpt.pathFilter == nil {
+		return nil
+	}
+	puts, _, ok := flatChanges(cc.GetChanges(), nil)
+	if !ok {
+		return errFullNodeValues
+	}
+	paths := make([]Path, 0, len(puts))
+	for p := range puts {
+		paths = append(paths, Path(p))
+	}
+	if err := mpt.pathFilter.Update(cc.GetStartRoot(), mpt.root, paths); err != nil {
+		return err
+	}
+
+	if store, ok := ndb.(PathFilterStore); ok {
+		if err := store.SavePathFilter(mpt.pathFilter); err != nil {
+			logging.Logger.Error("MPT save path filter failed", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// dropPathFilter - unsafe, requires the write lock, reset the filter that can't be updated and stop using it
+func (mpt *MerklePatriciaTrie) dropPathFilter(reason error) {
+	logging.Logger.Error("MPT update path filter failed, drop path filter",
+		zap.String("filter root", ToHex(mpt.pathFilter.GetRoot())),
+		zap.String("root", ToHex(mpt.root)),
+		zap.Error(reason))
+	mpt.pathFilter.Reset()
+	mpt.pathFilter = nil
+}
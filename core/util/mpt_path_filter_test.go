@@ -0,0 +1,118 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func TestPathFilter_MayContain(t *testing.T) {
+	pf := NewPathFilter(1000, 0.01)
+	var paths []Path
+	for i := 0; i < 1000; i++ {
+		paths = append(paths, flatTestPath(i))
+	}
+	require.NoError(t, pf.Update(nil, Key("root"), paths))
+	require.Equal(t, uint64(1000), pf.Count())
+
+	// no false negatives
+	for _, p := range paths {
+		require.True(t, pf.MayContain(p))
+	}
+
+	// the false positive rate is around the configured one
+	var fp int
+	for i := 1000; i < 11000; i++ {
+		if pf.MayContain(flatTestPath(i)) {
+			fp++
+		}
+	}
+	require.Less(t, fp, 300)
+
+	require.Equal(t, ErrPathFilterStale, pf.Update(Key("other"), Key("root2"), nil))
+}
+
+func TestPathFilter_StaleDropped(t *testing.T) {
+	mndb := NewMemoryNodeDB()
+	pf := NewPathFilter(100, 0.01)
+	mpt := NewMerklePatriciaTrie(mndb, Sequence(1), nil, statecache.NewEmpty())
+	doStrValInsert(t, mpt, string(flatTestPath(1)), "1")
+	require.NoError(t, mpt.SaveChanges(context.TODO(), mndb, false))
+
+	// the filter is not at the start root of the changes
+	mpt.SetPathFilter(pf)
+	mpt.ChangeCollector = NewChangeCollector(mpt.GetRoot())
+	doStrValInsert(t, mpt, string(flatTestPath(2)), "2")
+	require.NoError(t, mpt.SaveChanges(context.TODO(), mndb, false))
+	require.Nil(t, mpt.GetPathFilter())
+	require.Nil(t, pf.GetRoot())
+
+	// used again once rebuilt
+	require.NoError(t, RebuildPathFilter(context.TODO(), pf, mpt))
+	mpt.SetPathFilter(pf)
+	mpt.ChangeCollector = NewChangeCollector(mpt.GetRoot())
+	doStrValInsert(t, mpt, string(flatTestPath(3)), "3")
+	require.NoError(t, mpt.SaveChanges(context.TODO(), mndb, false))
+	require.Equal(t, pf, mpt.GetPathFilter())
+	require.Equal(t, mpt.GetRoot(), pf.GetRoot())
+	require.Equal(t, uint64(3), pf.Count())
+}
+
+func TestPathFilter_SaveChanges(t *testing.T) {
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+
+	pf := NewPathFilter(100, 0.01)
+	var root Key
+	for round := int64(1); round <= 5; round++ {
+		mpt := NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), pndb, false), Sequence(round), root, statecache.NewEmpty())
+		mpt.SetPathFilter(pf)
+		for i := 0; i < 10; i++ {
+			k := int(round)*10 + i
+			_, err := mpt.Insert(flatTestPath(k), &Txn{fmt.Sprintf("%d", k)})
+			require.NoError(t, err)
+
+			// paths changed since the start root are not answered by the filter
+			v := &Txn{}
+			require.NoError(t, mpt.GetNodeValue(flatTestPath(k), v))
+		}
+		require.NoError(t, mpt.SaveChanges(context.TODO(), pndb, false))
+		root = mpt.GetRoot()
+		require.Equal(t, root, pf.GetRoot())
+	}
+
+	// the filter is persisted next to the nodes
+	lpf, err := pndb.LoadPathFilter()
+	require.NoError(t, err)
+	require.Equal(t, root, lpf.GetRoot())
+	require.Equal(t, pf.Count(), lpf.Count())
+	require.Equal(t, pf.bits, lpf.bits)
+
+	// reads of the absent paths don't touch the storage, the nodes are not there
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(6), root, statecache.NewEmpty())
+	mpt.SetPathFilter(lpf)
+	var absent int
+	for i := 100; i < 200; i++ {
+		_, err := mpt.GetNodeValueRaw(flatTestPath(i))
+		if err == ErrValueNotPresent {
+			absent++
+		} else {
+			require.Equal(t, ErrNodeNotFound, err)
+		}
+	}
+	require.Greater(t, absent, 90)
+
+	_, err = mpt.GetNodeValueRaw(flatTestPath(10))
+	require.Equal(t, ErrNodeNotFound, err)
+
+	// the filter is rebuilt from the trie
+	rmpt := NewMerklePatriciaTrie(pndb, Sequence(5), root, statecache.NewEmpty())
+	rpf := NewPathFilter(100, 0.01)
+	require.NoError(t, RebuildPathFilter(context.TODO(), rpf, rmpt))
+	require.Equal(t, uint64(50), rpf.Count())
+	require.Equal(t, pf.bits, rpf.bits)
+}
@@ -17,6 +17,10 @@ import (
 type PNodeDB struct {
 	db *grocksdb.DB
 
+	// opts is kept to read the statistics collected by the db
+	opts    *grocksdb.Options
+	options PNodeDBOptions
+
 	ro      *grocksdb.ReadOptions
 	wo      *grocksdb.WriteOptions
 	to      *grocksdb.TransactionOptions
@@ -24,8 +28,18 @@ type PNodeDB struct {
 	mutex   sync.Mutex
 	version int64
 
-	defaultCFH   *grocksdb.ColumnFamilyHandle
-	deadNodesCFH *grocksdb.ColumnFamilyHandle
+	defaultCFH    *grocksdb.ColumnFamilyHandle
+	deadNodesCFH  *grocksdb.ColumnFamilyHandle
+	quarantineCFH *grocksdb.ColumnFamilyHandle
+	flatCFH       *grocksdb.ColumnFamilyHandle
+	pathFilterCFH *grocksdb.ColumnFamilyHandle
+	reverseCFH    *grocksdb.ColumnFamilyHandle
+	rootsCFH      *grocksdb.ColumnFamilyHandle
+	historyCFH    *grocksdb.ColumnFamilyHandle
+	usageCFH      *grocksdb.ColumnFamilyHandle
+
+	flatMutex sync.RWMutex
+	flatRoot  Key
 }
 
 const (
@@ -40,47 +54,57 @@ var (
 
 var sstType = SSTTypeBlockBasedTable
 
-func newDefaultCFOptions(logDir string) *grocksdb.Options {
+func newDefaultCFOptions(logDir string, o *PNodeDBOptions) *grocksdb.Options {
 	opts := grocksdb.NewDefaultOptions()
 	opts.SetCreateIfMissing(true)
-	opts.SetCompression(PNodeDBCompression)
+	opts.SetCompression(o.compression())
 	opts.SetCreateIfMissingColumnFamilies(true)
-	opts.OptimizeUniversalStyleCompaction(64 * 1024 * 1024)
-	if sstType == SSTTypePlainTable {
+	opts.OptimizeUniversalStyleCompaction(o.MemtableMemoryBudget)
+	if o.SSTType == SSTTypePlainTable {
 		opts.SetAllowMmapReads(true)
 		opts.SetPrefixExtractor(grocksdb.NewFixedPrefixTransform(6))
 		opts.SetPlainTableFactory(32, 10, 0.75, 16)
 	} else {
-		opts.OptimizeForPointLookup(64)
+		opts.OptimizeForPointLookup(o.BlockCacheSizeMB)
 		opts.SetAllowMmapReads(true)
 		opts.SetPrefixExtractor(grocksdb.NewFixedPrefixTransform(6))
-		opts.SetMaxBackgroundJobs(4)               // default was 2, double to 4
-		opts.SetMaxWriteBufferNumber(4)            // default was 2, double to 4
-		opts.SetWriteBufferSize(128 * 1024 * 1024) // default was 64M, double to 128M
-		opts.SetMinWriteBufferNumberToMerge(2)     // default was 1, double to 2
+		opts.SetMaxBackgroundJobs(o.MaxBackgroundJobs)
+		opts.SetMaxWriteBufferNumber(o.MaxWriteBufferNumber)
+		opts.SetWriteBufferSize(o.WriteBufferSize)
+		opts.SetMinWriteBufferNumberToMerge(o.MinWriteBufferNumberToMerge)
 	}
-	opts.IncreaseParallelism(2) // pruning and saving happen in parallel
+	opts.IncreaseParallelism(o.Parallelism)
 	opts.SetDbLogDir(logDir)
-	opts.EnableStatistics()
-	opts.SetDeleteObsoleteFilesPeriodMicros(uint64(10 * time.Minute.Microseconds()))
+	if o.EnableStatistics {
+		opts.EnableStatistics()
+	}
+	opts.SetDeleteObsoleteFilesPeriodMicros(uint64(o.DeleteObsoleteFilesPeriod.Microseconds()))
 
 	return opts
 }
 
-func newDeadNodesCFOptions() *grocksdb.Options {
+func newDeadNodesCFOptions(o *PNodeDBOptions) *grocksdb.Options {
 	bbto := grocksdb.NewDefaultBlockBasedTableOptions()
-	bbto.SetBlockCache(grocksdb.NewLRUCache(3 << 30))
+	bbto.SetBlockCache(grocksdb.NewLRUCache(o.DeadNodesBlockCacheSize))
 	opts := grocksdb.NewDefaultOptions()
-	opts.SetKeepLogFileNum(5)
+	opts.SetKeepLogFileNum(o.KeepLogFileNum)
 	opts.SetBlockBasedTableFactory(bbto)
 	opts.SetCreateIfMissing(true)
-	opts.SetCompression(PNodeDBCompression)
+	opts.SetCompression(o.compression())
 
-	opts.SetMaxBackgroundJobs(4)               // default was 2, double to 4
-	opts.SetMaxWriteBufferNumber(4)            // default was 2, double to 4
-	opts.SetWriteBufferSize(128 * 1024 * 1024) // default was 64M, double to 128M
-	opts.SetMinWriteBufferNumberToMerge(2)     // default was 1, double to 2
-	opts.SetDeleteObsoleteFilesPeriodMicros(uint64(10 * time.Minute.Microseconds()))
+	opts.SetMaxBackgroundJobs(o.MaxBackgroundJobs)
+	opts.SetMaxWriteBufferNumber(o.MaxWriteBufferNumber)
+	opts.SetWriteBufferSize(o.WriteBufferSize)
+	opts.SetMinWriteBufferNumberToMerge(o.MinWriteBufferNumberToMerge)
+	opts.SetDeleteObsoleteFilesPeriodMicros(uint64(o.DeleteObsoleteFilesPeriod.Microseconds()))
+	return opts
+}
+
+// newAuxCFOptions - options of the small auxiliary column families
+func newAuxCFOptions(o *PNodeDBOptions) *grocksdb.Options {
+	opts := grocksdb.NewDefaultOptions()
+	opts.SetCreateIfMissing(true)
+	opts.SetCompression(o.compression())
 	return opts
 }
 
@@ -92,15 +116,24 @@ func newDBOptions() *grocksdb.Options {
 	return opts
 }
 
-// NewPNodeDB - create a new PNodeDB
+// NewPNodeDB - create a new PNodeDB with the default options
 func NewPNodeDB(stateDir, logDir string) (*PNodeDB, error) {
+	return NewPNodeDBWithOptions(stateDir, logDir, DefaultPNodeDBOptions())
+}
+
+// NewPNodeDBWithOptions - create a new PNodeDB with the given options
+func NewPNodeDBWithOptions(stateDir, logDir string, o PNodeDBOptions) (*PNodeDB, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
 
 	var (
-		defaultCFOpts = newDefaultCFOptions(logDir)
-		deadNodesOpts = newDeadNodesCFOptions()
+		defaultCFOpts = newDefaultCFOptions(logDir, &o)
+		deadNodesOpts = newDeadNodesCFOptions(&o)
+		auxOpts       = newAuxCFOptions(&o)
 
-		cfs     = []string{"default", "dead_nodes"}
-		cfsOpts = []*grocksdb.Options{defaultCFOpts, deadNodesOpts}
+		cfs     = []string{"default", "dead_nodes", "quarantine", "flat", "path_filter", "reverse_diffs", "roots", "history", "usage"}
+		cfsOpts = []*grocksdb.Options{defaultCFOpts, deadNodesOpts, auxOpts, auxOpts, auxOpts, auxOpts, auxOpts, auxOpts, auxOpts}
 	)
 
 	db, cfhs, err := grocksdb.OpenDbColumnFamilies(defaultCFOpts, stateDir, cfs, cfsOpts)
@@ -109,17 +142,36 @@ func NewPNodeDB(stateDir, logDir string) (*PNodeDB, error) {
 	}
 
 	wo := grocksdb.NewDefaultWriteOptions()
-	wo.SetSync(false)
+	wo.SetSync(o.Sync)
+
+	pndb := &PNodeDB{
+		db:            db,
+		opts:          defaultCFOpts,
+		options:       o,
+		defaultCFH:    cfhs[0],
+		deadNodesCFH:  cfhs[1],
+		quarantineCFH: cfhs[2],
+		flatCFH:       cfhs[3],
+		pathFilterCFH: cfhs[4],
+		reverseCFH:    cfhs[5],
+		rootsCFH:      cfhs[6],
+		historyCFH:    cfhs[7],
+		usageCFH:      cfhs[8],
+		ro:            grocksdb.NewDefaultReadOptions(),
+		wo:            wo,
+		to:            grocksdb.NewDefaultTransactionOptions(),
+		fo:            grocksdb.NewDefaultFlushOptions(),
+	}
 
-	return &PNodeDB{
-		db:           db,
-		defaultCFH:   cfhs[0],
-		deadNodesCFH: cfhs[1],
-		ro:           grocksdb.NewDefaultReadOptions(),
-		wo:           wo,
-		to:           grocksdb.NewDefaultTransactionOptions(),
-		fo:           grocksdb.NewDefaultFlushOptions(),
-	}, nil
+	if err := pndb.loadFlatRoot(); err != nil {
+		pndb.Close()
+		return nil, err
+	}
+	if err := pndb.recoverLatestRoot(); err != nil {
+		pndb.Close()
+		return nil, err
+	}
+	return pndb, nil
 }
 
 func (pndb *PNodeDB) EstimateSize() (string, string) {
@@ -139,7 +191,7 @@ func (pndb *PNodeDB) GetNode(key Key) (Node, error) {
 	if len(buf) == 0 {
 		return nil, ErrNodeNotFound
 	}
-	return CreateNode(bytes.NewReader(buf))
+	return DecodeNode(buf)
 }
 
 /*PutNode - implement interface */
@@ -165,8 +217,8 @@ func (pndb *PNodeDB) PutNode(key Key, node Node) error {
 	return err
 }
 
-func (pndb *PNodeDB) saveDeadNodes(dn *deadNodes, version int64) error {
-	d, err := dn.encode()
+func (pndb *PNodeDB) saveDeadNodes(keys []Key, version int64) error {
+	d, err := encodeDeadNodeKeys(keys)
 	if err != nil {
 		return err
 	}
@@ -176,12 +228,12 @@ func (pndb *PNodeDB) saveDeadNodes(dn *deadNodes, version int64) error {
 
 // RecordDeadNodes records dead nodes with version
 func (pndb *PNodeDB) RecordDeadNodes(nodes []Node, version int64) error {
-	dn := deadNodes{make(map[string]bool, len(nodes))}
+	keys := make([]Key, 0, len(nodes))
 	for _, n := range nodes {
-		dn.Nodes[n.GetHash()] = true
+		keys = append(keys, n.GetHashBytes())
 	}
 
-	return pndb.saveDeadNodes(&dn, version)
+	return pndb.saveDeadNodes(keys, version)
 }
 
 func (pndb *PNodeDB) PruneBelowVersion(ctx context.Context, version int64) error {
@@ -215,8 +267,11 @@ func (pndb *PNodeDB) PruneBelowVersion(ctx context.Context, version int64) error
 			}
 
 			// decode node keys
-			dn := deadNodes{}
-			err := dn.decode(value)
+			var ns []Key
+			err := iterateDeadNodeKeys(value, func(key []byte) error {
+				ns = append(ns, concat(key))
+				return nil
+			})
 			if err != nil {
 				logging.Logger.Warn("prune state iterator - iterator decode node keys failed",
 					zap.Error(err),
@@ -224,18 +279,6 @@ func (pndb *PNodeDB) PruneBelowVersion(ctx context.Context, version int64) error
 				return true // continue
 			}
 
-			ns := make([]Key, 0, len(dn.Nodes))
-			for k := range dn.Nodes {
-				kk, err := fromHex(k)
-				if err != nil {
-					logging.Logger.Warn("prune state - iterator decode key failed",
-						zap.Error(err),
-						zap.Uint64("round", roundNum))
-					return true // continue
-				}
-				ns = append(ns, kk)
-			}
-
 			deadNodesC <- deadNodesRecord{
 				round:     roundNum,
 				nodesKeys: ns,
@@ -262,6 +305,10 @@ func (pndb *PNodeDB) PruneBelowVersion(ctx context.Context, version int64) error
 					return err
 				}
 
+				if err := pndb.pruneRoots(version); err != nil {
+					return err
+				}
+
 				// all have been processed
 				pndb.Flush()
 
@@ -358,9 +405,14 @@ func (pndb *PNodeDB) MultiGetNode(keys []Key) ([]Node, error) {
 
 /*MultiPutNode - implement interface */
 func (pndb *PNodeDB) MultiPutNode(keys []Key, nodes []Node) error {
-	ts := time.Now()
 	wb := grocksdb.NewWriteBatch()
 	defer wb.Destroy()
+	return pndb.writeNodes(wb, keys, nodes)
+}
+
+// writeNodes - add the nodes to the write batch and write it
+func (pndb *PNodeDB) writeNodes(wb *grocksdb.WriteBatch, keys []Key, nodes []Node) error {
+	ts := time.Now()
 	for idx, key := range keys {
 		nd := nodes[idx].CloneNode()
 		if !bytes.Equal(key, nd.GetHashBytes()) {
@@ -379,6 +431,11 @@ func (pndb *PNodeDB) MultiPutNode(keys []Key, nodes []Node) error {
 				zap.Int64("Version", int64(nodes[idx].GetVersion())))
 		}
 	}
+	return pndb.writeBatch(wb, ts)
+}
+
+// writeBatch - write the batch of nodes
+func (pndb *PNodeDB) writeBatch(wb *grocksdb.WriteBatch, ts time.Time) error {
 	err := pndb.db.Write(pndb.wo, wb)
 	if err != nil {
 		logging.Logger.Error("pnode save nodes failed",
@@ -389,6 +446,33 @@ func (pndb *PNodeDB) MultiPutNode(keys []Key, nodes []Node) error {
 	return err
 }
 
+// pnodeEncodedWrite - a batch of encoded nodes written in a single write batch
+type pnodeEncodedWrite struct {
+	pndb *PNodeDB
+	wb   *grocksdb.WriteBatch
+	ts   time.Time
+}
+
+// newEncodedWrite - implement encodedNodeWriter interface
+func (pndb *PNodeDB) newEncodedWrite() encodedWrite {
+	return &pnodeEncodedWrite{pndb: pndb, wb: grocksdb.NewWriteBatch(), ts: time.Now()}
+}
+
+func (ew *pnodeEncodedWrite) put(key Key, value []byte) {
+	ew.wb.Put(key, value)
+}
+
+func (ew *pnodeEncodedWrite) commit(rc *rootCommit) error {
+	if rc != nil {
+		ew.wb.PutCF(ew.pndb.rootsCFH, uint64ToBytes(uint64(rc.round)), rc.root)
+	}
+	return ew.pndb.writeBatch(ew.wb, ew.ts)
+}
+
+func (ew *pnodeEncodedWrite) destroy() {
+	ew.wb.Destroy()
+}
+
 /*MultiDeleteNode - implement interface */
 func (pndb *PNodeDB) MultiDeleteNode(keys []Key) error {
 	wb := grocksdb.NewWriteBatch()
@@ -414,7 +498,7 @@ func (pndb *PNodeDB) Iterate(ctx context.Context, handler NodeDBIteratorHandler)
 			continue
 		}
 		vdata := value.Data()
-		node, err := CreateNode(bytes.NewReader(vdata))
+		node, err := DecodeNode(vdata)
 		if err != nil {
 			key.Free()
 			value.Free()
@@ -434,6 +518,83 @@ func (pndb *PNodeDB) Iterate(ctx context.Context, handler NodeDBIteratorHandler)
 	return nil
 }
 
+// iterateRaw iterates the stored entries without decoding them
+func (pndb *PNodeDB) iterateRaw(ctx context.Context, handler func(key, value []byte) error) error {
+	ro := grocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+	it := pndb.db.NewIterator(ro)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		key := it.Key()
+		value := it.Value()
+		kdata := key.Data()
+		if bytes.Equal(kdata, deadNodesKey) {
+			key.Free()
+			value.Free()
+			continue
+		}
+		err := handler(kdata, value.Data())
+		key.Free()
+		value.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantine moves the entries of the given keys to the quarantine column family,
+// so they are no longer visible as nodes but can still be inspected
+func (pndb *PNodeDB) Quarantine(keys []Key) error {
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for _, key := range keys {
+		data, err := pndb.db.Get(pndb.ro, key)
+		if err != nil {
+			return err
+		}
+		if data.Exists() {
+			wb.PutCF(pndb.quarantineCFH, key, data.Data())
+		}
+		data.Free()
+		wb.Delete(key)
+	}
+	return pndb.db.Write(pndb.wo, wb)
+}
+
+// IterateQuarantine iterates the quarantined entries
+func (pndb *PNodeDB) IterateQuarantine(ctx context.Context, handler func(key Key, value []byte) error) error {
+	ro := grocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+	it := pndb.db.NewIteratorCF(ro, pndb.quarantineCFH)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		key := it.Key()
+		value := it.Value()
+		err := handler(key.Data(), value.Data())
+		key.Free()
+		value.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 /*Flush - flush the db */
 func (pndb *PNodeDB) Flush() {
 	pndb.db.Flush(pndb.fo)
@@ -458,5 +619,12 @@ func (pndb *PNodeDB) Size(ctx context.Context) int64 {
 func (pndb *PNodeDB) Close() {
 	pndb.defaultCFH.Destroy()
 	pndb.deadNodesCFH.Destroy()
+	pndb.quarantineCFH.Destroy()
+	pndb.flatCFH.Destroy()
+	pndb.pathFilterCFH.Destroy()
+	pndb.reverseCFH.Destroy()
+	pndb.rootsCFH.Destroy()
+	pndb.historyCFH.Destroy()
+	pndb.usageCFH.Destroy()
 	pndb.db.Close()
 }
@@ -0,0 +1,93 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/0chain/common/core/logging"
+	"go.uber.org/zap"
+)
+
+// Checkpoint - create a consistent on-disk snapshot of the db in the given directory,
+// including all the column families. The directory must not exist, and should be on the
+// same filesystem as the db so the sst files can be hard linked instead of copied.
+func (pndb *PNodeDB) Checkpoint(dir string) error {
+	cp, err := pndb.db.NewCheckpoint()
+	if err != nil {
+		return err
+	}
+	defer cp.Destroy()
+
+	// 0 means the memtables are always flushed so the checkpoint
+	// contains all the writes done before this call
+	if err := cp.CreateCheckpoint(dir, 0); err != nil {
+		return err
+	}
+
+	logging.Logger.Info("pnode db checkpoint created", zap.String("dir", dir))
+	return nil
+}
+
+// RestorePNodeDB - restore a checkpoint created by PNodeDB.Checkpoint to the state
+// directory and open it as a new PNodeDB. The checkpoint itself is left untouched
+// so it can be restored again.
+func RestorePNodeDB(checkpointDir, stateDir, logDir string) (*PNodeDB, error) {
+	if _, err := os.Stat(checkpointDir); err != nil {
+		return nil, fmt.Errorf("restore pnode db: %v", err)
+	}
+	if _, err := os.Stat(stateDir); err == nil {
+		return nil, fmt.Errorf("restore pnode db: state dir %s already exists", stateDir)
+	}
+
+	if err := copyDir(checkpointDir, stateDir); err != nil {
+		_ = os.RemoveAll(stateDir)
+		return nil, fmt.Errorf("restore pnode db: %v", err)
+	}
+
+	logging.Logger.Info("pnode db checkpoint restored",
+		zap.String("checkpoint", checkpointDir),
+		zap.String("dir", stateDir))
+	return NewPNodeDB(stateDir, logDir)
+}
+
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func TestPNodeDB_CheckpointRestore(t *testing.T) {
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+
+	mpt := NewMerklePatriciaTrie(pndb, Sequence(1), nil, statecache.NewEmpty())
+	doStrValInsert(t, mpt, "1234", "1")
+	doStrValInsert(t, mpt, "123567", "2")
+	root := mpt.GetRoot()
+
+	deadNode := NewLeafNode(nil, Path("01"), 0, &Txn{"dead"})
+	require.NoError(t, pndb.RecordDeadNodes([]Node{deadNode}, 1))
+
+	dirname, err := os.MkdirTemp("", "mpt-pndb-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dirname)
+
+	cpDir := filepath.Join(dirname, "checkpoint")
+	require.NoError(t, pndb.Checkpoint(cpDir))
+	require.Error(t, pndb.Checkpoint(cpDir), "checkpoint dir exists")
+
+	// changes after the checkpoint should not be restored
+	doStrValInsert(t, mpt, "223671", "3")
+
+	stateDir := filepath.Join(dirname, "restored")
+	restored, err := RestorePNodeDB(cpDir, stateDir, filepath.Join(dirname, "log"))
+	require.NoError(t, err)
+	defer restored.Close()
+
+	_, err = RestorePNodeDB(cpDir, stateDir, filepath.Join(dirname, "log"))
+	require.Error(t, err, "state dir exists")
+
+	rmpt := NewMerklePatriciaTrie(restored, Sequence(1), root, statecache.NewEmpty())
+	doGetStrValue(t, rmpt, "1234", "1")
+	doGetStrValue(t, rmpt, "123567", "2")
+	_, err = rmpt.GetNodeValueRaw(Path("223671"))
+	require.Equal(t, ErrValueNotPresent, err)
+
+	var rounds []uint64
+	restored.iteratorDeadNodes(context.TODO(), func(key, value []byte) bool {
+		rounds = append(rounds, bytesToUint64(key))
+		return true
+	})
+	require.Equal(t, []uint64{1}, rounds)
+}
@@ -0,0 +1,120 @@
+package util
+
+import (
+	"bytes"
+
+	"github.com/linxGnu/grocksdb"
+)
+
+// flatRootKey - key of the flat root record in the flat column family, paths are hex
+// so it never collides with a value entry
+var flatRootKey = []byte("\x00root")
+
+// flat entries and the root record are prefixed by the big endian version they were written at
+const flatVersionLen = 8
+
+func (pndb *PNodeDB) loadFlatRoot() error {
+	data, err := pndb.db.GetCF(pndb.ro, pndb.flatCFH, flatRootKey)
+	if err != nil {
+		return err
+	}
+	defer data.Free()
+	buf := data.Data()
+	if len(buf) > flatVersionLen {
+		pndb.flatRoot = concat(buf[flatVersionLen:])
+	}
+	return nil
+}
+
+// GetFlatRoot - implement FlatDB interface
+func (pndb *PNodeDB) GetFlatRoot() Key {
+	pndb.flatMutex.RLock()
+	defer pndb.flatMutex.RUnlock()
+	return pndb.flatRoot
+}
+
+// GetFlatValue - implement FlatDB interface
+func (pndb *PNodeDB) GetFlatValue(path Path) ([]byte, error) {
+	data, err := pndb.db.GetCF(pndb.ro, pndb.flatCFH, path)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Free()
+	buf := data.Data()
+	if len(buf) <= flatVersionLen {
+		return nil, ErrValueNotPresent
+	}
+	return concat(buf[flatVersionLen:]), nil
+}
+
+// GetFlatValueAt - implement FlatDB interface
+func (pndb *PNodeDB) GetFlatValueAt(root Key, path Path) ([]byte, error) {
+	pndb.flatMutex.RLock()
+	defer pndb.flatMutex.RUnlock()
+	if !bytes.Equal(pndb.flatRoot, root) {
+		return nil, ErrFlatDBStale
+	}
+	return pndb.GetFlatValue(path)
+}
+
+// UpdateFlat - implement FlatDB interface
+func (pndb *PNodeDB) UpdateFlat(startRoot, root Key, version Sequence, puts map[string][]byte, deletes []Path) error {
+	pndb.flatMutex.Lock()
+	defer pndb.flatMutex.Unlock()
+	if !bytes.Equal(pndb.flatRoot, startRoot) {
+		return ErrFlatDBStale
+	}
+
+	v := uint64ToBytes(uint64(version))
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for _, p := range deletes {
+		wb.DeleteCF(pndb.flatCFH, p)
+	}
+	for p, value := range puts {
+		wb.PutCF(pndb.flatCFH, []byte(p), concat(v, value...))
+	}
+	if len(root) > 0 {
+		wb.PutCF(pndb.flatCFH, flatRootKey, concat(v, root...))
+	} else {
+		wb.DeleteCF(pndb.flatCFH, flatRootKey)
+	}
+	if err := pndb.db.Write(pndb.wo, wb); err != nil {
+		return err
+	}
+
+	pndb.flatRoot = concat(root)
+	return nil
+}
+
+// ClearFlat - implement FlatDB interface
+func (pndb *PNodeDB) ClearFlat() error {
+	pndb.flatMutex.Lock()
+	defer pndb.flatMutex.Unlock()
+
+	ro := grocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+	it := pndb.db.NewIteratorCF(ro, pndb.flatCFH)
+	defer it.Close()
+
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := it.Key()
+		wb.DeleteCF(pndb.flatCFH, key.Data())
+		key.Free()
+		if wb.Count() >= BatchSize {
+			if err := pndb.db.Write(pndb.wo, wb); err != nil {
+				return err
+			}
+			wb.Clear()
+		}
+	}
+	if err := pndb.db.Write(pndb.wo, wb); err != nil {
+		return err
+	}
+
+	pndb.flatRoot = nil
+	return nil
+}
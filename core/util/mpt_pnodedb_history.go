@@ -0,0 +1,110 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/linxGnu/grocksdb"
+)
+
+// history entries are keyed by the path followed by the big endian round, the rounds
+// start with zero bytes so the versions of a path sort before the longer paths
+const historyRoundLen = 8
+
+func historyKey(path []byte, round int64) []byte {
+	return concat(path, uint64ToBytes(uint64(round))...)
+}
+
+// historyRoundPrefix - prefix of the entries indexing the paths changed by each round, keyed by the
+// big endian round followed by the path, paths are hex so they never collide with a history entry
+var historyRoundPrefix = []byte("\x00round")
+
+func historyRoundKey(round int64, path []byte) []byte {
+	key := concat(historyRoundPrefix, uint64ToBytes(uint64(round))...)
+	return append(key, path...)
+}
+
+// encodeValueVersion - root length uvarint | root | 1 and the value, or 0 for a delete
+func encodeValueVersion(root Key, value []byte) []byte {
+	buf := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(root)+1+len(value)), uint64(len(root)))
+	buf = append(buf, root...)
+	if value == nil {
+		return append(buf, 0)
+	}
+	buf = append(buf, 1)
+	return append(buf, value...)
+}
+
+func decodeValueVersion(round int64, data []byte) (ValueVersion, error) {
+	n, l := binary.Uvarint(data)
+	if l <= 0 || uint64(len(data)-l) < n+1 {
+		return ValueVersion{}, ErrInvalidEncoding
+	}
+	data = data[l:]
+	vv := ValueVersion{Round: round, Root: concat(data[:n])}
+	if data[n] == 1 {
+		vv.Value = concat(data[n+1:])
+	}
+	return vv, nil
+}
+
+// UpdateHistory - implement HistoryDB interface
+func (pndb *PNodeDB) UpdateHistory(round int64, root Key, changes map[string][]byte) error {
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for p, v := range changes {
+		wb.PutCF(pndb.historyCFH, historyKey([]byte(p), round), encodeValueVersion(root, v))
+		wb.PutCF(pndb.historyCFH, historyRoundKey(round, []byte(p)), nil)
+	}
+	return pndb.db.Write(pndb.wo, wb)
+}
+
+// History - implement HistoryDB interface
+func (pndb *PNodeDB) History(path Path) ([]ValueVersion, error) {
+	var versions []ValueVersion
+	it := pndb.db.NewIteratorCF(pndb.ro, pndb.historyCFH)
+	defer it.Close()
+	for it.Seek(path); it.Valid(); it.Next() {
+		k := it.Key()
+		key := k.Data()
+		if !bytes.HasPrefix(key, path) || len(key) != len(path)+historyRoundLen {
+			k.Free()
+			break
+		}
+		round := int64(bytesToUint64(key[len(path):]))
+		k.Free()
+		v := it.Value()
+		vv, err := decodeValueVersion(round, v.Data())
+		v.Free()
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, vv)
+	}
+	return versions, it.Err()
+}
+
+// deleteHistoryAfter - remove the versions written by the rounds after the round, found from the
+// index of the paths changed by each round
+func (pndb *PNodeDB) deleteHistoryAfter(round int64) error {
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	it := pndb.db.NewIteratorCF(pndb.ro, pndb.historyCFH)
+	defer it.Close()
+	for it.Seek(historyRoundKey(round+1, nil)); it.Valid(); it.Next() {
+		k := it.Key()
+		key := k.Data()
+		if !bytes.HasPrefix(key, historyRoundPrefix) || len(key) < len(historyRoundPrefix)+historyRoundLen {
+			k.Free()
+			break
+		}
+		r := int64(bytesToUint64(key[len(historyRoundPrefix):]))
+		wb.DeleteCF(pndb.historyCFH, historyKey(key[len(historyRoundPrefix)+historyRoundLen:], r))
+		wb.DeleteCF(pndb.historyCFH, concat(key))
+		k.Free()
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return pndb.db.Write(pndb.wo, wb)
+}
@@ -0,0 +1,194 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linxGnu/grocksdb"
+)
+
+// PNodeDBOptions - the tunables of a PNodeDB. The mapstructure tags allow to fill it
+// from the viper config, missing keys keep their defaults:
+//
+//	opts := util.DefaultPNodeDBOptions()
+//	err := viper.UnmarshalKey("storage.state", &opts)
+type PNodeDBOptions struct {
+	// Compression - one of none, snappy, zlib, bz2, lz4, lz4hc, xpress, zstd, empty uses PNodeDBCompression
+	Compression string `mapstructure:"compression"`
+	// SSTType - SSTTypeBlockBasedTable or SSTTypePlainTable
+	SSTType int `mapstructure:"sst_type"`
+	// BlockCacheSizeMB - block cache size of the point lookup optimization
+	BlockCacheSizeMB uint64 `mapstructure:"block_cache_size_mb"`
+	// MemtableMemoryBudget - memtable budget of the universal style compaction
+	MemtableMemoryBudget        uint64 `mapstructure:"memtable_memory_budget"`
+	MaxBackgroundJobs           int    `mapstructure:"max_background_jobs"`
+	MaxWriteBufferNumber        int    `mapstructure:"max_write_buffer_number"`
+	WriteBufferSize             uint64 `mapstructure:"write_buffer_size"`
+	MinWriteBufferNumberToMerge int    `mapstructure:"min_write_buffer_number_to_merge"`
+	// Parallelism - background threads, pruning and saving happen in parallel
+	Parallelism int `mapstructure:"parallelism"`
+	// DeadNodesBlockCacheSize - block cache size of the dead nodes column family, in bytes
+	DeadNodesBlockCacheSize   uint64        `mapstructure:"dead_nodes_block_cache_size"`
+	KeepLogFileNum            uint          `mapstructure:"keep_log_file_num"`
+	DeleteObsoleteFilesPeriod time.Duration `mapstructure:"delete_obsolete_files_period"`
+	EnableStatistics          bool          `mapstructure:"enable_statistics"`
+	// Sync - sync the writes to disk
+	Sync bool `mapstructure:"sync"`
+	// ReverseDiffRounds - number of latest rounds SaveChanges keeps the reverse diffs of, so that
+	// the state can be rewound by as many rounds, 0 disables the reverse diffs
+	ReverseDiffRounds int64 `mapstructure:"reverse_diff_rounds"`
+}
+
+// DefaultPNodeDBOptions - the options NewPNodeDB uses
+func DefaultPNodeDBOptions() PNodeDBOptions {
+	return PNodeDBOptions{
+		SSTType:                     sstType,
+		BlockCacheSizeMB:            64,
+		MemtableMemoryBudget:        64 * 1024 * 1024,
+		MaxBackgroundJobs:           4,                 // default was 2, double to 4
+		MaxWriteBufferNumber:        4,                 // default was 2, double to 4
+		WriteBufferSize:             128 * 1024 * 1024, // default was 64M, double to 128M
+		MinWriteBufferNumberToMerge: 2,                 // default was 1, double to 2
+		Parallelism:                 2,
+		DeadNodesBlockCacheSize:     3 << 30,
+		KeepLogFileNum:              5,
+		DeleteObsoleteFilesPeriod:   10 * time.Minute,
+		EnableStatistics:            true,
+	}
+}
+
+var compressionTypes = map[string]grocksdb.CompressionType{
+	"none":   grocksdb.NoCompression,
+	"snappy": grocksdb.SnappyCompression,
+	"zlib":   grocksdb.ZLibCompression,
+	"bz2":    grocksdb.Bz2Compression,
+	"lz4":    grocksdb.LZ4Compression,
+	"lz4hc":  grocksdb.LZ4HCCompression,
+	"xpress": grocksdb.XpressCompression,
+	"zstd":   grocksdb.ZSTDCompression,
+}
+
+// Validate - checks the options are usable
+func (o *PNodeDBOptions) Validate() error {
+	if _, ok := compressionTypes[strings.ToLower(o.Compression)]; o.Compression != "" && !ok {
+		return fmt.Errorf("invalid pnode db compression: %q", o.Compression)
+	}
+	if o.SSTType != SSTTypeBlockBasedTable && o.SSTType != SSTTypePlainTable {
+		return fmt.Errorf("invalid pnode db sst type: %d", o.SSTType)
+	}
+	if o.MaxWriteBufferNumber < 1 || o.WriteBufferSize == 0 {
+		return errors.New("invalid pnode db write buffer options")
+	}
+	if o.ReverseDiffRounds < 0 {
+		return fmt.Errorf("invalid pnode db reverse diff rounds: %d", o.ReverseDiffRounds)
+	}
+	return nil
+}
+
+func (o *PNodeDBOptions) compression() grocksdb.CompressionType {
+	if ct, ok := compressionTypes[strings.ToLower(o.Compression)]; ok {
+		return ct
+	}
+	return PNodeDBCompression
+}
+
+// Options - returns the options the db was opened with
+func (pndb *PNodeDB) Options() PNodeDBOptions {
+	return pndb.options
+}
+
+// PNodeDBStats - runtime statistics of a PNodeDB
+type PNodeDBStats struct {
+	// from the statistics collected with EnableStatistics
+	BlockCacheHit     uint64 `json:"block_cache_hit"`
+	BlockCacheMiss    uint64 `json:"block_cache_miss"`
+	MemtableHit       uint64 `json:"memtable_hit"`
+	MemtableMiss      uint64 `json:"memtable_miss"`
+	BloomFilterUseful uint64 `json:"bloom_filter_useful"`
+	KeysRead          uint64 `json:"keys_read"`
+	KeysWritten       uint64 `json:"keys_written"`
+	BytesRead         uint64 `json:"bytes_read"`
+	BytesWritten      uint64 `json:"bytes_written"`
+	CompactReadBytes  uint64 `json:"compact_read_bytes"`
+	CompactWriteBytes uint64 `json:"compact_write_bytes"`
+	FlushWriteBytes   uint64 `json:"flush_write_bytes"`
+	StallMicros       uint64 `json:"stall_micros"`
+
+	// from the db properties
+	NumRunningCompactions  uint64 `json:"num_running_compactions"`
+	NumRunningFlushes      uint64 `json:"num_running_flushes"`
+	PendingCompactionBytes uint64 `json:"pending_compaction_bytes"`
+	ActualDelayedWriteRate uint64 `json:"actual_delayed_write_rate"`
+	IsWriteStopped         bool   `json:"is_write_stopped"`
+	BlockCacheUsage        uint64 `json:"block_cache_usage"`
+	EstimateNumKeys        uint64 `json:"estimate_num_keys"`
+	DeadNodesNumKeys       uint64 `json:"dead_nodes_num_keys"`
+
+	// Tickers - all the ticker counters reported by rocksdb
+	Tickers map[string]uint64 `json:"tickers,omitempty"`
+}
+
+// BlockCacheHitRatio - block cache hits over block cache lookups
+func (s *PNodeDBStats) BlockCacheHitRatio() float64 {
+	total := s.BlockCacheHit + s.BlockCacheMiss
+	if total == 0 {
+		return 0
+	}
+	return float64(s.BlockCacheHit) / float64(total)
+}
+
+// Stats - returns the runtime statistics of the db, the ticker counters are
+// only available when the db is opened with EnableStatistics
+func (pndb *PNodeDB) Stats() *PNodeDBStats {
+	s := &PNodeDBStats{}
+	if pndb.options.EnableStatistics {
+		s.Tickers = parseStatisticsTickers(pndb.opts.GetStatisticsString())
+		s.BlockCacheHit = s.Tickers["rocksdb.block.cache.hit"]
+		s.BlockCacheMiss = s.Tickers["rocksdb.block.cache.miss"]
+		s.MemtableHit = s.Tickers["rocksdb.memtable.hit"]
+		s.MemtableMiss = s.Tickers["rocksdb.memtable.miss"]
+		s.BloomFilterUseful = s.Tickers["rocksdb.bloom.filter.useful"]
+		s.KeysRead = s.Tickers["rocksdb.number.keys.read"]
+		s.KeysWritten = s.Tickers["rocksdb.number.keys.written"]
+		s.BytesRead = s.Tickers["rocksdb.bytes.read"]
+		s.BytesWritten = s.Tickers["rocksdb.bytes.written"]
+		s.CompactReadBytes = s.Tickers["rocksdb.compact.read.bytes"]
+		s.CompactWriteBytes = s.Tickers["rocksdb.compact.write.bytes"]
+		s.FlushWriteBytes = s.Tickers["rocksdb.flush.write.bytes"]
+		s.StallMicros = s.Tickers["rocksdb.stall.micros"]
+	}
+
+	s.NumRunningCompactions, _ = pndb.db.GetIntProperty("rocksdb.num-running-compactions")
+	s.NumRunningFlushes, _ = pndb.db.GetIntProperty("rocksdb.num-running-flushes")
+	s.PendingCompactionBytes, _ = pndb.db.GetIntProperty("rocksdb.estimate-pending-compaction-bytes")
+	s.ActualDelayedWriteRate, _ = pndb.db.GetIntProperty("rocksdb.actual-delayed-write-rate")
+	stopped, _ := pndb.db.GetIntProperty("rocksdb.is-write-stopped")
+	s.IsWriteStopped = stopped != 0
+	s.BlockCacheUsage, _ = pndb.db.GetIntProperty("rocksdb.block-cache-usage")
+	s.EstimateNumKeys, _ = pndb.db.GetIntPropertyCF("rocksdb.estimate-num-keys", pndb.defaultCFH)
+	s.DeadNodesNumKeys, _ = pndb.db.GetIntPropertyCF("rocksdb.estimate-num-keys", pndb.deadNodesCFH)
+	return s
+}
+
+// parseStatisticsTickers - parse the ticker lines of the rocksdb statistics dump,
+// in the form of "rocksdb.block.cache.miss COUNT : 10", histograms are skipped
+func parseStatisticsTickers(stats string) map[string]uint64 {
+	tickers := make(map[string]uint64)
+	sc := bufio.NewScanner(strings.NewReader(stats))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 4 || fields[1] != "COUNT" || fields[2] != ":" {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			continue
+		}
+		tickers[fields[0]] = v
+	}
+	return tickers
+}
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/viper"
+)
+
+func TestPNodeDBOptions_Viper(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+state_db:
+  compression: zstd
+  write_buffer_size: 33554432
+  dead_nodes_block_cache_size: 268435456
+  delete_obsolete_files_period: 5m
+`)))
+
+	opts := DefaultPNodeDBOptions()
+	require.NoError(t, v.UnmarshalKey("state_db", &opts))
+	require.NoError(t, opts.Validate())
+
+	require.Equal(t, "zstd", opts.Compression)
+	require.Equal(t, uint64(32*1024*1024), opts.WriteBufferSize)
+	require.Equal(t, uint64(256*1024*1024), opts.DeadNodesBlockCacheSize)
+	require.Equal(t, 5*time.Minute, opts.DeleteObsoleteFilesPeriod)
+	// not configured keys keep the defaults
+	require.Equal(t, 4, opts.MaxWriteBufferNumber)
+	require.True(t, opts.EnableStatistics)
+}
+
+func TestPNodeDBOptions_Validate(t *testing.T) {
+	opts := DefaultPNodeDBOptions()
+	opts.Compression = "gzip"
+	require.Error(t, opts.Validate())
+
+	opts = DefaultPNodeDBOptions()
+	opts.SSTType = 3
+	require.Error(t, opts.Validate())
+
+	opts = DefaultPNodeDBOptions()
+	opts.MaxWriteBufferNumber = 0
+	require.Error(t, opts.Validate())
+
+	dirname, err := os.MkdirTemp("", "mpt-pndb-options")
+	require.NoError(t, err)
+	defer os.RemoveAll(dirname)
+
+	_, err = NewPNodeDBWithOptions(filepath.Join(dirname, "mpt"), filepath.Join(dirname, "log"), opts)
+	require.Error(t, err)
+}
+
+func TestPNodeDB_Stats(t *testing.T) {
+	dirname, err := os.MkdirTemp("", "mpt-pndb-options")
+	require.NoError(t, err)
+	defer os.RemoveAll(dirname)
+
+	opts := DefaultPNodeDBOptions()
+	opts.WriteBufferSize = 16 * 1024 * 1024
+	pndb, err := NewPNodeDBWithOptions(filepath.Join(dirname, "mpt"), filepath.Join(dirname, "log"), opts)
+	require.NoError(t, err)
+	defer pndb.Close()
+
+	require.Equal(t, opts, pndb.Options())
+
+	ln := NewLeafNode(nil, Path("01"), 0, &Txn{"1"})
+	require.NoError(t, pndb.PutNode(ln.GetHashBytes(), ln))
+	_, err = pndb.GetNode(ln.GetHashBytes())
+	require.NoError(t, err)
+
+	stats := pndb.Stats()
+	require.NotNil(t, stats)
+	require.NotNil(t, stats.Tickers)
+}
+
+func TestParseStatisticsTickers(t *testing.T) {
+	stats := `rocksdb.block.cache.miss COUNT : 10
+rocksdb.block.cache.hit COUNT : 30
+rocksdb.stall.micros COUNT : 7
+rocksdb.db.get.micros P50 : 1.000000 P95 : 2.000000 P99 : 3.000000 P100 : 4.000000 COUNT : 5 SUM : 6
+`
+	tickers := parseStatisticsTickers(stats)
+	require.Len(t, tickers, 3)
+	require.Equal(t, uint64(7), tickers["rocksdb.stall.micros"])
+
+	s := &PNodeDBStats{BlockCacheHit: tickers["rocksdb.block.cache.hit"], BlockCacheMiss: tickers["rocksdb.block.cache.miss"]}
+	require.Equal(t, 0.75, s.BlockCacheHitRatio())
+}
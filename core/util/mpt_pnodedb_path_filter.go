@@ -0,0 +1,64 @@
+package util
+
+import (
+	"encoding/binary"
+
+	"github.com/linxGnu/grocksdb"
+)
+
+// pathFilterHeaderKey - key of the header record in the path filter column family,
+// the pages are keyed by their 4 bytes big endian index
+var pathFilterHeaderKey = []byte("\x00header")
+
+// LoadPathFilter - implement PathFilterStore interface
+func (pndb *PNodeDB) LoadPathFilter() (*PathFilter, error) {
+	data, err := pndb.db.GetCF(pndb.ro, pndb.pathFilterCFH, pathFilterHeaderKey)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Free()
+	if !data.Exists() {
+		return nil, nil
+	}
+	pf, err := decodePathFilterHeader(data.Data())
+	if err != nil {
+		return nil, err
+	}
+
+	it := pndb.db.NewIteratorCF(pndb.ro, pndb.pathFilterCFH)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key, value := it.Key(), it.Value()
+		if len(key.Data()) == 4 {
+			err = pf.decodePage(binary.BigEndian.Uint32(key.Data()), value.Data())
+		}
+		key.Free()
+		value.Free()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+// SavePathFilter - implement PathFilterStore interface
+func (pndb *PNodeDB) SavePathFilter(pf *PathFilter) error {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for page := range pf.dirty {
+		wb.PutCF(pndb.pathFilterCFH, binary.BigEndian.AppendUint32(nil, page), pf.encodePage(page))
+	}
+	wb.PutCF(pndb.pathFilterCFH, pathFilterHeaderKey, pf.encodeHeader())
+	if err := pndb.db.Write(pndb.wo, wb); err != nil {
+		return err
+	}
+
+	pf.dirty = make(map[uint32]struct{})
+	return nil
+}
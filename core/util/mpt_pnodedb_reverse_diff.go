@@ -0,0 +1,168 @@
+package util
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/linxGnu/grocksdb"
+
+	"github.com/0chain/common/core/logging"
+	"go.uber.org/zap"
+)
+
+// KeepReverseDiffs - implement ReverseDiffStore interface
+func (pndb *PNodeDB) KeepReverseDiffs() bool {
+	return pndb.options.ReverseDiffRounds > 0
+}
+
+// SaveReverseDiff - implement ReverseDiffStore interface, the diffs of the rounds more
+// than ReverseDiffRounds before the round are removed. A second save of the same round is merged
+// with the first one when it continues from its root.
+func (pndb *PNodeDB) SaveReverseDiff(rd *ReverseDiff) error {
+	pndb.mutex.Lock()
+	defer pndb.mutex.Unlock()
+
+	key := uint64ToBytes(uint64(rd.Round))
+	data, err := pndb.db.GetCF(pndb.ro, pndb.reverseCFH, key)
+	if err != nil {
+		return err
+	}
+	if data.Exists() {
+		prev, err := decodeReverseDiff(rd.Round, data.Data())
+		switch {
+		case err == nil && bytes.Equal(prev.Root, rd.StartRoot):
+			rd = prev.merge(rd)
+		default:
+			logging.Logger.Warn("pnode reverse diff - replace the diff of the round",
+				zap.Int64("round", rd.Round),
+				zap.Error(err))
+		}
+	}
+	data.Free()
+
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	wb.PutCF(pndb.reverseCFH, key, rd.encode())
+
+	oldest := rd.Round - pndb.options.ReverseDiffRounds
+	it := pndb.db.NewIteratorCF(pndb.ro, pndb.reverseCFH)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		k := it.Key()
+		round := int64(bytesToUint64(k.Data()))
+		if round >= oldest {
+			k.Free()
+			break
+		}
+		wb.DeleteCF(pndb.reverseCFH, concat(k.Data()))
+		k.Free()
+	}
+	return pndb.db.Write(pndb.wo, wb)
+}
+
+// RewindTo - implement ReverseDiffStore interface, the diff of the round or of an earlier
+// round must be kept to know its root. The diffs are undone from the latest one, each in its
+// own write batch with the dead nodes record and the registered root of its round, so an
+// interrupted rewind can be resumed. The dead nodes records of the rounds after the round are
+// removed as the nodes are alive again, and so are the value versions they wrote.
+func (pndb *PNodeDB) RewindTo(ctx context.Context, round int64) (Key, error) {
+	pndb.mutex.Lock()
+	defer pndb.mutex.Unlock()
+
+	diffs, base, err := pndb.reverseDiffsAfter(round)
+	if err != nil {
+		return nil, err
+	}
+	if len(diffs) == 0 {
+		return nil, ErrNoReverseDiffs
+	}
+	// the diffs must chain down to the root of the round, kept by the last diff at or before it
+	if base == nil {
+		return nil, ErrReverseDiffGap
+	}
+	for i := 1; i < len(diffs); i++ {
+		if !bytes.Equal(diffs[i-1].StartRoot, diffs[i].Root) {
+			return nil, ErrReverseDiffGap
+		}
+	}
+	if !bytes.Equal(diffs[len(diffs)-1].StartRoot, base.Root) {
+		return nil, ErrReverseDiffGap
+	}
+
+	for _, rd := range diffs {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		if err := pndb.undoReverseDiff(rd); err != nil {
+			return nil, err
+		}
+		logging.Logger.Info("pnode rewind - round undone",
+			zap.Int64("round", rd.Round),
+			zap.String("root", ToHex(rd.StartRoot)))
+	}
+
+	if err := pndb.deleteDeadNodesAfter(round); err != nil {
+		return nil, err
+	}
+	if err := pndb.deleteHistoryAfter(round); err != nil {
+		return nil, err
+	}
+	return diffs[len(diffs)-1].StartRoot, nil
+}
+
+// reverseDiffsAfter - the reverse diffs of the rounds after the round, the latest first,
+// and the last diff at or before the round, nil if none
+func (pndb *PNodeDB) reverseDiffsAfter(round int64) ([]*ReverseDiff, *ReverseDiff, error) {
+	var diffs []*ReverseDiff
+	it := pndb.db.NewIteratorCF(pndb.ro, pndb.reverseCFH)
+	defer it.Close()
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		k, v := it.Key(), it.Value()
+		r := int64(bytesToUint64(k.Data()))
+		rd, err := decodeReverseDiff(r, v.Data())
+		k.Free()
+		v.Free()
+		if err != nil {
+			return nil, nil, err
+		}
+		if r <= round {
+			return diffs, rd, nil
+		}
+		diffs = append(diffs, rd)
+	}
+	return diffs, nil, it.Err()
+}
+
+func (pndb *PNodeDB) undoReverseDiff(rd *ReverseDiff) error {
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for _, k := range rd.Added {
+		wb.Delete(k)
+	}
+	for _, n := range rd.Removed {
+		wb.Put(n.GetHashBytes(), n.Encode())
+	}
+	key := uint64ToBytes(uint64(rd.Round))
+	wb.DeleteCF(pndb.deadNodesCFH, key)
+	wb.DeleteCF(pndb.reverseCFH, key)
+	wb.DeleteCF(pndb.rootsCFH, key)
+	return pndb.db.Write(pndb.wo, wb)
+}
+
+// deleteDeadNodesAfter - remove the dead nodes records of the rounds after the round
+func (pndb *PNodeDB) deleteDeadNodesAfter(round int64) error {
+	var rounds []uint64
+	it := pndb.db.NewIteratorCF(pndb.ro, pndb.deadNodesCFH)
+	for it.Seek(uint64ToBytes(uint64(round + 1))); it.Valid(); it.Next() {
+		k := it.Key()
+		rounds = append(rounds, bytesToUint64(k.Data()))
+		k.Free()
+	}
+	it.Close()
+	if len(rounds) == 0 {
+		return nil
+	}
+	return pndb.multiDeleteDeadNodes(rounds)
+}
@@ -0,0 +1,122 @@
+package util
+
+import (
+	"github.com/linxGnu/grocksdb"
+
+	"github.com/0chain/common/core/logging"
+	"go.uber.org/zap"
+)
+
+// MultiPutNodeWithRoot - implement RootRegistry interface
+func (pndb *PNodeDB) MultiPutNodeWithRoot(keys []Key, nodes []Node, round int64, root Key) error {
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	wb.PutCF(pndb.rootsCFH, uint64ToBytes(uint64(round)), root)
+	return pndb.writeNodes(wb, keys, nodes)
+}
+
+// LatestRoot - implement RootRegistry interface
+func (pndb *PNodeDB) LatestRoot() (int64, Key, error) {
+	it := pndb.db.NewIteratorCF(pndb.ro, pndb.rootsCFH)
+	defer it.Close()
+	it.SeekToLast()
+	if !it.Valid() {
+		if err := it.Err(); err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, ErrRootNotFound
+	}
+	k, v := it.Key(), it.Value()
+	defer k.Free()
+	defer v.Free()
+	return int64(bytesToUint64(k.Data())), concat(v.Data()), nil
+}
+
+// RootAt - implement RootRegistry interface
+func (pndb *PNodeDB) RootAt(round int64) (Key, error) {
+	data, err := pndb.db.GetCF(pndb.ro, pndb.rootsCFH, uint64ToBytes(uint64(round)))
+	if err != nil {
+		return nil, err
+	}
+	defer data.Free()
+	if !data.Exists() {
+		return nil, ErrRootNotFound
+	}
+	return concat(data.Data()), nil
+}
+
+// recoverLatestRoot - drop the latest registered roots whose root node is missing, such as the
+// rounds after a rewind that was interrupted, so the latest root is the highest complete round
+func (pndb *PNodeDB) recoverLatestRoot() error {
+	var dangling [][]byte
+	it := pndb.db.NewIteratorCF(pndb.ro, pndb.rootsCFH)
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		k, v := it.Key(), it.Value()
+		round, root := concat(k.Data()), concat(v.Data())
+		k.Free()
+		v.Free()
+		if len(root) == 0 {
+			break
+		}
+		if _, err := pndb.GetNode(root); err == nil {
+			break
+		} else if err != ErrNodeNotFound {
+			it.Close()
+			return err
+		}
+		dangling = append(dangling, round)
+	}
+	err := it.Err()
+	it.Close()
+	if err != nil || len(dangling) == 0 {
+		return err
+	}
+
+	logging.Logger.Warn("pnode root registry - drop the rounds with missing roots",
+		zap.Uint64("from", bytesToUint64(dangling[len(dangling)-1])),
+		zap.Uint64("to", bytesToUint64(dangling[0])))
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for _, k := range dangling {
+		wb.DeleteCF(pndb.rootsCFH, k)
+	}
+	return pndb.db.Write(pndb.wo, wb)
+}
+
+// pruneRoots - remove the roots registered before the version, their nodes may be pruned. The latest
+// root is always kept. The storage usage of a removed root is removed unless a kept round has the same root.
+func (pndb *PNodeDB) pruneRoots(version int64) error {
+	latest, _, err := pndb.LatestRoot()
+	switch err {
+	case nil:
+	case ErrRootNotFound:
+		return nil
+	default:
+		return err
+	}
+
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	pruned := make(map[string]struct{})
+	it := pndb.db.NewIteratorCF(pndb.ro, pndb.rootsCFH)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		k, v := it.Key(), it.Value()
+		round := int64(bytesToUint64(k.Data()))
+		if round < version && round != latest {
+			wb.DeleteCF(pndb.rootsCFH, concat(k.Data()))
+			pruned[string(v.Data())] = struct{}{}
+		} else {
+			delete(pruned, string(v.Data()))
+		}
+		k.Free()
+		v.Free()
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	for root := range pruned {
+		wb.DeleteCF(pndb.usageCFH, []byte(root))
+	}
+	return pndb.db.Write(pndb.wo, wb)
+}
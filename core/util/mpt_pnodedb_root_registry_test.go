@@ -0,0 +1,123 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func openRootRegistryPNodeDB(t *testing.T, dirname string) *PNodeDB {
+	opts := DefaultPNodeDBOptions()
+	opts.ReverseDiffRounds = 10
+	pndb, err := NewPNodeDBWithOptions(filepath.Join(dirname, "mpt"), filepath.Join(dirname, "log"), opts)
+	require.NoError(t, err)
+	return pndb
+}
+
+func TestPNodeDB_RootRegistry(t *testing.T) {
+	pndb, cleanup := newReverseDiffPNodeDB(t, 10)
+	defer cleanup()
+
+	_, _, err := pndb.LatestRoot()
+	require.Equal(t, ErrRootNotFound, err)
+
+	roots := make(map[int64]Key)
+	var root Key
+	for round := int64(1); round <= 5; round++ {
+		root = saveReverseDiffRound(t, pndb, root, round)
+		roots[round] = root
+	}
+
+	// the nodes of a round written in several batches
+	mpt := NewMerklePatriciaTrie(pndb, Sequence(6), root, statecache.NewEmpty())
+	for i := 0; i < 3*BatchSize; i++ {
+		_, err := mpt.Insert(flatTestPath(1000+i), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, mpt.SaveChanges(context.TODO(), pndb, false))
+	roots[6] = mpt.GetRoot()
+
+	round, latest, err := pndb.LatestRoot()
+	require.NoError(t, err)
+	require.Equal(t, int64(6), round)
+	require.Equal(t, roots[6], latest)
+	for r, root := range roots {
+		got, err := pndb.RootAt(r)
+		require.NoError(t, err)
+		require.Equal(t, root, got)
+	}
+	_, err = pndb.RootAt(7)
+	require.Equal(t, ErrRootNotFound, err)
+
+	// the rewound rounds are not registered anymore
+	require.NoError(t, mpt.RewindTo(context.TODO(), 3))
+	round, latest, err = pndb.LatestRoot()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), round)
+	require.Equal(t, roots[3], latest)
+
+	// the roots before the pruned version are removed, the latest one is kept
+	require.NoError(t, pndb.PruneBelowVersion(context.TODO(), 3))
+	_, err = pndb.RootAt(2)
+	require.Equal(t, ErrRootNotFound, err)
+	require.NoError(t, pndb.PruneBelowVersion(context.TODO(), 10))
+	round, latest, err = pndb.LatestRoot()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), round)
+	require.Equal(t, roots[3], latest)
+}
+
+func TestPNodeDB_PruneRootsUsage(t *testing.T) {
+	pndb, cleanup := newReverseDiffPNodeDB(t, 10)
+	defer cleanup()
+
+	// a root registered again by a later round, such as a round with no changes
+	usage := map[string]StorageUsage{"a": {NodeBytes: 1, ValueBytes: 1}}
+	for round, root := range []string{"root_1", "root_2", "root_1", "root_3"} {
+		require.NoError(t, pndb.MultiPutNodeWithRoot(nil, nil, int64(round+1), Key(root)))
+		require.NoError(t, pndb.SaveUsage(Key(root), usage))
+	}
+
+	require.NoError(t, pndb.pruneRoots(3))
+	for root, kept := range map[string]bool{"root_1": true, "root_2": false, "root_3": true} {
+		got, err := pndb.Usage(Key(root))
+		require.NoError(t, err)
+		if kept {
+			require.Equal(t, usage, got, root)
+		} else {
+			require.Empty(t, got, root)
+		}
+	}
+}
+
+func TestPNodeDB_RootRegistryRecovery(t *testing.T) {
+	dirname, err := os.MkdirTemp("", "mpt-pndb-roots")
+	require.NoError(t, err)
+	defer os.RemoveAll(dirname)
+
+	pndb := openRootRegistryPNodeDB(t, dirname)
+	var root Key
+	for round := int64(1); round <= 3; round++ {
+		root = saveReverseDiffRound(t, pndb, root, round)
+	}
+	// the rounds registered with a root whose nodes are lost
+	require.NoError(t, pndb.MultiPutNodeWithRoot(nil, nil, 4, Key("missing_4")))
+	require.NoError(t, pndb.MultiPutNodeWithRoot(nil, nil, 5, Key("missing_5")))
+	pndb.Flush()
+	pndb.Close()
+
+	pndb = openRootRegistryPNodeDB(t, dirname)
+	defer pndb.Close()
+	round, latest, err := pndb.LatestRoot()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), round)
+	require.Equal(t, root, latest)
+	_, err = pndb.RootAt(4)
+	require.Equal(t, ErrRootNotFound, err)
+}
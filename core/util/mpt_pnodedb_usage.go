@@ -0,0 +1,19 @@
+package util
+
+// SaveUsage - implement UsageDB interface
+func (pndb *PNodeDB) SaveUsage(root Key, usage map[string]StorageUsage) error {
+	return pndb.db.PutCF(pndb.wo, pndb.usageCFH, root, encodeUsage(usage))
+}
+
+// Usage - implement UsageDB interface
+func (pndb *PNodeDB) Usage(root Key) (map[string]StorageUsage, error) {
+	data, err := pndb.db.GetCF(pndb.ro, pndb.usageCFH, root)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Free()
+	if !data.Exists() {
+		return map[string]StorageUsage{}, nil
+	}
+	return decodeUsage(data.Data())
+}
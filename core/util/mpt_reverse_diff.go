@@ -0,0 +1,250 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/0chain/common/core/logging"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrInvalidReverseDiff - the encoded reverse diff can't be decoded
+	ErrInvalidReverseDiff = errors.New("invalid reverse diff")
+	// ErrNoReverseDiffs - there are no reverse diffs after the round to rewind to
+	ErrNoReverseDiffs = errors.New("no reverse diffs to rewind")
+	// ErrReverseDiffGap - the reverse diffs don't chain from the latest root to the round to rewind to
+	ErrReverseDiffGap = errors.New("reverse diffs are not contiguous")
+	// ErrReverseDiffsNotSupported - the node db doesn't keep reverse diffs
+	ErrReverseDiffsNotSupported = errors.New("node db doesn't keep reverse diffs")
+)
+
+const reverseDiffEncodingVersion = 1
+
+// ReverseDiff - the inverse of the node changes saved for a round. Undoing it deletes the added
+// nodes and puts back the removed ones, which moves the state from Root back to StartRoot.
+// The added nodes are created with the round as origin, so no other round shares them.
+type ReverseDiff struct {
+	Round     int64
+	StartRoot Key
+	Root      Key
+	Added     []Key
+	Removed   []Node
+}
+
+// ReverseDiffStore - a node db that can persist the reverse diffs of the saved rounds
+type ReverseDiffStore interface {
+	// KeepReverseDiffs - true if the reverse diffs are kept
+	KeepReverseDiffs() bool
+	// SaveReverseDiff - persist the reverse diff of a round, before the nodes of the round are written
+	SaveReverseDiff(rd *ReverseDiff) error
+	// RewindTo - undo the reverse diffs of the rounds after the round, returns the root at the round
+	RewindTo(ctx context.Context, round int64) (Key, error)
+}
+
+// NewReverseDiff - the reverse diff of the collected changes moving the state from the start root to the root
+func NewReverseDiff(cc ChangeCollectorI, root Key, round int64) *ReverseDiff {
+	changes := cc.GetChanges()
+	rd := &ReverseDiff{
+		Round:     round,
+		StartRoot: concat(cc.GetStartRoot()),
+		Root:      concat(root),
+		Added:     make([]Key, 0, len(changes)),
+		Removed:   cc.GetDeletes(),
+	}
+	for _, c := range changes {
+		rd.Added = append(rd.Added, c.New.GetHashBytes())
+	}
+	return rd
+}
+
+// merge - the diff of saving rd and then next in the same round
+func (rd *ReverseDiff) merge(next *ReverseDiff) *ReverseDiff {
+	added := make(map[string]struct{}, len(rd.Added))
+	for _, k := range rd.Added {
+		added[string(k)] = struct{}{}
+	}
+	merged := &ReverseDiff{
+		Round:     rd.Round,
+		StartRoot: rd.StartRoot,
+		Root:      next.Root,
+		Added:     append(concatKeys(rd.Added), next.Added...),
+		Removed:   append([]Node{}, rd.Removed...),
+	}
+	for _, n := range next.Removed {
+		// the nodes added by the first save don't need to be restored
+		if _, ok := added[string(n.GetHashBytes())]; !ok {
+			merged.Removed = append(merged.Removed, n)
+		}
+	}
+	return merged
+}
+
+func concatKeys(keys []Key) []Key {
+	return append(make([]Key, 0, len(keys)), keys...)
+}
+
+// encode - version, start root, root, the added keys and the encoded removed nodes
+func (rd *ReverseDiff) encode() []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(reverseDiffEncodingVersion)
+	writeReverseDiffBytes(buf, rd.StartRoot)
+	writeReverseDiffBytes(buf, rd.Root)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(rd.Added))))
+	for _, k := range rd.Added {
+		writeReverseDiffBytes(buf, k)
+	}
+	buf.Write(binary.AppendUvarint(nil, uint64(len(rd.Removed))))
+	for _, n := range rd.Removed {
+		writeReverseDiffBytes(buf, n.Encode())
+	}
+	return buf.Bytes()
+}
+
+func writeReverseDiffBytes(buf *bytes.Buffer, b []byte) {
+	buf.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	buf.Write(b)
+}
+
+func decodeReverseDiff(round int64, data []byte) (*ReverseDiff, error) {
+	r := bytes.NewReader(data)
+	if v, err := r.ReadByte(); err != nil || v != reverseDiffEncodingVersion {
+		return nil, ErrInvalidReverseDiff
+	}
+	rd := &ReverseDiff{Round: round}
+	var err error
+	if rd.StartRoot, err = readReverseDiffBytes(r); err != nil {
+		return nil, err
+	}
+	if rd.Root, err = readReverseDiffBytes(r); err != nil {
+		return nil, err
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, ErrInvalidReverseDiff
+	}
+	rd.Added = make([]Key, 0, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := readReverseDiffBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		rd.Added = append(rd.Added, k)
+	}
+
+	if n, err = binary.ReadUvarint(r); err != nil || n > uint64(r.Len()) {
+		return nil, ErrInvalidReverseDiff
+	}
+	rd.Removed = make([]Node, 0, n)
+	for i := uint64(0); i < n; i++ {
+		b, err := readReverseDiffBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		node, err := decodeNode(b)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidReverseDiff, err)
+		}
+		rd.Removed = append(rd.Removed, node)
+	}
+	if r.Len() != 0 {
+		return nil, ErrInvalidReverseDiff
+	}
+	return rd, nil
+}
+
+func readReverseDiffBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, ErrInvalidReverseDiff
+	}
+	b := make([]byte, n)
+	_, _ = r.Read(b)
+	return b, nil
+}
+
+// saveReverseDiff - persist the reverse diff of the collected changes when the node db keeps them
+func (mpt *MerklePatriciaTrie) saveReverseDiff(cc ChangeCollectorI, ndb NodeDB) error {
+	store, ok := ndb.(ReverseDiffStore)
+	if !ok || !store.KeepReverseDiffs() {
+		return nil
+	}
+	if err := store.SaveReverseDiff(NewReverseDiff(cc, mpt.root, int64(mpt.Version))); err != nil {
+		logging.Logger.Error("MPT save reverse diff failed",
+			zap.Int64("round", int64(mpt.Version)),
+			zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// reverseDiffStore - the node db keeping the reverse diffs, the node db itself or the persistent node db
+// under its levels
+func reverseDiffStore(ndb NodeDB) (ReverseDiffStore, bool) {
+	for {
+		if store, ok := ndb.(ReverseDiffStore); ok {
+			return store, true
+		}
+		lndb, ok := ndb.(*LevelNodeDB)
+		if !ok {
+			return nil, false
+		}
+		ndb = lndb.GetPrev()
+	}
+}
+
+// RewindTo - rewind the node db of the trie to the state of the round and move the trie to its root.
+// The node db is the one keeping the reverse diffs, such as the PNodeDB under the levels of a LevelNodeDB.
+// The changes not saved are discarded. The flat db and the path filter of the trie are rebuilt at the
+// root, they are dropped from the trie if the rebuild fails. Fails with ErrObserved if the trie has observers.
+func (mpt *MerklePatriciaTrie) RewindTo(ctx context.Context, round int64) error {
+	mpt.mutex.Lock()
+	if len(mpt.observers) > 0 {
+		mpt.mutex.Unlock()
+		return ErrObserved
+	}
+	store, ok := reverseDiffStore(mpt.db)
+	if !ok {
+		mpt.mutex.Unlock()
+		return ErrReverseDiffsNotSupported
+	}
+	root, err := store.RewindTo(ctx, round)
+	if err != nil {
+		mpt.mutex.Unlock()
+		return err
+	}
+	mpt.setRoot(root)
+	mpt.ChangeCollector = NewChangeCollector(root)
+	mpt.dirtyPaths = nil
+	mpt.dirtyAll = false
+	mpt.SetVersion(Sequence(round))
+	fdb, pf := mpt.flat, mpt.pathFilter
+	mpt.mutex.Unlock()
+
+	// the indexes are at the root of the bad fork, they are not used for the reads until rebuilt
+	if fdb != nil {
+		if err := RebuildFlatDB(ctx, fdb, mpt); err != nil {
+			mpt.mutex.Lock()
+			if mpt.flat == fdb {
+				mpt.dropFlat(err)
+			}
+			mpt.mutex.Unlock()
+			return err
+		}
+	}
+	if pf != nil {
+		if err := RebuildPathFilter(ctx, pf, mpt); err != nil {
+			mpt.mutex.Lock()
+			if mpt.pathFilter == pf {
+				mpt.dropPathFilter(err)
+			}
+			mpt.mutex.Unlock()
+			return err
+		}
+	}
+	return nil
+}
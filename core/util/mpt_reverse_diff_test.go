@@ -0,0 +1,209 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func newReverseDiffPNodeDB(t *testing.T, rounds int64) (*PNodeDB, func()) {
+	dirname, err := ioutil.TempDir("", "mpt-pndb")
+	require.NoError(t, err)
+	opts := DefaultPNodeDBOptions()
+	opts.ReverseDiffRounds = rounds
+	pndb, err := NewPNodeDBWithOptions(filepath.Join(dirname, "mpt"), filepath.Join(dirname, "log"), opts)
+	require.NoError(t, err)
+	return pndb, func() {
+		pndb.Flush()
+		pndb.Close()
+		require.NoError(t, os.RemoveAll(dirname))
+	}
+}
+
+// saveReverseDiffRound - insert the values in round 1, then change some values of the round and save the changes, deleting the old nodes
+func saveReverseDiffRound(t *testing.T, pndb *PNodeDB, root Key, round int64) Key {
+	mpt := NewMerklePatriciaTrie(pndb, Sequence(round), root, statecache.NewEmpty())
+	for i := 0; i < 100; i++ {
+		if round > 1 && i%10 != int(round%10) {
+			continue
+		}
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("value_%d_%d", i, round)})
+		require.NoError(t, err)
+	}
+	if round > 1 {
+		_, err := mpt.Delete(flatTestPath(int(round)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, mpt.SaveChanges(context.TODO(), pndb, true))
+	require.NoError(t, pndb.RecordDeadNodes(mpt.GetDeletes(), round))
+	return mpt.GetRoot()
+}
+
+func TestPNodeDB_RewindTo(t *testing.T) {
+	pndb, cleanup := newReverseDiffPNodeDB(t, 10)
+	defer cleanup()
+
+	var (
+		roots = make(map[int64]Key)
+		sizes = make(map[int64]int64)
+		root  Key
+	)
+	for round := int64(1); round <= 5; round++ {
+		root = saveReverseDiffRound(t, pndb, root, round)
+		roots[round] = root
+		sizes[round] = pndb.Size(context.TODO())
+	}
+
+	mpt := NewMerklePatriciaTrie(pndb, Sequence(5), root, statecache.NewEmpty())
+	require.NoError(t, mpt.RewindTo(context.TODO(), 2))
+	require.Equal(t, roots[2], mpt.GetRoot())
+	require.Equal(t, Sequence(2), mpt.GetVersion())
+	require.Equal(t, 0, mpt.GetChangeCount())
+	require.NoError(t, mpt.Validate())
+	require.Equal(t, sizes[2], pndb.Size(context.TODO()))
+
+	// the state of round 2 is complete, path 2 is deleted in round 2
+	for i := 0; i < 100; i++ {
+		_, err := mpt.GetNodeValueRaw(flatTestPath(i))
+		if i == 2 {
+			require.Equal(t, ErrValueNotPresent, err)
+			continue
+		}
+		require.NoError(t, err, i)
+	}
+	missing, err := mpt.HasMissingNodes(context.TODO())
+	require.NoError(t, err)
+	require.False(t, missing)
+
+	// the dead nodes of the undone rounds are not pruned
+	require.NoError(t, pndb.PruneBelowVersion(context.TODO(), 6))
+	require.NoError(t, NewMerklePatriciaTrie(pndb, Sequence(2), roots[2], statecache.NewEmpty()).Validate())
+
+	require.Equal(t, ErrNoReverseDiffs, mpt.RewindTo(context.TODO(), 2))
+
+	// the state moves on from the rewound round
+	root = saveReverseDiffRound(t, pndb, roots[2], 3)
+	require.Equal(t, roots[3], root)
+	_, err = pndb.RewindTo(context.TODO(), 0)
+	require.Equal(t, ErrReverseDiffGap, err)
+}
+
+func TestMerklePatriciaTrie_RewindToLevelNodeDB(t *testing.T) {
+	pndb, cleanup := newReverseDiffPNodeDB(t, 10)
+	defer cleanup()
+
+	roots := make(map[int64]Key)
+	var root Key
+	for round := int64(1); round <= 3; round++ {
+		root = saveReverseDiffRound(t, pndb, root, round)
+		roots[round] = root
+	}
+
+	// the trie of a round over the persistent node db, with changes not saved
+	lndb := NewLevelNodeDB(NewMemoryNodeDB(), NewLevelNodeDB(NewMemoryNodeDB(), pndb, false), false)
+	mpt := NewMerklePatriciaTrie(lndb, Sequence(4), root, statecache.NewEmpty())
+	_, err := mpt.Insert(flatTestPath(200), &Txn{"200"})
+	require.NoError(t, err)
+
+	require.NoError(t, mpt.RewindTo(context.TODO(), 1))
+	require.Equal(t, roots[1], mpt.GetRoot())
+	require.Equal(t, 0, mpt.GetChangeCount())
+	require.NoError(t, mpt.Validate())
+	round, latest, err := pndb.LatestRoot()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), round)
+	require.Equal(t, roots[1], latest)
+
+	// no reverse diffs under the levels
+	mpt = NewMerklePatriciaTrie(NewLevelNodeDB(NewMemoryNodeDB(), NewMemoryNodeDB(), false), Sequence(1), nil, statecache.NewEmpty())
+	require.Equal(t, ErrReverseDiffsNotSupported, mpt.RewindTo(context.TODO(), 0))
+}
+
+func TestMerklePatriciaTrie_RewindToIndexes(t *testing.T) {
+	pndb, cleanup := newReverseDiffPNodeDB(t, 10)
+	defer cleanup()
+
+	var root Key
+	for round := int64(1); round <= 4; round++ {
+		root = saveReverseDiffRound(t, pndb, root, round)
+	}
+
+	// the indexes are at the root of the round 4
+	mpt := NewMerklePatriciaTrie(pndb, Sequence(4), root, statecache.NewEmpty())
+	fdb := NewMemoryFlatDB()
+	require.NoError(t, RebuildFlatDB(context.TODO(), fdb, mpt))
+	pf := NewPathFilter(100, 0.01)
+	require.NoError(t, RebuildPathFilter(context.TODO(), pf, mpt))
+	mpt.SetFlatDB(fdb)
+	mpt.SetPathFilter(pf)
+
+	require.NoError(t, mpt.RewindTo(context.TODO(), 2))
+	require.Equal(t, mpt.GetRoot(), fdb.GetFlatRoot())
+	require.Equal(t, mpt.GetRoot(), pf.GetRoot())
+	requireFlatMatchesTrie(t, fdb, fdb.Size, mpt)
+
+	// and kept up to date by the next rounds
+	mpt.SetVersion(3)
+	_, err := mpt.Insert(flatTestPath(200), &Txn{"200"})
+	require.NoError(t, err)
+	require.NoError(t, mpt.SaveChanges(context.TODO(), pndb, false))
+	require.Equal(t, fdb, mpt.GetFlatDB())
+	require.Equal(t, pf, mpt.GetPathFilter())
+	require.Equal(t, mpt.GetRoot(), pf.GetRoot())
+	requireFlatMatchesTrie(t, fdb, fdb.Size, mpt)
+}
+
+func TestPNodeDB_ReverseDiffRetention(t *testing.T) {
+	pndb, cleanup := newReverseDiffPNodeDB(t, 2)
+	defer cleanup()
+
+	var root Key
+	roots := make(map[int64]Key)
+	for round := int64(1); round <= 6; round++ {
+		root = saveReverseDiffRound(t, pndb, root, round)
+		roots[round] = root
+	}
+
+	_, err := pndb.RewindTo(context.TODO(), 3)
+	require.Equal(t, ErrReverseDiffGap, err)
+	got, err := pndb.RewindTo(context.TODO(), 4)
+	require.NoError(t, err)
+	require.Equal(t, roots[4], got)
+}
+
+func TestReverseDiff_Encoding(t *testing.T) {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	for i := 0; i < 20; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, mpt.SaveChanges(context.TODO(), mpt.GetNodeDB(), false))
+	mpt2 := NewMerklePatriciaTrie(mpt.GetNodeDB(), Sequence(2), mpt.GetRoot(), statecache.NewEmpty())
+	_, err := mpt2.Insert(flatTestPath(1), &Txn{"changed"})
+	require.NoError(t, err)
+
+	rd := NewReverseDiff(mpt2.ChangeCollector, mpt2.GetRoot(), 2)
+	require.NotEmpty(t, rd.Added)
+	require.NotEmpty(t, rd.Removed)
+
+	drd, err := decodeReverseDiff(2, rd.encode())
+	require.NoError(t, err)
+	require.Equal(t, rd.StartRoot, drd.StartRoot)
+	require.Equal(t, rd.Root, drd.Root)
+	require.Equal(t, rd.Added, drd.Added)
+	require.Equal(t, len(rd.Removed), len(drd.Removed))
+	for i := range rd.Removed {
+		require.Equal(t, rd.Removed[i].Encode(), drd.Removed[i].Encode())
+	}
+
+	enc := rd.encode()
+	_, err = decodeReverseDiff(2, enc[:len(enc)-1])
+	require.Error(t, err)
+}
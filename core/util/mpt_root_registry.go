@@ -0,0 +1,37 @@
+package util
+
+import "errors"
+
+// ErrRootNotFound - no root is registered for the round
+var ErrRootNotFound = errors.New("root not registered")
+
+// RootRegistry - a node db registering the root committed by each round in the same write
+// batch as the last nodes of the round, so a registered root always has all its nodes
+type RootRegistry interface {
+	// MultiPutNodeWithRoot - write the nodes and register the root of the round atomically
+	MultiPutNodeWithRoot(keys []Key, nodes []Node, round int64, root Key) error
+	// LatestRoot - the highest round registered with its root, ErrRootNotFound if none
+	LatestRoot() (int64, Key, error)
+	// RootAt - the root registered by the round, ErrRootNotFound if none
+	RootAt(round int64) (Key, error)
+}
+
+// rootCommit - unsafe, the root of the trie to register for its version, nil for a sub trie
+// as its root is committed by its parent
+func (mpt *MerklePatriciaTrie) rootCommit() *rootCommit {
+	if mpt.subPrefix != nil {
+		return nil
+	}
+	return &rootCommit{round: int64(mpt.Version), root: mpt.root}
+}
+
+// updateChanges - write the collected changes of the version, registering the root with the last
+// nodes when the node db is a root registry and the root is given
+func updateChanges(cc ChangeCollectorI, ndb NodeDB, version Sequence, includeDeletes bool, rc *rootCommit) error {
+	_, ok := ndb.(RootRegistry)
+	ccImpl, isImpl := cc.(*ChangeCollector)
+	if !ok || !isImpl || rc == nil {
+		return cc.UpdateChanges(ndb, version, includeDeletes)
+	}
+	return ccImpl.updateChanges(ndb, includeDeletes, rc)
+}
@@ -0,0 +1,294 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/0chain/common/core/logging"
+	"go.uber.org/zap"
+)
+
+// ErrQuarantineNotSupported - the node db can't quarantine entries
+var ErrQuarantineNotSupported = errors.New("node db does not support quarantine")
+
+// scrub issue reasons
+const (
+	ScrubReasonDecode       = "decode"
+	ScrubReasonHashMismatch = "hash_mismatch"
+	ScrubReasonUnreachable  = "unreachable"
+	ScrubReasonMissing      = "missing"
+)
+
+// Quarantiner - a node db that can move bad entries aside instead of deleting them
+type Quarantiner interface {
+	Quarantine(keys []Key) error
+}
+
+// rawNodeIterator - a node db that can iterate its entries without decoding them
+type rawNodeIterator interface {
+	iterateRaw(ctx context.Context, handler func(key, value []byte) error) error
+}
+
+// ScrubOptions - options of the node db scrubber
+type ScrubOptions struct {
+	// Rate - the maximum number of entries read per second by the live node walk and the
+	// check of the entries together, 0 means unlimited
+	Rate int
+	// LiveRoots - when set, the entries that are not reachable from any of the roots are reported,
+	// the nodes of the sub tries referenced by the values are reachable
+	LiveRoots []Key
+	// Quarantine - quarantine the corrupted entries
+	Quarantine bool
+	// QuarantineUnreachable - quarantine the unreachable entries too, requires LiveRoots
+	QuarantineUnreachable bool
+}
+
+// ScrubIssue - a bad entry found by the scrubber
+type ScrubIssue struct {
+	Key    Key    `json:"k"`
+	Reason string `json:"r"`
+	Error  string `json:"e,omitempty"`
+}
+
+// MarshalJSON - encode the key as hex
+func (si ScrubIssue) MarshalJSON() ([]byte, error) {
+	type issue ScrubIssue
+	return json.Marshal(struct {
+		Key string `json:"k"`
+		issue
+	}{Key: ToHex(si.Key), issue: issue(si)})
+}
+
+// ScrubReport - the result of a scrub run
+type ScrubReport struct {
+	Scanned     int64         `json:"scanned"`
+	Reachable   int64         `json:"reachable"`
+	Corrupted   []ScrubIssue  `json:"corrupted"`
+	Unreachable []ScrubIssue  `json:"unreachable"`
+	Missing     []ScrubIssue  `json:"missing"`
+	Quarantined int64         `json:"quarantined"`
+	Duration    time.Duration `json:"duration"`
+}
+
+// reads - the number of entries read so far
+func (sr *ScrubReport) reads() int64 {
+	return sr.Reachable + int64(len(sr.Missing)) + sr.Scanned
+}
+
+// Write - write the report as json
+func (sr *ScrubReport) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sr)
+}
+
+// Scrubber - walks a node db and checks the integrity of the stored nodes
+type Scrubber struct {
+	ndb  NodeDB
+	opts ScrubOptions
+}
+
+// NewScrubber - create a new scrubber for the node db
+func NewScrubber(ndb NodeDB, opts ScrubOptions) *Scrubber {
+	return &Scrubber{ndb: ndb, opts: opts}
+}
+
+// ScrubResult - the result of a background scrub run
+type ScrubResult struct {
+	Report *ScrubReport
+	Err    error
+}
+
+// Start - run the scrubber in background, the result is sent to the returned channel
+func (s *Scrubber) Start(ctx context.Context) <-chan ScrubResult {
+	resultC := make(chan ScrubResult, 1)
+	go func() {
+		report, err := s.Run(ctx)
+		resultC <- ScrubResult{Report: report, Err: err}
+		close(resultC)
+	}()
+	return resultC
+}
+
+// Run - run the scrubber and return the report
+func (s *Scrubber) Run(ctx context.Context) (*ScrubReport, error) {
+	var quarantiner Quarantiner
+	if s.opts.Quarantine || s.opts.QuarantineUnreachable {
+		q, ok := s.ndb.(Quarantiner)
+		if !ok {
+			return nil, ErrQuarantineNotSupported
+		}
+		quarantiner = q
+	}
+
+	var (
+		ts     = time.Now()
+		report = &ScrubReport{}
+	)
+
+	var live map[StrKey]struct{}
+	if len(s.opts.LiveRoots) > 0 {
+		var err error
+		live, err = s.markLive(ctx, ts, report)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	check := func(key, value []byte) error {
+		report.Scanned++
+		if err := s.throttle(ctx, ts, report.reads()); err != nil {
+			return err
+		}
+
+		node, err := decodeScrubNode(value)
+		if err != nil {
+			report.Corrupted = append(report.Corrupted, ScrubIssue{
+				Key:    concat(key),
+				Reason: ScrubReasonDecode,
+				Error:  err.Error(),
+			})
+			return nil
+		}
+		if !bytes.Equal(node.GetHashBytes(), key) {
+			report.Corrupted = append(report.Corrupted, ScrubIssue{
+				Key:    concat(key),
+				Reason: ScrubReasonHashMismatch,
+			})
+			return nil
+		}
+		if live != nil {
+			if _, ok := live[StrKey(key)]; !ok {
+				report.Unreachable = append(report.Unreachable, ScrubIssue{
+					Key:    concat(key),
+					Reason: ScrubReasonUnreachable,
+				})
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if rndb, ok := s.ndb.(rawNodeIterator); ok {
+		err = rndb.iterateRaw(ctx, check)
+	} else {
+		err = s.ndb.Iterate(ctx, func(ctx context.Context, key Key, node Node) error {
+			return check(key, node.Encode())
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if quarantiner != nil {
+		var keys []Key
+		if s.opts.Quarantine {
+			for _, issue := range report.Corrupted {
+				keys = append(keys, issue.Key)
+			}
+		}
+		if s.opts.QuarantineUnreachable {
+			for _, issue := range report.Unreachable {
+				keys = append(keys, issue.Key)
+			}
+		}
+		if len(keys) > 0 {
+			if err := quarantiner.Quarantine(keys); err != nil {
+				return nil, err
+			}
+			report.Quarantined = int64(len(keys))
+		}
+	}
+
+	report.Duration = time.Since(ts)
+	logging.Logger.Info("scrub node db",
+		zap.Int64("scanned", report.Scanned),
+		zap.Int("corrupted", len(report.Corrupted)),
+		zap.Int("unreachable", len(report.Unreachable)),
+		zap.Int("missing", len(report.Missing)),
+		zap.Int64("quarantined", report.Quarantined),
+		zap.Duration("duration", report.Duration))
+	return report, nil
+}
+
+// decodeScrubNode - decode a stored node, DecodeNode panics on unknown node types
+func decodeScrubNode(value []byte) (node Node, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decode node: %v", r)
+		}
+	}()
+	return DecodeNode(value)
+}
+
+// markLive - collect the keys of all the nodes reachable from the live roots, including the nodes
+// of the sub tries referenced by their values
+func (s *Scrubber) markLive(ctx context.Context, start time.Time, report *ScrubReport) (map[StrKey]struct{}, error) {
+	live := make(map[StrKey]struct{})
+	var walk func(key Key) error
+	walk = func(key Key) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if _, ok := live[StrKey(key)]; ok {
+			return nil
+		}
+		node, err := s.ndb.GetNode(key)
+		if err != nil {
+			report.Missing = append(report.Missing, ScrubIssue{
+				Key:    concat(key),
+				Reason: ScrubReasonMissing,
+				Error:  err.Error(),
+			})
+			return s.throttle(ctx, start, report.reads())
+		}
+		live[StrKey(key)] = struct{}{}
+		report.Reachable++
+		if err := s.throttle(ctx, start, report.reads()); err != nil {
+			return err
+		}
+
+		for _, ckey := range nodeRefs(node) {
+			if err := walk(ckey); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, root := range s.opts.LiveRoots {
+		if len(root) == 0 {
+			continue
+		}
+		if err := walk(root); err != nil {
+			return nil, err
+		}
+	}
+	return live, nil
+}
+
+// throttle - sleeps when the scrubber runs faster than the configured rate
+func (s *Scrubber) throttle(ctx context.Context, start time.Time, scanned int64) error {
+	if s.opts.Rate <= 0 {
+		return nil
+	}
+	expected := time.Duration(scanned) * time.Second / time.Duration(s.opts.Rate)
+	wait := expected - time.Since(start)
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
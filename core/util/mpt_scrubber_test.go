@@ -0,0 +1,128 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func TestScrubber_MemoryNodeDB(t *testing.T) {
+	mndb := NewMemoryNodeDB()
+	mpt := NewMerklePatriciaTrie(mndb, Sequence(0), nil, statecache.NewEmpty())
+	doStrValInsert(t, mpt, "1234", "1")
+	doStrValInsert(t, mpt, "123567", "2")
+	doStrValInsert(t, mpt, "223671", "3")
+
+	// a node stored under a wrong key
+	badKey := Key(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, mndb.PutNode(badKey, NewLeafNode(nil, Path("01"), 0, &Txn{"bad"})))
+
+	// a valid node that is not part of the trie
+	leaked := NewLeafNode(nil, Path("02"), 0, &Txn{"leaked"})
+	require.NoError(t, mndb.PutNode(leaked.GetHashBytes(), leaked))
+
+	report, err := NewScrubber(mndb, ScrubOptions{LiveRoots: []Key{mpt.GetRoot()}}).Run(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, int64(len(mndb.Nodes)), report.Scanned)
+	require.Len(t, report.Corrupted, 1)
+	require.Equal(t, badKey, report.Corrupted[0].Key)
+	require.Equal(t, ScrubReasonHashMismatch, report.Corrupted[0].Reason)
+	require.Len(t, report.Unreachable, 1)
+	require.Equal(t, Key(leaked.GetHashBytes()), report.Unreachable[0].Key)
+	require.Empty(t, report.Missing)
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, report.Write(buf))
+	require.Contains(t, buf.String(), ToHex(badKey))
+
+	_, err = NewScrubber(mndb, ScrubOptions{Quarantine: true}).Run(context.TODO())
+	require.Equal(t, ErrQuarantineNotSupported, err)
+}
+
+func TestScrubber_Rate(t *testing.T) {
+	mndb := NewMemoryNodeDB()
+	mpt := NewMerklePatriciaTrie(mndb, Sequence(0), nil, statecache.NewEmpty())
+	doStrValInsert(t, mpt, "1234", "1")
+	doStrValInsert(t, mpt, "123567", "2")
+	doStrValInsert(t, mpt, "223671", "3")
+
+	// the reads of the live node walk are limited too
+	rate := 100
+	report, err := NewScrubber(mndb, ScrubOptions{Rate: rate, LiveRoots: []Key{mpt.GetRoot()}}).Run(context.TODO())
+	require.NoError(t, err)
+	require.NotZero(t, report.Reachable)
+	reads := report.Reachable + report.Scanned
+	require.GreaterOrEqual(t, report.Duration, time.Duration(reads-1)*time.Second/time.Duration(rate))
+}
+
+func TestScrubber_PNodeDBQuarantine(t *testing.T) {
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+
+	mpt := NewMerklePatriciaTrie(pndb, Sequence(0), nil, statecache.NewEmpty())
+	doStrValInsert(t, mpt, "1234", "1")
+	doStrValInsert(t, mpt, "123567", "2")
+
+	badKey := Key(bytes.Repeat([]byte{2}, 32))
+	require.NoError(t, pndb.db.Put(pndb.wo, badKey, []byte{0xff, 1, 2, 3}))
+
+	report, err := NewScrubber(pndb, ScrubOptions{
+		LiveRoots:  []Key{mpt.GetRoot()},
+		Quarantine: true,
+	}).Run(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, report.Corrupted, 1)
+	require.Equal(t, ScrubReasonDecode, report.Corrupted[0].Reason)
+	require.Empty(t, report.Unreachable)
+	require.Equal(t, int64(1), report.Quarantined)
+
+	_, err = pndb.GetNode(badKey)
+	require.Equal(t, ErrNodeNotFound, err)
+
+	var quarantined []Key
+	err = pndb.IterateQuarantine(context.TODO(), func(key Key, value []byte) error {
+		quarantined = append(quarantined, concat(key))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []Key{badKey}, quarantined)
+
+	// the trie is still intact
+	doGetStrValue(t, mpt, "1234", "1")
+}
+
+func TestScrubber_SubTries(t *testing.T) {
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+
+	mpt, accounts, storage := newSubTrieTestMPT(t, pndb)
+	report, err := NewScrubber(pndb, ScrubOptions{
+		LiveRoots:             []Key{mpt.GetRoot()},
+		QuarantineUnreachable: true,
+	}).Run(context.TODO())
+	require.NoError(t, err)
+	// the nodes of the sub tries are live
+	for _, a := range accounts {
+		for key := range subTrieNodeKeys(t, mpt, a) {
+			for _, issue := range report.Unreachable {
+				require.NotEqual(t, Key(key), issue.Key)
+			}
+		}
+	}
+	require.Empty(t, report.Missing)
+
+	mpt = NewMerklePatriciaTrie(pndb, Sequence(1), mpt.GetRoot(), statecache.NewEmpty())
+	for _, a := range accounts {
+		sub, err := mpt.OpenSubTrie(a)
+		require.NoError(t, err)
+		for _, p := range storage {
+			_, err := sub.GetNodeValueRaw(p)
+			require.NoError(t, err)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// ErrInvalidSnapshot - the snapshot file is malformed or its nodes don't form a complete trie
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// ErrSnapshotChecksum - the snapshot checksum doesn't match its content
+var ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+// SnapshotFormatVersion - the version of the snapshot format written by ExportSnapshot
+const SnapshotFormatVersion = 1
+
+var snapshotMagic = []byte("MPTS")
+
+// snapshotMaxRecordSize - the largest node record accepted on import
+const snapshotMaxRecordSize = MPTMaxAllowableNodeSize + 4096
+
+// SnapshotHeader - the header of a state snapshot
+type SnapshotHeader struct {
+	Version   uint16
+	Root      Key
+	Round     int64
+	NodeCount uint64
+}
+
+// ExportSnapshot - stream all the nodes reachable from the root, the nodes of the referenced sub tries
+// included, to the writer as a snapshot file:
+//
+//	magic "MPTS" | version uint16 | round int64 | node count uint64 | root length byte | root
+//	node count times: uvarint length | Node.Encode
+//	sha3-256 of all the preceding bytes
+//
+// The nodes are written in depth first order, a node before its children. The trie is walked
+// twice, once to count the nodes for the header and once to write them.
+func ExportSnapshot(ctx context.Context, w io.Writer, ndb NodeDB, root Key, round int64) (*SnapshotHeader, error) {
+	if len(root) == 0 || len(root) > 255 {
+		return nil, ErrInvalidSnapshot
+	}
+	var count uint64
+	if err := walkSnapshotNodes(ctx, ndb, root, func(Node) error {
+		count++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	header := &SnapshotHeader{
+		Version:   SnapshotFormatVersion,
+		Root:      concat(root),
+		Round:     round,
+		NodeCount: count,
+	}
+	h := sha3.New256()
+	bw := bufio.NewWriter(w)
+	mw := io.MultiWriter(bw, h)
+	if _, err := mw.Write(header.encode()); err != nil {
+		return nil, err
+	}
+
+	var (
+		written uint64
+		lbuf    = make([]byte, binary.MaxVarintLen64)
+	)
+	if err := walkSnapshotNodes(ctx, ndb, root, func(node Node) error {
+		data := node.Encode()
+		n := binary.PutUvarint(lbuf, uint64(len(data)))
+		if _, err := mw.Write(lbuf[:n]); err != nil {
+			return err
+		}
+		if _, err := mw.Write(data); err != nil {
+			return err
+		}
+		written++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if written != count {
+		return nil, fmt.Errorf("snapshot nodes changed during export: %d counted, %d written", count, written)
+	}
+
+	if _, err := bw.Write(h.Sum(nil)); err != nil {
+		return nil, err
+	}
+	return header, bw.Flush()
+}
+
+// ImportSnapshot - validate the snapshot and write its nodes to the node db, returns the header.
+// Each node must be referenced by a previous one and all the referenced nodes must be present,
+// the roots of the referenced sub tries included. The nodes are staged in memory and written in
+// batches only once the checksum matches, so nothing is written from an invalid snapshot.
+func ImportSnapshot(ctx context.Context, r io.Reader, ndb NodeDB) (*SnapshotHeader, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r), h: sha3.New256()}
+	header, err := readSnapshotHeader(sr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the number of references not yet read by key
+	pending := map[string]int{string(header.Root): 1}
+	var (
+		keys  []Key
+		nodes []Node
+	)
+	for i := uint64(0); i < header.NodeCount; i++ {
+		if i%BatchSize == 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
+			}
+		}
+		node, err := sr.readNode()
+		if err != nil {
+			return nil, err
+		}
+		key := node.GetHashBytes()
+		if pending[string(key)] == 0 {
+			return nil, fmt.Errorf("%w: unreferenced node %s", ErrInvalidSnapshot, ToHex(key))
+		}
+		releaseSnapshotRef(pending, key)
+		for _, ckey := range nodeRefs(node) {
+			pending[string(ckey)]++
+		}
+
+		keys = append(keys, key)
+		nodes = append(nodes, node)
+	}
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("%w: %d missing nodes", ErrInvalidSnapshot, len(pending))
+	}
+
+	sum := sr.h.Sum(nil)
+	checksum := make([]byte, len(sum))
+	if _, err := io.ReadFull(sr.r, checksum); err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+	if !bytes.Equal(sum, checksum) {
+		return nil, ErrSnapshotChecksum
+	}
+	if _, err := sr.r.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("%w: trailing data", ErrInvalidSnapshot)
+	}
+
+	// the root of the snapshot round is registered with the last nodes
+	last := (len(keys) - 1) / BatchSize * BatchSize
+	for i := 0; i < last; i += BatchSize {
+		if err := ndb.MultiPutNode(keys[i:i+BatchSize], nodes[i:i+BatchSize]); err != nil {
+			return nil, err
+		}
+	}
+	if registry, ok := ndb.(RootRegistry); ok {
+		return header, registry.MultiPutNodeWithRoot(keys[last:], nodes[last:], header.Round, header.Root)
+	}
+	return header, ndb.MultiPutNode(keys[last:], nodes[last:])
+}
+
+func releaseSnapshotRef(pending map[string]int, key Key) {
+	if pending[string(key)] == 1 {
+		delete(pending, string(key))
+		return
+	}
+	pending[string(key)]--
+}
+
+func (sh *SnapshotHeader) encode() []byte {
+	buf := make([]byte, 0, len(snapshotMagic)+19+len(sh.Root))
+	buf = append(buf, snapshotMagic...)
+	buf = binary.BigEndian.AppendUint16(buf, sh.Version)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(sh.Round))
+	buf = binary.BigEndian.AppendUint64(buf, sh.NodeCount)
+	buf = append(buf, byte(len(sh.Root)))
+	return append(buf, sh.Root...)
+}
+
+func readSnapshotHeader(sr *snapshotReader) (*SnapshotHeader, error) {
+	buf := make([]byte, len(snapshotMagic)+19)
+	if _, err := io.ReadFull(sr, buf); err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+	if !bytes.Equal(buf[:len(snapshotMagic)], snapshotMagic) {
+		return nil, ErrInvalidSnapshot
+	}
+	buf = buf[len(snapshotMagic):]
+	sh := &SnapshotHeader{
+		Version:   binary.BigEndian.Uint16(buf),
+		Round:     int64(binary.BigEndian.Uint64(buf[2:])),
+		NodeCount: binary.BigEndian.Uint64(buf[10:]),
+	}
+	if sh.Version != SnapshotFormatVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, sh.Version)
+	}
+	rootLen := int(buf[18])
+	if rootLen == 0 || sh.NodeCount == 0 {
+		return nil, ErrInvalidSnapshot
+	}
+	sh.Root = make(Key, rootLen)
+	if _, err := io.ReadFull(sr, sh.Root); err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+	return sh, nil
+}
+
+// snapshotReader - reads the snapshot content, hashing all the bytes read
+type snapshotReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (sr *snapshotReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.h.Write(p[:n])
+	return n, err
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (sr *snapshotReader) readNode() (Node, error) {
+	size, err := binary.ReadUvarint(sr)
+	if err != nil || size == 0 || size > snapshotMaxRecordSize {
+		return nil, ErrInvalidSnapshot
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(sr, data); err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+	// decodeNode panics on unknown types
+	switch data[0] & NodeTypesAll {
+	case NodeTypeLeafNode, NodeTypeFullNode, NodeTypeExtensionNode:
+	default:
+		return nil, ErrInvalidSnapshot
+	}
+	node, err := decodeNode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	return node, nil
+}
+
+// walkSnapshotNodes - visit the nodes reachable from the key in depth first order, the nodes of the
+// referenced sub tries included, failing on missing nodes
+func walkSnapshotNodes(ctx context.Context, ndb NodeDB, key Key, handler func(Node) error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	node, err := ndb.GetNode(key)
+	if err != nil {
+		return fmt.Errorf("snapshot node %s: %w", ToHex(key), err)
+	}
+	if err := handler(node); err != nil {
+		return err
+	}
+	for _, ckey := range nodeRefs(node) {
+		if err := walkSnapshotNodes(ctx, ndb, ckey, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
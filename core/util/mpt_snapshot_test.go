@@ -0,0 +1,134 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func newSnapshotTestMPT(t *testing.T) *MerklePatriciaTrie {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(5), nil, statecache.NewEmpty())
+	for i := 0; i < 500; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+	return mpt
+}
+
+func TestSnapshot_ExportImport(t *testing.T) {
+	mpt := newSnapshotTestMPT(t)
+	ndb := mpt.GetNodeDB()
+
+	buf := bytes.NewBuffer(nil)
+	header, err := ExportSnapshot(context.TODO(), buf, ndb, mpt.GetRoot(), 42)
+	require.NoError(t, err)
+	require.Equal(t, ndb.Size(context.TODO()), int64(header.NodeCount))
+
+	// the export is deterministic
+	buf2 := bytes.NewBuffer(nil)
+	_, err = ExportSnapshot(context.TODO(), buf2, ndb, mpt.GetRoot(), 42)
+	require.NoError(t, err)
+	require.Equal(t, buf.Bytes(), buf2.Bytes())
+
+	ndb2 := NewMemoryNodeDB()
+	header2, err := ImportSnapshot(context.TODO(), bytes.NewReader(buf.Bytes()), ndb2)
+	require.NoError(t, err)
+	require.Equal(t, header, header2)
+	require.Equal(t, int64(42), header2.Round)
+	require.Equal(t, ndb.Size(context.TODO()), ndb2.Size(context.TODO()))
+
+	mpt2 := NewMerklePatriciaTrie(ndb2, Sequence(5), header2.Root, statecache.NewEmpty())
+	require.NoError(t, mpt2.Validate())
+	for i := 0; i < 500; i++ {
+		v, err := mpt2.GetNodeValueRaw(flatTestPath(i))
+		require.NoError(t, err)
+		ev, err := (&Txn{fmt.Sprintf("value_%d", i)}).MarshalMsg(nil)
+		require.NoError(t, err)
+		require.Equal(t, ev, v)
+	}
+
+	// the root of the snapshot round is registered by a root registry
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+	_, err = ImportSnapshot(context.TODO(), bytes.NewReader(buf.Bytes()), pndb)
+	require.NoError(t, err)
+	round, root, err := pndb.LatestRoot()
+	require.NoError(t, err)
+	require.Equal(t, int64(42), round)
+	require.Equal(t, header.Root, root)
+}
+
+func TestSnapshot_ImportInvalid(t *testing.T) {
+	mpt := newSnapshotTestMPT(t)
+	buf := bytes.NewBuffer(nil)
+	_, err := ExportSnapshot(context.TODO(), buf, mpt.GetNodeDB(), mpt.GetRoot(), 1)
+	require.NoError(t, err)
+	data := buf.Bytes()
+
+	importErr := func(data []byte) error {
+		_, err := ImportSnapshot(context.TODO(), bytes.NewReader(data), NewMemoryNodeDB())
+		return err
+	}
+
+	corrupt := concat(data)
+	corrupt[len(corrupt)-1] ^= 0xff
+	require.ErrorIs(t, importErr(corrupt), ErrSnapshotChecksum)
+	// nothing is written from a snapshot failing the checksum
+	ndb := NewMemoryNodeDB()
+	_, err = ImportSnapshot(context.TODO(), bytes.NewReader(corrupt), ndb)
+	require.ErrorIs(t, err, ErrSnapshotChecksum)
+	require.Zero(t, ndb.Size(context.TODO()))
+
+	corrupt = concat(data)
+	corrupt[len(corrupt)-40] ^= 0xff
+	require.Error(t, importErr(corrupt))
+
+	require.ErrorIs(t, importErr(data[:len(data)-10]), ErrInvalidSnapshot)
+	require.ErrorIs(t, importErr(append(concat(data), 0)), ErrInvalidSnapshot)
+	require.ErrorIs(t, importErr([]byte("MPTX")), ErrInvalidSnapshot)
+
+	// a node count short of the trie
+	corrupt = concat(data)
+	corrupt[len(snapshotMagic)+17]--
+	require.ErrorIs(t, importErr(corrupt), ErrInvalidSnapshot)
+
+	// missing nodes fail the export
+	mpt2 := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(5), mpt.GetRoot(), statecache.NewEmpty())
+	_, err = ExportSnapshot(context.TODO(), bytes.NewBuffer(nil), mpt2.GetNodeDB(), mpt.GetRoot(), 1)
+	require.ErrorIs(t, err, ErrNodeNotFound)
+}
+
+func TestSnapshot_SubTries(t *testing.T) {
+	ndb := NewMemoryNodeDB()
+	mpt, accounts, storage := newSubTrieTestMPT(t, ndb)
+
+	buf := bytes.NewBuffer(nil)
+	header, err := ExportSnapshot(context.TODO(), buf, ndb, mpt.GetRoot(), 1)
+	require.NoError(t, err)
+	require.Equal(t, ndb.Size(context.TODO()), int64(header.NodeCount))
+
+	ndb2 := NewMemoryNodeDB()
+	_, err = ImportSnapshot(context.TODO(), bytes.NewReader(buf.Bytes()), ndb2)
+	require.NoError(t, err)
+	mpt2 := NewMerklePatriciaTrie(ndb2, Sequence(1), header.Root, statecache.NewEmpty())
+	for _, a := range accounts {
+		sub, err := mpt2.OpenSubTrie(a)
+		require.NoError(t, err)
+		for _, p := range storage {
+			_, err := sub.GetNodeValueRaw(p)
+			require.NoError(t, err)
+		}
+	}
+
+	// the nodes of the sub tries are required
+	ref, err := mpt.GetSubTrieRef(accounts[0])
+	require.NoError(t, err)
+	require.NoError(t, ndb.DeleteNode(ref.Root))
+	_, err = ExportSnapshot(context.TODO(), bytes.NewBuffer(nil), ndb, mpt.GetRoot(), 1)
+	require.ErrorIs(t, err, ErrNodeNotFound)
+}
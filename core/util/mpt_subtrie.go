@@ -0,0 +1,378 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+var (
+	// ErrNotSubTrie - the value is not a sub trie reference
+	ErrNotSubTrie = errors.New("value is not a sub trie reference")
+	// ErrSubTrieMismatch - the sub trie was not opened from the trie at the path
+	ErrSubTrieMismatch = errors.New("sub trie not opened at the path")
+	// ErrInvalidProof - the proof nodes don't lead from the root to the value
+	ErrInvalidProof = errors.New("invalid proof")
+)
+
+// SubTrieSeparator - separates the path of a sub trie reference from the paths in the sub trie
+const SubTrieSeparator = '/'
+
+// subTrieRefMarker - the first byte of an encoded sub trie reference, a byte never used by msgpack
+const subTrieRefMarker = 0xc1
+
+// SubTrieRef - a value referencing the root of a sub trie, such as the storage trie of an
+// account, with the data of its owner
+type SubTrieRef struct {
+	Root Key
+	Data []byte
+}
+
+// MarshalMsg - implement MPTSerializable interface
+func (ref *SubTrieRef) MarshalMsg(b []byte) ([]byte, error) {
+	b = append(b, subTrieRefMarker)
+	b = binary.AppendUvarint(b, uint64(len(ref.Root)))
+	b = append(b, ref.Root...)
+	return append(b, ref.Data...), nil
+}
+
+// UnmarshalMsg - implement MPTSerializable interface, returns ErrNotSubTrie for other values
+func (ref *SubTrieRef) UnmarshalMsg(b []byte) ([]byte, error) {
+	if len(b) == 0 || b[0] != subTrieRefMarker {
+		return nil, ErrNotSubTrie
+	}
+	n, l := binary.Uvarint(b[1:])
+	if l <= 0 || n > uint64(len(b)-1-l) {
+		return nil, ErrNotSubTrie
+	}
+	b = b[1+l:]
+	ref.Root, ref.Data = nil, nil
+	if n > 0 {
+		ref.Root = concat(b[:n])
+	}
+	if len(b) > int(n) {
+		ref.Data = concat(b[n:])
+	}
+	return nil, nil
+}
+
+// subTrieCommit - the reference to the new root of a sub trie written by InsertSubTrie, the nodes
+// of the sub trie at the old root are recorded as deleted by the sub trie itself
+type subTrieCommit struct {
+	SubTrieRef
+}
+
+// decodeSubTrieRef - the sub trie reference of the encoded value, ok is false for other values
+func decodeSubTrieRef(value []byte) (ref *SubTrieRef, ok bool) {
+	if len(value) == 0 || value[0] != subTrieRefMarker {
+		return nil, false
+	}
+	ref = &SubTrieRef{}
+	if _, err := ref.UnmarshalMsg(value); err != nil {
+		return nil, false
+	}
+	return ref, true
+}
+
+// nodeRefs - the keys of the nodes referenced by the node: the children of a full node, the child of an
+// extension node and the root of the sub trie referenced by the value of a leaf or a full node. The
+// nodes of the sub tries are kept in the node db of the trie, so every walk of the stored nodes uses it.
+func nodeRefs(node Node) []Key {
+	var refs []Key
+	switch nodeImpl := node.(type) {
+	case *FullNode:
+		for _, ckey := range nodeImpl.Children {
+			if ckey != nil {
+				refs = append(refs, ckey)
+			}
+		}
+	case *ExtensionNode:
+		return []Key{nodeImpl.NodeKey}
+	}
+	if vn := GetValueNode(node); vn != nil {
+		if ref, ok := decodeSubTrieRef(vn.GetValueBytes()); ok && len(ref.Root) > 0 {
+			refs = append(refs, ref.Root)
+		}
+	}
+	return refs
+}
+
+// SubTriePath - the path of a value of the sub trie referenced at the path, as visited by IterateSubTries
+func SubTriePath(path, subPath Path) Path {
+	p := make(Path, 0, len(path)+1+len(subPath))
+	p = append(p, path...)
+	p = append(p, SubTrieSeparator)
+	return append(p, subPath...)
+}
+
+// SplitSubTriePath - split a path visited by IterateSubTries into the path of the sub trie
+// reference and the path in the sub trie, ok is false for the paths of the trie itself
+func SplitSubTriePath(p Path) (path, subPath Path, ok bool) {
+	idx := bytes.LastIndexByte(p, SubTrieSeparator)
+	if idx < 0 {
+		return p, nil, false
+	}
+	return p[:idx], p[idx+1:], true
+}
+
+// isSubTrieLeafPrefix - true if the leaf belongs to a sub trie
+func isSubTrieLeafPrefix(prefix Path) bool {
+	return bytes.IndexByte(prefix, SubTrieSeparator) >= 0
+}
+
+// rootPrefix - the prefix of the values at the root. The leaves of a sub trie are prefixed with the
+// path of its reference, so that the nodes of the sub tries of different paths are never shared.
+func (mpt *MerklePatriciaTrie) rootPrefix() Path {
+	if mpt.subPrefix == nil {
+		return Path("")
+	}
+	return mpt.subPrefix
+}
+
+// GetSubTrieRef - the sub trie reference at the path, ErrNotSubTrie if the value is not a reference
+func (mpt *MerklePatriciaTrie) GetSubTrieRef(path Path) (*SubTrieRef, error) {
+	ref := &SubTrieRef{}
+	if err := mpt.GetNodeValue(path, ref); err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// OpenSubTrie - open the sub trie referenced at the path, an empty sub trie if there is no value.
+// The sub trie shares the node db, the cache and the change collector of the trie: its changes are
+// saved, merged and recorded as deleted together with the changes of the trie, and must not be saved
+// on their own. The new root of the sub trie is committed to the trie with InsertSubTrie.
+func (mpt *MerklePatriciaTrie) OpenSubTrie(path Path) (*MerklePatriciaTrie, error) {
+	var root Key
+	ref, err := mpt.GetSubTrieRef(path)
+	switch err {
+	case nil:
+		root = ref.Root
+	case ErrValueNotPresent:
+	default:
+		return nil, err
+	}
+
+	mpt.mutex.RLock()
+	defer mpt.mutex.RUnlock()
+	sub := NewMerklePatriciaTrie(mpt.db, mpt.GetVersion(), root, mpt.cache)
+	sub.ChangeCollector = mpt.ChangeCollector
+	sub.subPrefix = mpt.subTriePrefix(path)
+	sub.meter = mpt.meter
+	return sub, nil
+}
+
+func (mpt *MerklePatriciaTrie) subTriePrefix(path Path) Path {
+	return SubTriePath(concat(mpt.subPrefix, path...), nil)
+}
+
+// InsertSubTrie - insert or update the reference at the path to the root of the sub trie opened
+// at the same path, with the data of its owner
+func (mpt *MerklePatriciaTrie) InsertSubTrie(path Path, sub *MerklePatriciaTrie, data []byte) (Key, error) {
+	mpt.mutex.RLock()
+	ok := sub.ChangeCollector == mpt.ChangeCollector && bytes.Equal(sub.subPrefix, mpt.subTriePrefix(path))
+	mpt.mutex.RUnlock()
+	if !ok {
+		return nil, ErrSubTrieMismatch
+	}
+	return mpt.Insert(path, &subTrieCommit{SubTrieRef{Root: sub.GetRoot(), Data: data}})
+}
+
+// DeleteSubTrie - delete the sub trie reference at the path, all the nodes of the sub trie are
+// recorded as deleted in the change collector. So are they when the reference is deleted by Delete
+// or DeletePrefix, or overwritten by Insert with a value that is not a reference. Insert returns
+// ErrSubTrieMismatch for a reference to another root, the root is changed by InsertSubTrie.
+func (mpt *MerklePatriciaTrie) DeleteSubTrie(path Path) (Key, error) {
+	if _, err := mpt.GetSubTrieRef(path); err != nil {
+		return nil, err
+	}
+	return mpt.Delete(path)
+}
+
+// releaseSubTrie - unsafe, record all the nodes of the sub trie referenced at the path as deleted
+// when the reference is replaced by the value, nil for a delete
+func (mpt *MerklePatriciaTrie) releaseSubTrie(path Path, value []byte) error {
+	old, err := mpt.valueAt(path)
+	if err != nil {
+		return err
+	}
+	return mpt.releaseSubTrieRef(concat(mpt.rootPrefix(), path...), old, value)
+}
+
+// releaseSubTrieRef - unsafe, record all the nodes of the sub trie referenced by the old value at the
+// full path as deleted, unless the value references the same root
+func (mpt *MerklePatriciaTrie) releaseSubTrieRef(fullPath Path, old, value []byte) error {
+	ref, ok := decodeSubTrieRef(old)
+	if !ok || len(ref.Root) == 0 {
+		return nil
+	}
+	if nref, ok := decodeSubTrieRef(value); ok {
+		if bytes.Equal(nref.Root, ref.Root) {
+			return nil
+		}
+		return ErrSubTrieMismatch
+	}
+	node, err := mpt.getNode(ref.Root)
+	if err != nil {
+		return err
+	}
+	return mpt.deleteSubtree(node, SubTriePath(fullPath, nil))
+}
+
+// IterateSubTries - iterate the entire trie descending into the sub tries, the nodes of a sub trie
+// are visited with the SubTriePath of the reference path and their path in the sub trie
+func (mpt *MerklePatriciaTrie) IterateSubTries(ctx context.Context, handler MPTIteratorHandler, visitNodeTypes byte) error {
+	mpt.mutex.RLock()
+	defer mpt.mutex.RUnlock()
+	if len(mpt.root) == 0 {
+		return nil
+	}
+	return mpt.iterate(ctx, Path{}, mpt.root, mpt.subTrieHandler(handler, visitNodeTypes), visitNodeTypes|NodeTypeValueNode)
+}
+
+// subTrieHandler - visit the value nodes for the handler and descend into the referenced sub tries
+func (mpt *MerklePatriciaTrie) subTrieHandler(handler MPTIteratorHandler, visitNodeTypes byte) MPTIteratorHandler {
+	var h MPTIteratorHandler
+	h = func(ctx context.Context, path Path, key Key, node Node) error {
+		vn, ok := node.(*ValueNode)
+		if !ok {
+			return handler(ctx, path, key, node)
+		}
+		if IncludesNodeType(visitNodeTypes, NodeTypeValueNode) {
+			if err := handler(ctx, path, key, node); err != nil {
+				return err
+			}
+		}
+		ref := &SubTrieRef{}
+		if _, err := ref.UnmarshalMsg(vn.GetValueBytes()); err != nil || len(ref.Root) == 0 {
+			return nil
+		}
+		return mpt.iterate(ctx, SubTriePath(path, nil), ref.Root, h, visitNodeTypes|NodeTypeValueNode)
+	}
+	return h
+}
+
+// GetPathNodes - the nodes from the root to the node holding the value at the path, the proof of the value
+func (mpt *MerklePatriciaTrie) GetPathNodes(path Path) ([]Node, error) {
+	if _, err := hex.DecodeString(string(path)); err != nil {
+		return nil, err
+	}
+	mpt.mutex.RLock()
+	defer mpt.mutex.RUnlock()
+	if len(mpt.root) == 0 {
+		return nil, ErrValueNotPresent
+	}
+
+	var nodes []Node
+	key := mpt.root
+	for {
+		node, err := mpt.getNode(key)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		ckey, rest, err := pathNodeChild(node, path)
+		if err != nil {
+			return nil, err
+		}
+		if ckey == nil {
+			return nodes, nil
+		}
+		key, path = ckey, rest
+	}
+}
+
+// pathNodeChild - the key of the child of the node on the path with the rest of the path,
+// a nil key if the node holds the value at the path
+func pathNodeChild(node Node, path Path) (Key, Path, error) {
+	switch nodeImpl := node.(type) {
+	case *LeafNode:
+		if bytes.Equal(nodeImpl.Path, path) && nodeImpl.HasValue() {
+			return nil, nil, nil
+		}
+	case *FullNode:
+		if len(path) == 0 {
+			if nodeImpl.HasValue() {
+				return nil, nil, nil
+			}
+			break
+		}
+		if ckey := nodeImpl.GetChild(path[0]); ckey != nil {
+			return ckey, path[1:], nil
+		}
+	case *ExtensionNode:
+		if bytes.HasPrefix(path, nodeImpl.Path) {
+			return nodeImpl.NodeKey, path[len(nodeImpl.Path):], nil
+		}
+	}
+	return nil, nil, ErrValueNotPresent
+}
+
+// VerifyPathNodes - check the nodes lead from the root to the value at the path, returns the value
+func VerifyPathNodes(root Key, path Path, nodes []Node) ([]byte, error) {
+	if _, err := hex.DecodeString(string(path)); err != nil {
+		return nil, ErrInvalidProof
+	}
+	key := root
+	for i, node := range nodes {
+		if node == nil || !bytes.Equal(node.GetHashBytes(), key) {
+			return nil, ErrInvalidProof
+		}
+		ckey, rest, err := pathNodeChild(node, path)
+		if err != nil {
+			return nil, ErrInvalidProof
+		}
+		if ckey == nil {
+			if i != len(nodes)-1 {
+				return nil, ErrInvalidProof
+			}
+			return GetValueNode(node).GetValueBytes(), nil
+		}
+		key, path = ckey, rest
+	}
+	return nil, ErrInvalidProof
+}
+
+// SubTrieProof - the proof of a value in a sub trie, the proof of the reference in the trie
+// chained to the proof of the value in the sub trie referenced
+type SubTrieProof struct {
+	Ref   []Node
+	Value []Node
+}
+
+// GetSubTrieProof - the proof of the value at the sub path of the sub trie referenced at the path
+func (mpt *MerklePatriciaTrie) GetSubTrieProof(path, subPath Path) (*SubTrieProof, error) {
+	refNodes, err := mpt.GetPathNodes(path)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := mpt.OpenSubTrie(path)
+	if err != nil {
+		return nil, err
+	}
+	valueNodes, err := sub.GetPathNodes(subPath)
+	if err != nil {
+		return nil, err
+	}
+	return &SubTrieProof{Ref: refNodes, Value: valueNodes}, nil
+}
+
+// VerifySubTrieProof - check the proof leads from the root to the reference at the path and from
+// the root of the sub trie to the value at the sub path, returns the reference and the value
+func VerifySubTrieProof(root Key, path, subPath Path, proof *SubTrieProof) (*SubTrieRef, []byte, error) {
+	v, err := VerifyPathNodes(root, path, proof.Ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref := &SubTrieRef{}
+	if _, err := ref.UnmarshalMsg(v); err != nil {
+		return nil, nil, ErrInvalidProof
+	}
+	value, err := VerifyPathNodes(ref.Root, subPath, proof.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ref, value, nil
+}
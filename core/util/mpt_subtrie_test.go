@@ -0,0 +1,261 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/encryption"
+	"github.com/0chain/common/core/statecache"
+)
+
+func subTrieTestPath(s string) Path {
+	return Path(encryption.Hash(s))
+}
+
+// newSubTrieTestMPT - a trie with plain values and two accounts with the same storage values
+func newSubTrieTestMPT(t *testing.T, ndb NodeDB) (*MerklePatriciaTrie, []Path, []Path) {
+	mpt := NewMerklePatriciaTrie(ndb, Sequence(1), nil, statecache.NewEmpty())
+	for i := 0; i < 10; i++ {
+		_, err := mpt.Insert(subTrieTestPath(fmt.Sprintf("value_%d", i)), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+
+	accounts := []Path{subTrieTestPath("account_1"), subTrieTestPath("account_2")}
+	var storage []Path
+	for i := 0; i < 20; i++ {
+		storage = append(storage, subTrieTestPath(fmt.Sprintf("storage_%d", i)))
+	}
+	for _, a := range accounts {
+		sub, err := mpt.OpenSubTrie(a)
+		require.NoError(t, err)
+		for _, p := range storage {
+			_, err := sub.Insert(p, &Txn{string(p)})
+			require.NoError(t, err)
+		}
+		_, err = mpt.InsertSubTrie(a, sub, []byte("account"))
+		require.NoError(t, err)
+	}
+	return mpt, accounts, storage
+}
+
+func TestSubTrieRef_Encoding(t *testing.T) {
+	ref := &SubTrieRef{Root: Key("root"), Data: []byte("data")}
+	b, err := ref.MarshalMsg(nil)
+	require.NoError(t, err)
+
+	var decoded SubTrieRef
+	_, err = decoded.UnmarshalMsg(b)
+	require.NoError(t, err)
+	require.Equal(t, *ref, decoded)
+
+	_, err = decoded.UnmarshalMsg([]byte("value"))
+	require.Equal(t, ErrNotSubTrie, err)
+	_, err = decoded.UnmarshalMsg(b[:3])
+	require.Equal(t, ErrNotSubTrie, err)
+
+	path, subPath, ok := SplitSubTriePath(SubTriePath(Path("ab"), Path("cd")))
+	require.True(t, ok)
+	require.Equal(t, Path("ab"), path)
+	require.Equal(t, Path("cd"), subPath)
+}
+
+func TestMerklePatriciaTrie_SubTrie(t *testing.T) {
+	mpt, accounts, storage := newSubTrieTestMPT(t, NewMemoryNodeDB())
+
+	ref1, err := mpt.GetSubTrieRef(accounts[0])
+	require.NoError(t, err)
+	ref2, err := mpt.GetSubTrieRef(accounts[1])
+	require.NoError(t, err)
+	require.Equal(t, []byte("account"), ref1.Data)
+	// the same values under two accounts don't share nodes
+	require.NotEqual(t, ref1.Root, ref2.Root)
+
+	_, err = mpt.GetSubTrieRef(subTrieTestPath("value_1"))
+	require.Equal(t, ErrNotSubTrie, err)
+
+	// the changes of the sub tries are saved with the trie
+	ndb := NewMemoryNodeDB()
+	require.NoError(t, mpt.SaveChanges(context.Background(), ndb, false))
+	saved := NewMerklePatriciaTrie(ndb, Sequence(1), mpt.GetRoot(), statecache.NewEmpty())
+	for _, a := range accounts {
+		sub, err := saved.OpenSubTrie(a)
+		require.NoError(t, err)
+		require.NoError(t, sub.Validate())
+		for _, p := range storage {
+			var v Txn
+			require.NoError(t, sub.GetNodeValue(p, &v))
+			require.Equal(t, string(p), v.Data)
+		}
+	}
+
+	values := make(map[string]bool)
+	err = saved.IterateSubTries(context.Background(), func(ctx context.Context, path Path, key Key, node Node) error {
+		values[string(path)] = true
+		return nil
+	}, NodeTypeValueNode)
+	require.NoError(t, err)
+	require.Len(t, values, 10+2+2*len(storage))
+	for _, a := range accounts {
+		require.True(t, values[string(a)])
+		for _, p := range storage {
+			require.True(t, values[string(SubTriePath(a, p))])
+		}
+	}
+}
+
+// subTrieNodeKeys - the keys of all the nodes of the sub trie referenced at the path
+func subTrieNodeKeys(t *testing.T, mpt *MerklePatriciaTrie, path Path) map[string]bool {
+	ref, err := mpt.GetSubTrieRef(path)
+	require.NoError(t, err)
+	keys := make(map[string]bool)
+	err = mpt.IterateFrom(context.Background(), ref.Root, func(ctx context.Context, path Path, key Key, node Node) error {
+		keys[string(key)] = true
+		return nil
+	}, NodeTypeLeafNode|NodeTypeFullNode|NodeTypeExtensionNode)
+	require.NoError(t, err)
+	require.NotEmpty(t, keys)
+	return keys
+}
+
+func TestMerklePatriciaTrie_DeleteSubTrie(t *testing.T) {
+	ndb := NewMemoryNodeDB()
+	mpt, accounts, storage := newSubTrieTestMPT(t, NewMemoryNodeDB())
+	require.NoError(t, mpt.SaveChanges(context.Background(), ndb, false))
+	root := mpt.GetRoot()
+
+	tests := []struct {
+		name   string
+		remove func(mpt *MerklePatriciaTrie, path Path) error
+	}{
+		{"DeleteSubTrie", func(mpt *MerklePatriciaTrie, path Path) error {
+			_, err := mpt.DeleteSubTrie(path)
+			return err
+		}},
+		{"Delete", func(mpt *MerklePatriciaTrie, path Path) error {
+			_, err := mpt.Delete(path)
+			return err
+		}},
+		{"DeletePrefix", func(mpt *MerklePatriciaTrie, path Path) error {
+			_, err := mpt.DeletePrefix(path)
+			return err
+		}},
+		{"Insert", func(mpt *MerklePatriciaTrie, path Path) error {
+			_, err := mpt.Insert(path, &Txn{"plain"})
+			return err
+		}},
+		{"UpdateBatch", func(mpt *MerklePatriciaTrie, path Path) error {
+			_, err := mpt.UpdateBatch([]BatchWrite{{Path: path}})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ndb := NewLevelNodeDB(NewMemoryNodeDB(), ndb, false)
+			mpt := NewMerklePatriciaTrie(ndb, Sequence(2), root, statecache.NewEmpty())
+			subKeys := subTrieNodeKeys(t, mpt, accounts[0])
+
+			require.NoError(t, tt.remove(mpt, accounts[0]))
+			_, err := mpt.GetSubTrieRef(accounts[0])
+			require.Error(t, err)
+
+			// all the nodes of the sub trie are dead
+			for _, d := range mpt.GetDeletes() {
+				delete(subKeys, string(d.GetHashBytes()))
+			}
+			require.Empty(t, subKeys)
+
+			require.NoError(t, mpt.SaveChanges(context.Background(), ndb, true))
+			sub, err := mpt.OpenSubTrie(accounts[1])
+			require.NoError(t, err)
+			require.NoError(t, sub.Validate())
+			for _, p := range storage {
+				_, err := sub.GetNodeValueRaw(p)
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMerklePatriciaTrie_InsertSubTrieRef(t *testing.T) {
+	mpt, accounts, _ := newSubTrieTestMPT(t, NewMemoryNodeDB())
+	ref, err := mpt.GetSubTrieRef(accounts[0])
+	require.NoError(t, err)
+	deletes := len(mpt.GetDeletes())
+
+	// the data of the owner is updated, the sub trie is kept
+	_, err = mpt.Insert(accounts[0], &SubTrieRef{Root: ref.Root, Data: []byte("updated")})
+	require.NoError(t, err)
+	require.Len(t, mpt.GetDeletes(), deletes)
+	sub, err := mpt.OpenSubTrie(accounts[0])
+	require.NoError(t, err)
+	require.NoError(t, sub.Validate())
+
+	// the root is changed by InsertSubTrie only
+	other, err := mpt.GetSubTrieRef(accounts[1])
+	require.NoError(t, err)
+	_, err = mpt.Insert(accounts[0], &SubTrieRef{Root: other.Root})
+	require.Equal(t, ErrSubTrieMismatch, err)
+}
+
+func TestMerklePatriciaTrie_SubTrieProof(t *testing.T) {
+	mpt, accounts, storage := newSubTrieTestMPT(t, NewMemoryNodeDB())
+
+	proof, err := mpt.GetSubTrieProof(accounts[1], storage[3])
+	require.NoError(t, err)
+	ref, value, err := VerifySubTrieProof(mpt.GetRoot(), accounts[1], storage[3], proof)
+	require.NoError(t, err)
+	require.Equal(t, []byte("account"), ref.Data)
+	var v Txn
+	_, err = v.UnmarshalMsg(value)
+	require.NoError(t, err)
+	require.Equal(t, string(storage[3]), v.Data)
+
+	_, _, err = VerifySubTrieProof(mpt.GetRoot(), accounts[0], storage[3], proof)
+	require.Equal(t, ErrInvalidProof, err)
+	_, _, err = VerifySubTrieProof(mpt.GetRoot(), accounts[1], storage[4], proof)
+	require.Equal(t, ErrInvalidProof, err)
+
+	other, err := mpt.GetSubTrieProof(accounts[0], storage[3])
+	require.NoError(t, err)
+	proof.Value = other.Value
+	_, _, err = VerifySubTrieProof(mpt.GetRoot(), accounts[1], storage[3], proof)
+	require.Equal(t, ErrInvalidProof, err)
+
+	_, err = mpt.GetSubTrieProof(accounts[1], subTrieTestPath("missing"))
+	require.Equal(t, ErrValueNotPresent, err)
+}
+
+func TestMerklePatriciaTrie_InsertSubTrieMismatch(t *testing.T) {
+	mpt, accounts, _ := newSubTrieTestMPT(t, NewMemoryNodeDB())
+	sub, err := mpt.OpenSubTrie(accounts[0])
+	require.NoError(t, err)
+	_, err = mpt.InsertSubTrie(accounts[1], sub, nil)
+	require.Equal(t, ErrSubTrieMismatch, err)
+}
+
+func TestMerklePatriciaTrie_SubTrieMissingNodes(t *testing.T) {
+	ndb := NewMemoryNodeDB()
+	mpt, accounts, _ := newSubTrieTestMPT(t, ndb)
+	for key := range subTrieNodeKeys(t, mpt, accounts[1]) {
+		require.NoError(t, ndb.DeleteNode(Key(key)))
+	}
+
+	synced := NewMerklePatriciaTrie(ndb, Sequence(1), mpt.GetRoot(), statecache.NewEmpty())
+	missing, err := synced.GetAllMissingNodes()
+	require.NoError(t, err)
+	ref, err := synced.GetSubTrieRef(accounts[1])
+	require.NoError(t, err)
+	// the walk stops at the missing root of the sub trie
+	require.Equal(t, []Key{ref.Root}, missing)
+}
+
+func TestMemoryNodeDB_ComputeRootSubTries(t *testing.T) {
+	ndb := NewMemoryNodeDB()
+	mpt, _, _ := newSubTrieTestMPT(t, ndb)
+	root, err := ndb.ComputeRoot()
+	require.NoError(t, err)
+	require.Equal(t, mpt.GetRoot(), Key(root.GetHashBytes()))
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"context"
+
+	"github.com/0chain/common/core/encryption"
+)
+
+// KeyEncoder - encodes a typed key into a trie path, the result must be a hex path
+type KeyEncoder[K any] func(key K) Path
+
+// HashKeyEncoder - the default key encoder, hashes the key to a hex path
+func HashKeyEncoder[K ~string | ~[]byte](key K) Path {
+	return Path(encryption.Hash(string(key)))
+}
+
+// TypedIteratorHandler - a typed trie iteration handler function type
+type TypedIteratorHandler[V MPTSerializable] func(ctx context.Context, path Path, value V) error
+
+// TypedTrie - a typed view over a merkle patricia trie, values are decoded
+// into V and keys are encoded to paths with the given key encoder
+type TypedTrie[K any, V MPTSerializable] struct {
+	mpt      MerklePatriciaTrieI
+	encode   KeyEncoder[K]
+	newValue func() V
+}
+
+// NewTypedTrie - create a typed trie over the given mpt, newValue must return
+// a new allocated value to decode into
+func NewTypedTrie[K any, V MPTSerializable](mpt MerklePatriciaTrieI, encode KeyEncoder[K], newValue func() V) *TypedTrie[K, V] {
+	return &TypedTrie[K, V]{
+		mpt:      mpt,
+		encode:   encode,
+		newValue: newValue,
+	}
+}
+
+// MPT - returns the underlying merkle patricia trie
+func (tt *TypedTrie[K, V]) MPT() MerklePatriciaTrieI {
+	return tt.mpt
+}
+
+// Path - returns the trie path of the given key
+func (tt *TypedTrie[K, V]) Path(key K) Path {
+	return tt.encode(key)
+}
+
+// Get - get the value of the given key, returns ErrValueNotPresent if it does not exist
+func (tt *TypedTrie[K, V]) Get(key K) (V, error) {
+	v := tt.newValue()
+	if err := tt.mpt.GetNodeValue(tt.encode(key), v); err != nil {
+		var zero V
+		return zero, err
+	}
+	return v, nil
+}
+
+// Has - checks if a value exists for the given key
+func (tt *TypedTrie[K, V]) Has(key K) (bool, error) {
+	_, err := tt.mpt.GetNodeValueRaw(tt.encode(key))
+	switch err {
+	case nil:
+		return true, nil
+	case ErrValueNotPresent:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Put - inserts or updates the value of the given key
+func (tt *TypedTrie[K, V]) Put(key K, value V) (Key, error) {
+	return tt.mpt.Insert(tt.encode(key), value)
+}
+
+// Delete - deletes the value of the given key, deleting a key that
+// does not exist is not an error
+func (tt *TypedTrie[K, V]) Delete(key K) (Key, error) {
+	root, err := tt.mpt.Delete(tt.encode(key))
+	if err == ErrValueNotPresent {
+		return tt.mpt.GetRoot(), nil
+	}
+	return root, err
+}
+
+// Iterate - iterate all the values of the trie, decoded into V
+func (tt *TypedTrie[K, V]) Iterate(ctx context.Context, handler TypedIteratorHandler[V]) error {
+	return tt.mpt.Iterate(ctx, func(ctx context.Context, path Path, _ Key, node Node) error {
+		vn, ok := node.(*ValueNode)
+		if !ok {
+			return nil
+		}
+		v := tt.newValue()
+		if _, err := v.UnmarshalMsg(vn.GetValueBytes()); err != nil {
+			return err
+		}
+		return handler(ctx, path, v)
+	}, NodeTypeValueNode)
+}
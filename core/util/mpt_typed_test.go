@@ -0,0 +1,86 @@
+package util
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+func newTestTypedTrie() *TypedTrie[string, *AState] {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(0), nil, statecache.NewEmpty())
+	return NewTypedTrie[string, *AState](mpt, HashKeyEncoder[string], func() *AState { return &AState{} })
+}
+
+func TestTypedTrie_PutGet(t *testing.T) {
+	tt := newTestTypedTrie()
+
+	_, err := tt.Put("alice", &AState{balance: 100})
+	require.NoError(t, err)
+	_, err = tt.Put("bob", &AState{balance: 200})
+	require.NoError(t, err)
+
+	v, err := tt.Get("alice")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), v.balance)
+
+	_, err = tt.Get("carol")
+	require.Equal(t, ErrValueNotPresent, err)
+
+	ok, err := tt.Has("bob")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = tt.Has("carol")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// the typed trie and the raw trie should agree on the path
+	raw := &AState{}
+	require.NoError(t, tt.MPT().GetNodeValue(tt.Path("bob"), raw))
+	require.Equal(t, int64(200), raw.balance)
+}
+
+func TestTypedTrie_Delete(t *testing.T) {
+	tt := newTestTypedTrie()
+
+	_, err := tt.Put("alice", &AState{balance: 100})
+	require.NoError(t, err)
+	root, err := tt.Put("bob", &AState{balance: 200})
+	require.NoError(t, err)
+
+	// deleting a missing key keeps the root
+	nroot, err := tt.Delete("carol")
+	require.NoError(t, err)
+	require.Equal(t, root, nroot)
+
+	_, err = tt.Delete("alice")
+	require.NoError(t, err)
+
+	ok, err := tt.Has("alice")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestTypedTrie_Iterate(t *testing.T) {
+	tt := newTestTypedTrie()
+
+	values := map[string]int64{"alice": 100, "bob": 200, "carol": 300}
+	for k, v := range values {
+		_, err := tt.Put(k, &AState{balance: v})
+		require.NoError(t, err)
+	}
+
+	var sum int64
+	var count int
+	err := tt.Iterate(context.TODO(), func(_ context.Context, path Path, v *AState) error {
+		count++
+		sum += v.balance
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	require.Equal(t, int64(600), sum)
+}
@@ -0,0 +1,402 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/0chain/common/core/logging"
+	"go.uber.org/zap"
+)
+
+// ErrUsageNotAccounted - the storage usage of the prefix is not accounted
+var ErrUsageNotAccounted = errors.New("storage usage not accounted for the prefix")
+
+// StorageUsage - the bytes of the values and of the encoded nodes owned by a prefix. A node is owned
+// by a prefix when all the values of its subtree have paths starting with the prefix.
+type StorageUsage struct {
+	ValueBytes int64
+	NodeBytes  int64
+}
+
+func (su *StorageUsage) add(o StorageUsage, sign int64) {
+	su.ValueBytes += sign * o.ValueBytes
+	su.NodeBytes += sign * o.NodeBytes
+}
+
+// UsageDB - the storage usage of the accounted prefixes by root, the usage depends only on the root
+type UsageDB interface {
+	SaveUsage(root Key, usage map[string]StorageUsage) error
+	// Usage - the usage saved for the root, empty if none is saved
+	Usage(root Key) (map[string]StorageUsage, error)
+}
+
+// MemoryUsageDB - an in memory usage db
+type MemoryUsageDB struct {
+	usage map[string]map[string]StorageUsage
+	mutex sync.RWMutex
+}
+
+// NewMemoryUsageDB - create a new in memory usage db
+func NewMemoryUsageDB() *MemoryUsageDB {
+	return &MemoryUsageDB{usage: make(map[string]map[string]StorageUsage)}
+}
+
+// SaveUsage - implement interface
+func (mudb *MemoryUsageDB) SaveUsage(root Key, usage map[string]StorageUsage) error {
+	mudb.mutex.Lock()
+	defer mudb.mutex.Unlock()
+	saved := make(map[string]StorageUsage, len(usage))
+	for p, u := range usage {
+		saved[p] = u
+	}
+	mudb.usage[string(root)] = saved
+	return nil
+}
+
+// Usage - implement interface
+func (mudb *MemoryUsageDB) Usage(root Key) (map[string]StorageUsage, error) {
+	mudb.mutex.RLock()
+	defer mudb.mutex.RUnlock()
+	usage := make(map[string]StorageUsage, len(mudb.usage[string(root)]))
+	for p, u := range mudb.usage[string(root)] {
+		usage[p] = u
+	}
+	return usage, nil
+}
+
+// encodeUsage - for each prefix in order, prefix length uvarint | prefix | value bytes varint | node bytes varint
+func encodeUsage(usage map[string]StorageUsage) []byte {
+	prefixes := make([]string, 0, len(usage))
+	for p := range usage {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	var buf []byte
+	for _, p := range prefixes {
+		buf = binary.AppendUvarint(buf, uint64(len(p)))
+		buf = append(buf, p...)
+		buf = binary.AppendVarint(buf, usage[p].ValueBytes)
+		buf = binary.AppendVarint(buf, usage[p].NodeBytes)
+	}
+	return buf
+}
+
+func decodeUsage(data []byte) (map[string]StorageUsage, error) {
+	usage := make(map[string]StorageUsage)
+	for len(data) > 0 {
+		n, l := binary.Uvarint(data)
+		if l <= 0 || uint64(len(data)-l) < n {
+			return nil, ErrInvalidEncoding
+		}
+		data = data[l:]
+		p := string(data[:n])
+		data = data[n:]
+		var su StorageUsage
+		for _, v := range []*int64{&su.ValueBytes, &su.NodeBytes} {
+			if *v, l = binary.Varint(data); l <= 0 {
+				return nil, ErrInvalidEncoding
+			}
+			data = data[l:]
+		}
+		usage[p] = su
+	}
+	return usage, nil
+}
+
+// SetStorageAccounting - account the bytes of the values and the nodes owned by the prefixes. The usage
+// is updated by the writes of Insert and Delete and saved with the changes in the usage db if any.
+// The usage of the current root is loaded from the usage db, the prefixes with no saved usage are
+// counted by a walk of their subtrees, as are all the prefixes after changes made by other means.
+func (mpt *MerklePatriciaTrie) SetStorageAccounting(udb UsageDB, prefixes ...Path) error {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	mpt.usageDB = udb
+	mpt.usagePrefixes = prefixes
+	mpt.usage = nil
+	if len(prefixes) == 0 {
+		return nil
+	}
+	usage, err := mpt.usageAt()
+	if err != nil {
+		return err
+	}
+	mpt.usage, mpt.usageRoot = usage, mpt.root
+	return nil
+}
+
+// StorageUsage - the storage usage of an accounted prefix
+func (mpt *MerklePatriciaTrie) StorageUsage(prefix Path) (StorageUsage, error) {
+	mpt.mutex.Lock()
+	defer mpt.mutex.Unlock()
+	if !mpt.usageAccounts(prefix) {
+		return StorageUsage{}, ErrUsageNotAccounted
+	}
+	if !mpt.usageValid() {
+		usage, err := mpt.usageAt()
+		if err != nil {
+			return StorageUsage{}, err
+		}
+		mpt.usage, mpt.usageRoot = usage, mpt.root
+	}
+	return mpt.usage[string(prefix)], nil
+}
+
+// usageAccounts - unsafe, true if the usage of the prefix is accounted
+func (mpt *MerklePatriciaTrie) usageAccounts(prefix Path) bool {
+	for _, p := range mpt.usagePrefixes {
+		if bytes.Equal(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// usageValid - unsafe, true if the usage is accounted and up to date with the root
+func (mpt *MerklePatriciaTrie) usageValid() bool {
+	return mpt.usage != nil && bytes.Equal(mpt.usageRoot, mpt.root)
+}
+
+// usageAt - unsafe, the usage of the accounted prefixes at the root, from the usage db or counted
+func (mpt *MerklePatriciaTrie) usageAt() (map[string]StorageUsage, error) {
+	var saved map[string]StorageUsage
+	if mpt.usageDB != nil && len(mpt.root) > 0 {
+		var err error
+		if saved, err = mpt.usageDB.Usage(mpt.root); err != nil {
+			return nil, err
+		}
+	}
+	usage := make(map[string]StorageUsage, len(mpt.usagePrefixes))
+	for _, p := range mpt.usagePrefixes {
+		if su, ok := saved[string(p)]; ok {
+			usage[string(p)] = su
+			continue
+		}
+		su, err := mpt.prefixUsage(p)
+		if err != nil {
+			return nil, err
+		}
+		usage[string(p)] = su
+	}
+	return usage, nil
+}
+
+// prefixUsage - unsafe, count the usage of the prefix by a walk of its subtree
+func (mpt *MerklePatriciaTrie) prefixUsage(prefix Path) (StorageUsage, error) {
+	var su StorageUsage
+	node, _, err := mpt.findPrefixNode(prefix)
+	if err != nil || node == nil {
+		return su, err
+	}
+	var walk func(node Node) error
+	walk = func(node Node) error {
+		su.add(nodeUsage(node), 1)
+		var children []Key
+		switch nodeImpl := node.(type) {
+		case *FullNode:
+			for _, pe := range PathElements {
+				if ckey := nodeImpl.GetChild(pe); ckey != nil {
+					children = append(children, ckey)
+				}
+			}
+		case *ExtensionNode:
+			children = append(children, nodeImpl.NodeKey)
+		}
+		for _, ckey := range children {
+			cnode, err := mpt.getNode(ckey)
+			if err != nil {
+				return err
+			}
+			if err := walk(cnode); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return su, walk(node)
+}
+
+// saveUsage - unsafe, save the usage of the root in the usage db, the usage counted again is
+// returned to be kept for the root
+func (mpt *MerklePatriciaTrie) saveUsage() map[string]StorageUsage {
+	if mpt.usageDB == nil || len(mpt.usagePrefixes) == 0 || len(mpt.root) == 0 {
+		return nil
+	}
+	var counted map[string]StorageUsage
+	usage := mpt.usage
+	if !mpt.usageValid() {
+		var err error
+		if usage, err = mpt.usageAt(); err != nil {
+			logging.Logger.Error("MPT save usage - count usage failed",
+				zap.Int64("round", int64(mpt.Version)),
+				zap.Error(err))
+			return nil
+		}
+		counted = usage
+	}
+	if err := mpt.usageDB.SaveUsage(mpt.root, usage); err != nil {
+		logging.Logger.Error("MPT save usage failed",
+			zap.Int64("round", int64(mpt.Version)),
+			zap.Error(err))
+	}
+	return counted
+}
+
+func nodeUsage(node Node) StorageUsage {
+	su := StorageUsage{NodeBytes: int64(len(node.Encode()))}
+	switch nodeImpl := node.(type) {
+	case *LeafNode:
+		su.ValueBytes = int64(len(nodeImpl.GetValueBytes()))
+	case *FullNode:
+		su.ValueBytes = int64(len(nodeImpl.GetValueBytes()))
+	}
+	return su
+}
+
+// nodeOwned - true if the node at the position is owned by the prefix
+func nodeOwned(node Node, position, prefix Path) bool {
+	switch nodeImpl := node.(type) {
+	case *LeafNode:
+		return bytes.HasPrefix(concat(position, nodeImpl.Path...), prefix)
+	case *ExtensionNode:
+		return bytes.HasPrefix(concat(position, nodeImpl.Path...), prefix)
+	case *FullNode:
+		return bytes.HasPrefix(position, prefix)
+	default:
+		panic(fmt.Sprintf("unknown node type: %T %v", node, node))
+	}
+}
+
+// nodeLog - the nodes added and removed by the writes
+type nodeLog struct {
+	added   map[string]Node
+	removed map[string]Node
+}
+
+// pathNodes - the nodes on the paths of the writes and the positions of them and of their children
+// by node key, the writes only change these nodes
+type pathNodes struct {
+	positions map[string]Path
+	nodes     map[string]Node
+}
+
+// walkPathNodes - unsafe, the nodes on the paths
+func (mpt *MerklePatriciaTrie) walkPathNodes(paths ...Path) (*pathNodes, error) {
+	pn := &pathNodes{positions: make(map[string]Path), nodes: make(map[string]Node)}
+	for _, path := range paths {
+		if err := mpt.walkPath(pn, path); err != nil {
+			return nil, err
+		}
+	}
+	return pn, nil
+}
+
+// walkPath - unsafe, add the nodes on the path
+func (mpt *MerklePatriciaTrie) walkPath(pn *pathNodes, path Path) error {
+	var (
+		key      = mpt.root
+		position = Path("")
+	)
+	for key != nil {
+		node, err := mpt.getNode(key)
+		if err != nil {
+			return err
+		}
+		pn.positions[string(key)] = position
+		pn.nodes[string(key)] = node
+		switch nodeImpl := node.(type) {
+		case *FullNode:
+			for _, pe := range PathElements {
+				if ckey := nodeImpl.GetChild(pe); ckey != nil {
+					pn.positions[string(ckey)] = concat(position, pe)
+				}
+			}
+			if len(path) == 0 {
+				return nil
+			}
+			key, position, path = nodeImpl.GetChild(path[0]), concat(position, path[0]), path[1:]
+		case *ExtensionNode:
+			pn.positions[string(nodeImpl.NodeKey)] = concat(position, nodeImpl.Path...)
+			if !bytes.HasPrefix(path, nodeImpl.Path) {
+				return nil
+			}
+			key, position, path = nodeImpl.NodeKey, concat(position, nodeImpl.Path...), path[len(nodeImpl.Path):]
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// startAccounting - unsafe, start logging the nodes changed by the writes at the paths when the usage
+// is up to date, returns the nodes on the paths before the writes
+func (mpt *MerklePatriciaTrie) startAccounting(paths ...Path) *pathNodes {
+	if mpt.subPrefix != nil || !mpt.usageValid() {
+		return nil
+	}
+	before, err := mpt.walkPathNodes(paths...)
+	if err != nil {
+		// counted again when needed
+		mpt.usage = nil
+		return nil
+	}
+	mpt.nodeLog = &nodeLog{added: make(map[string]Node), removed: make(map[string]Node)}
+	return before
+}
+
+// finishAccounting - unsafe, update the usage with the nodes changed by the writes at the paths.
+// A failed write leaves the usage to be counted again if the root changed.
+func (mpt *MerklePatriciaTrie) finishAccounting(before *pathNodes, failed bool, paths ...Path) {
+	log := mpt.nodeLog
+	mpt.nodeLog = nil
+	if log == nil || failed {
+		return
+	}
+	after, err := mpt.walkPathNodes(paths...)
+	if err != nil {
+		mpt.usage = nil
+		return
+	}
+	// the nodes dropped from the paths without being deleted, such as a full node left with
+	// a single child and no value, are removed too
+	for h, node := range before.nodes {
+		if _, ok := after.positions[h]; !ok {
+			log.removed[h] = node
+		}
+	}
+	apply := func(nodes map[string]Node, positions map[string]Path, sign int64) {
+		for h, node := range nodes {
+			position, ok := positions[h]
+			if !ok {
+				// added and removed by the writes
+				continue
+			}
+			for _, p := range mpt.usagePrefixes {
+				if nodeOwned(node, position, p) {
+					su := mpt.usage[string(p)]
+					su.add(nodeUsage(node), sign)
+					mpt.usage[string(p)] = su
+				}
+			}
+		}
+	}
+	apply(log.removed, before.positions, -1)
+	apply(log.added, after.positions, 1)
+	mpt.usageRoot = mpt.root
+}
+
+// logNodeChange - unsafe, log the node change of the accounted writes
+func (mpt *MerklePatriciaTrie) logNodeChange(oldNode, newNode Node) {
+	if mpt.nodeLog == nil {
+		return
+	}
+	if newNode != nil {
+		mpt.nodeLog.added[string(newNode.GetHashBytes())] = newNode
+	}
+	if oldNode != nil {
+		mpt.nodeLog.removed[string(oldNode.GetHashBytes())] = oldNode
+	}
+}
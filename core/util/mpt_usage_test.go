@@ -0,0 +1,155 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/0chain/common/core/statecache"
+)
+
+var usageTestPrefixes = []Path{Path(""), Path("0"), Path("a1"), Path("a1b")}
+
+// requireUsageCounted - the accounted usage is the usage counted by a walk of the prefixes
+func requireUsageCounted(t *testing.T, mpt *MerklePatriciaTrie) {
+	for _, p := range usageTestPrefixes {
+		su, err := mpt.StorageUsage(p)
+		require.NoError(t, err)
+		counted, err := mpt.prefixUsage(p)
+		require.NoError(t, err)
+		require.Equal(t, counted, su, string(p))
+	}
+}
+
+func TestMerklePatriciaTrie_StorageUsage(t *testing.T) {
+	mpt := NewMerklePatriciaTrie(NewMemoryNodeDB(), Sequence(1), nil, statecache.NewEmpty())
+	require.NoError(t, mpt.SetStorageAccounting(nil, usageTestPrefixes...))
+
+	// the values on the full nodes and the leaves split or merged by the writes of the other prefixes
+	paths := []Path{Path("a"), Path("a1"), Path("a1b"), Path("a1b2"), Path("a2"), Path("0"), Path("01")}
+	for i := 0; i < 100; i++ {
+		paths = append(paths, flatTestPath(i))
+	}
+	rng := rand.New(rand.NewSource(1))
+	present := make(map[string]bool)
+	for i := 0; i < 600; i++ {
+		p := paths[rng.Intn(len(paths))]
+		if present[string(p)] && rng.Intn(2) == 0 {
+			_, err := mpt.Delete(p)
+			require.NoError(t, err)
+			delete(present, string(p))
+		} else {
+			_, err := mpt.Insert(p, &Txn{fmt.Sprintf("value_%d", i)})
+			require.NoError(t, err)
+			present[string(p)] = true
+		}
+		// updated by the write, not counted again
+		require.True(t, mpt.usageValid())
+		if i%20 == 0 {
+			requireUsageCounted(t, mpt)
+		}
+	}
+	requireUsageCounted(t, mpt)
+
+	su, err := mpt.StorageUsage(Path("a1b"))
+	require.NoError(t, err)
+	require.NotZero(t, su.ValueBytes)
+	require.NotZero(t, su.NodeBytes)
+	_, err = mpt.StorageUsage(Path("a2"))
+	require.Equal(t, ErrUsageNotAccounted, err)
+}
+
+func TestMerklePatriciaTrie_StorageUsagePersisted(t *testing.T) {
+	var (
+		ndb = NewMemoryNodeDB()
+		udb = NewMemoryUsageDB()
+	)
+	mpt := NewMerklePatriciaTrie(ndb, Sequence(1), nil, statecache.NewEmpty())
+	require.NoError(t, mpt.SetStorageAccounting(udb, usageTestPrefixes...))
+	for i := 0; i < 50; i++ {
+		_, err := mpt.Insert(flatTestPath(i), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+		_, err = mpt.Insert(concat(Path("0"), flatTestPath(i)...), &Txn{fmt.Sprintf("value_%d", i)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+	root := mpt.GetRoot()
+
+	saved, err := udb.Usage(root)
+	require.NoError(t, err)
+	require.Len(t, saved, len(usageTestPrefixes))
+	su, err := mpt.StorageUsage(Path("0"))
+	require.NoError(t, err)
+	require.Equal(t, su, saved["0"])
+
+	// loaded from the usage db
+	saved["0"] = StorageUsage{ValueBytes: 1, NodeBytes: 2}
+	require.NoError(t, udb.SaveUsage(root, saved))
+	mpt = NewMerklePatriciaTrie(ndb, Sequence(2), root, statecache.NewEmpty())
+	require.NoError(t, mpt.SetStorageAccounting(udb, usageTestPrefixes...))
+	su, err = mpt.StorageUsage(Path("0"))
+	require.NoError(t, err)
+	require.Equal(t, StorageUsage{ValueBytes: 1, NodeBytes: 2}, su)
+
+	// counted again after the changes not made by Insert and Delete
+	require.NoError(t, udb.SaveUsage(root, nil))
+	mpt = NewMerklePatriciaTrie(ndb, Sequence(2), root, statecache.NewEmpty())
+	require.NoError(t, mpt.SetStorageAccounting(udb, usageTestPrefixes...))
+	_, err = mpt.DeletePrefix(Path("0"))
+	require.NoError(t, err)
+	require.False(t, mpt.usageValid())
+	requireUsageCounted(t, mpt)
+
+	// counted on save while the readers wait
+	_, err = mpt.DeletePrefix(Path("a"))
+	require.NoError(t, err)
+	require.False(t, mpt.usageValid())
+	errC := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; i < 100 && err == nil; i++ {
+			_, err = mpt.StorageUsage(Path(""))
+		}
+		errC <- err
+	}()
+	require.NoError(t, mpt.SaveChanges(context.TODO(), ndb, false))
+	require.NoError(t, <-errC)
+	require.True(t, mpt.usageValid())
+	requireUsageCounted(t, mpt)
+	su, err = mpt.StorageUsage(Path("0"))
+	require.NoError(t, err)
+	require.Equal(t, StorageUsage{}, su)
+}
+
+func TestPNodeDB_Usage(t *testing.T) {
+	pndb, cleanup := newPNodeDB(t)
+	defer cleanup()
+
+	usage, err := pndb.Usage(Key("root"))
+	require.NoError(t, err)
+	require.Empty(t, usage)
+
+	saved := map[string]StorageUsage{
+		"":   {ValueBytes: 100, NodeBytes: 300},
+		"0a": {ValueBytes: 10, NodeBytes: 30},
+	}
+	require.NoError(t, pndb.SaveUsage(Key("root"), saved))
+	usage, err = pndb.Usage(Key("root"))
+	require.NoError(t, err)
+	require.Equal(t, saved, usage)
+
+	// pruned with the registered roots
+	require.NoError(t, pndb.MultiPutNodeWithRoot(nil, nil, 1, Key("root")))
+	require.NoError(t, pndb.MultiPutNodeWithRoot(nil, nil, 2, Key("root2")))
+	require.NoError(t, pndb.SaveUsage(Key("root2"), saved))
+	require.NoError(t, pndb.PruneBelowVersion(context.TODO(), 2))
+	usage, err = pndb.Usage(Key("root"))
+	require.NoError(t, err)
+	require.Empty(t, usage)
+	usage, err = pndb.Usage(Key("root2"))
+	require.NoError(t, err)
+	require.Equal(t, saved, usage)
+}